@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tidepool-org/marketo-service/backfill"
+	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+// backfillUsers refreshes the users matching the filters. Mutations are persisted in
+// the outbox and are delivered to marketo by the running service.
+func backfillUsers(args []string) {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	name := flags.String("name", "backfill", "name of the checkpoint used to resume the backfill")
+	since := flags.String("since", "", "refresh users modified at or after this RFC3339 time")
+	until := flags.String("until", "", "refresh users modified before this RFC3339 time")
+	role := flags.String("role", "", "refresh only the users with this role")
+	userIdsFile := flags.String("user-ids-file", "", "refresh only the users in this file, one user id per line")
+	batchSize := flags.Int("batch-size", backfill.DefaultBatchSize, "number of users read from the store at once")
+	concurrency := flags.Int("concurrency", backfill.DefaultConcurrency, "number of users refreshed concurrently")
+	rate := flags.Float64("rate", 10, "max number of users refreshed per second, 0 disables the limit")
+	force := flags.Bool("force", false, "send users to marketo even if nothing has changed since the last sync")
+	reset := flags.Bool("reset", false, "discard the checkpoint and start from the beginning")
+	if err := flags.Parse(args); err != nil {
+		log.Fatalln(err)
+	}
+
+	config := backfill.Config{
+		Name:        *name,
+		BatchSize:   *batchSize,
+		Concurrency: *concurrency,
+		Rate:        *rate,
+		Force:       *force,
+		Reset:       *reset,
+	}
+	// Users which haven't verified their email or accepted the terms are not synced to marketo
+	verified := true
+	config.Filter.EmailVerified = &verified
+	config.Filter.TermsAccepted = &verified
+	if *role != "" {
+		config.Filter.Roles = []string{*role}
+	}
+	var err error
+	if config.Filter.ModifiedSince, err = parseTime(*since); err != nil {
+		log.Fatalf("since is invalid: %v", err)
+	}
+	if config.Filter.ModifiedUntil, err = parseTime(*until); err != nil {
+		log.Fatalf("until is invalid: %v", err)
+	}
+	if *userIdsFile != "" {
+		if config.Filter.UserIDs, err = readUserIds(*userIdsFile); err != nil {
+			log.Fatalf("unable to read user ids: %v", err)
+		}
+		if len(config.Filter.UserIDs) == 0 {
+			log.Fatalln("user ids file is empty")
+		}
+	}
+
+	deps := buildDependencies()
+	defer deps.mongoStore.Disconnect(context.Background())
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	ctx = marketo.ContextWithSource(ctx, store.AuditSource{Type: store.AuditSourceBackfill, Name: config.Name})
+
+	result, err := backfill.NewBackfill(deps.logger, deps.mongoStore, deps.userEventsHandler, config).Run(ctx)
+	log.Printf("processed %d users, %d failed, completed %v", result.Processed, result.Failed, result.Completed)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// parseTime normalizes the time to the format of the times in the users collection
+func parseTime(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format(time.RFC3339), nil
+}
+
+func readUserIds(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var userIds []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if userId := strings.TrimSpace(scanner.Text()); userId != "" {
+			userIds = append(userIds, userId)
+		}
+	}
+	return userIds, scanner.Err()
+}
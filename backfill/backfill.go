@@ -0,0 +1,216 @@
+package backfill
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+const (
+	DefaultBatchSize   = 100
+	DefaultConcurrency = 4
+)
+
+// Store provides the candidate users and persists the checkpoint of the backfill
+type Store interface {
+	StreamUsers(ctx context.Context, filter *store.UsersFilter, after string, batchSize int) (store.UsersIterator, error)
+	store.CheckpointRepository
+}
+
+// Refresher sends the current state of a user to marketo
+type Refresher interface {
+	RefreshUser(ctx context.Context, userId string, force bool) error
+}
+
+// Config is the configuration of a backfill
+type Config struct {
+	// Name identifies the checkpoint of the backfill
+	Name        string
+	Filter      store.UsersFilter
+	BatchSize   int
+	Concurrency int
+	// Rate is the max number of users refreshed per second, zero disables the limit
+	Rate  float64
+	Force bool
+	// Reset discards the existing checkpoint and starts from the beginning
+	Reset bool
+}
+
+// Result summarizes a backfill
+type Result struct {
+	Processed int
+	Failed    int
+	Completed bool
+}
+
+// Backfill refreshes the users matching the filter in the order they were created. The
+// checkpoint is updated after each batch, so an interrupted backfill can be resumed.
+type Backfill struct {
+	logger    *log.Logger
+	store     Store
+	refresher Refresher
+	config    Config
+}
+
+func NewBackfill(logger *log.Logger, store Store, refresher Refresher, config Config) *Backfill {
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = DefaultConcurrency
+	}
+	return &Backfill{
+		logger:    logger,
+		store:     store,
+		refresher: refresher,
+		config:    config,
+	}
+}
+
+// Run refreshes the users starting after the position of the checkpoint
+func (b *Backfill) Run(ctx context.Context) (Result, error) {
+	checkpoint, err := b.checkpoint(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	if checkpoint.Completed {
+		b.logger.Printf("backfill %s is already completed", b.config.Name)
+		return result(checkpoint), nil
+	}
+	if checkpoint.Position != "" {
+		b.logger.Printf("resuming backfill %s after position %s", b.config.Name, checkpoint.Position)
+	}
+	var throttle <-chan time.Time
+	if b.config.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / b.config.Rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	users, err := b.store.StreamUsers(ctx, &b.config.Filter, checkpoint.Position, b.config.BatchSize)
+	if err != nil {
+		return result(checkpoint), err
+	}
+	defer users.Close(context.Background())
+
+	batch := make([]*store.User, 0, b.config.BatchSize)
+	position := checkpoint.Position
+	flush := func() error {
+		failed, err := b.refresh(ctx, batch, throttle)
+		if err != nil {
+			// The batch was interrupted, it will be processed again when the backfill is resumed
+			return err
+		}
+		checkpoint.Position = position
+		checkpoint.Processed += len(batch)
+		checkpoint.Failed += failed
+		batch = batch[:0]
+		if err := b.store.UpsertCheckpoint(ctx, checkpoint); err != nil {
+			return err
+		}
+		b.logger.Printf("backfill %s processed %d users, %d failed", b.config.Name, checkpoint.Processed, checkpoint.Failed)
+		return nil
+	}
+
+	for users.Next(ctx) {
+		batch = append(batch, users.User())
+		position = users.Position()
+		if len(batch) == b.config.BatchSize {
+			if err := flush(); err != nil {
+				return result(checkpoint), err
+			}
+		}
+	}
+	if err := users.Err(); err != nil {
+		return result(checkpoint), err
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return result(checkpoint), err
+		}
+	}
+	checkpoint.Completed = true
+	return result(checkpoint), b.store.UpsertCheckpoint(ctx, checkpoint)
+}
+
+// refresh refreshes a batch of users with the configured concurrency and returns the number of failures
+func (b *Backfill) refresh(ctx context.Context, users []*store.User, throttle <-chan time.Time) (int, error) {
+	userIds := make(chan string)
+	var failed int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < b.config.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for userId := range userIds {
+				if err := b.refresher.RefreshUser(ctx, userId, b.config.Force); err != nil {
+					b.logger.Printf("unable to refresh user %v: %v", userId, err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	var err error
+dispatch:
+	for _, user := range users {
+		if throttle != nil {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				break dispatch
+			case <-throttle:
+			}
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break dispatch
+		case userIds <- user.Id:
+		}
+	}
+	close(userIds)
+	wg.Wait()
+	return failed, err
+}
+
+// checkpoint returns the checkpoint of the backfill, or a new checkpoint if the backfill
+// is started from the beginning
+func (b *Backfill) checkpoint(ctx context.Context) (*store.Checkpoint, error) {
+	params, err := json.Marshal(b.config.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if !b.config.Reset {
+		checkpoint, err := b.store.FindCheckpoint(ctx, b.config.Name)
+		if err != nil {
+			return nil, err
+		}
+		if checkpoint != nil {
+			if checkpoint.Params != string(params) {
+				return nil, fmt.Errorf("checkpoint %s was created with different filters %s", b.config.Name, checkpoint.Params)
+			}
+			return checkpoint, nil
+		}
+	}
+	return &store.Checkpoint{
+		Name:   b.config.Name,
+		Params: string(params),
+	}, nil
+}
+
+func result(checkpoint *store.Checkpoint) Result {
+	return Result{
+		Processed: checkpoint.Processed,
+		Failed:    checkpoint.Failed,
+		Completed: checkpoint.Completed,
+	}
+}
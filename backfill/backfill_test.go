@@ -0,0 +1,72 @@
+package backfill_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/tidepool-org/marketo-service/backfill"
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+type RefresherMock struct {
+	mu        sync.Mutex
+	Refreshed []string
+	Failing   map[string]bool
+}
+
+func (r *RefresherMock) RefreshUser(ctx context.Context, userId string, force bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Refreshed = append(r.Refreshed, userId)
+	if r.Failing[userId] {
+		return errors.New("refresh failed")
+	}
+	return nil
+}
+
+func Test_Backfill_Resumes_From_Checkpoint(t *testing.T) {
+	logger := log.New(os.Stdout, "backfill-test", log.LstdFlags)
+	ctx := context.Background()
+	users := store.NewMemoryStore()
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		_ = users.UpsertUser(ctx, &store.User{Id: id})
+	}
+	config := backfill.Config{Name: "test", BatchSize: 2, Concurrency: 2}
+
+	// The first two users were processed by a previous run
+	params, _ := json.Marshal(config.Filter)
+	second, _ := users.FindUser(ctx, "2")
+	_ = users.UpsertCheckpoint(ctx, &store.Checkpoint{Name: "test", Params: string(params), Position: second.ObjectID.Hex(), Processed: 2})
+
+	refresher := &RefresherMock{Failing: map[string]bool{"4": true}}
+	result, err := backfill.NewBackfill(logger, users, refresher, config).Run(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(refresher.Refreshed) != 3 {
+		t.Errorf("Expected users 3 to 5 to be refreshed, got %v", refresher.Refreshed)
+	}
+	if result.Processed != 5 || result.Failed != 1 || !result.Completed {
+		t.Errorf("Expected 5 processed users with 1 failure, got %+v", result)
+	}
+
+	// A completed backfill is not repeated
+	refresher = &RefresherMock{}
+	if _, err := backfill.NewBackfill(logger, users, refresher, config).Run(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(refresher.Refreshed) != 0 {
+		t.Errorf("Expected no refreshed users, got %v", refresher.Refreshed)
+	}
+
+	// The checkpoint can't be resumed with different filters
+	config.Filter.Roles = []string{"clinic"}
+	if _, err := backfill.NewBackfill(logger, users, refresher, config).Run(ctx); err == nil {
+		t.Errorf("Expected an error when resuming with different filters")
+	}
+}
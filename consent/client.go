@@ -0,0 +1,71 @@
+package consent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tidepool-org/go-common/clients/shoreline"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+)
+
+// TokenProvider returns the server token used to authenticate the requests
+type TokenProvider interface {
+	TokenProvide() string
+}
+
+// Consent is the marketing consent of a user as it's returned by the consent service
+type Consent struct {
+	Level marketo.ConsentLevel `json:"level"`
+}
+
+var _ marketo.ConsentResolver = &Client{}
+
+// Client fetches the marketing consent of users from the consent service
+type Client struct {
+	host           string
+	httpClient     *http.Client
+	tokens         TokenProvider
+	withoutConsent marketo.ConsentLevel
+}
+
+// NewClient returns a client of the consent service. Users without a consent record have the withoutConsent level.
+func NewClient(host string, httpClient *http.Client, tokens TokenProvider, withoutConsent marketo.ConsentLevel) *Client {
+	return &Client{
+		host:           strings.TrimSuffix(host, "/"),
+		httpClient:     httpClient,
+		tokens:         tokens,
+		withoutConsent: withoutConsent,
+	}
+}
+
+// MarketingConsent returns the marketing consent level of the user
+func (c *Client) MarketingConsent(ctx context.Context, tidepoolID string, user shoreline.UserData) (marketo.ConsentLevel, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.host+"/v1/users/"+url.PathEscape(tidepoolID)+"/marketing-consent", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("x-tidepool-session-token", c.tokens.TokenProvide())
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return c.withoutConsent, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %v when fetching marketing consent of user %v", res.StatusCode, tidepoolID)
+	}
+
+	consent := Consent{}
+	if err := json.NewDecoder(res.Body).Decode(&consent); err != nil {
+		return "", fmt.Errorf("unable to decode marketing consent of user %v: %w", tidepoolID, err)
+	}
+	return consent.Level, nil
+}
@@ -0,0 +1,62 @@
+package consent_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tidepool-org/go-common/clients/shoreline"
+
+	"github.com/tidepool-org/marketo-service/consent"
+	"github.com/tidepool-org/marketo-service/marketo"
+)
+
+type TokenProviderMock struct{}
+
+func (t TokenProviderMock) TokenProvide() string {
+	return "server-token"
+}
+
+func Test_Client_MarketingConsent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-tidepool-session-token") != "server-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/users/1234/marketing-consent":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"level": "full"}`))
+		case "/v1/users/5678/marketing-consent":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	client := consent.NewClient(server.URL, server.Client(), TokenProviderMock{}, marketo.ConsentNone)
+	ctx := context.Background()
+
+	tests := []struct {
+		name          string
+		userId        string
+		expected      marketo.ConsentLevel
+		expectedError bool
+	}{
+		{name: "consent record", userId: "1234", expected: marketo.ConsentFull},
+		{name: "no consent record", userId: "5678", expected: marketo.ConsentNone},
+		{name: "unexpected status code", userId: "9999", expectedError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			level, err := client.MarketingConsent(ctx, tt.userId, shoreline.UserData{UserID: tt.userId})
+			if (err != nil) != tt.expectedError {
+				t.Fatalf("Expected error %v, got %v", tt.expectedError, err)
+			}
+			if level != tt.expected {
+				t.Errorf("Expected consent level %v, got %v", tt.expected, level)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package deadletter
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/tidepool-org/go-common/events"
+)
+
+// Headers added to dead-letter records in addition to the headers of the original record
+const (
+	ErrorHeader     = "x-dead-letter-error"
+	AttemptsHeader  = "x-dead-letter-attempts"
+	TopicHeader     = "x-dead-letter-source-topic"
+	PartitionHeader = "x-dead-letter-source-partition"
+	OffsetHeader    = "x-dead-letter-source-offset"
+	TimeHeader      = "x-dead-letter-time"
+)
+
+const (
+	DefaultAttempts = 3
+	DefaultDelay    = time.Second
+)
+
+var _ events.MessageConsumer = &Consumer{}
+
+// Consumer retries the messages which couldn't be handled by the delegate and publishes
+// them to the dead-letter topic once all attempts have failed. If the dead-letter topic
+// is not configured the error is returned and the message is not committed.
+// The consumer can be reused when the consumer group is restarted, in which case the
+// dead-letter producer is reused as well.
+type Consumer struct {
+	delegate events.MessageConsumer
+	producer sarama.SyncProducer
+	topic    string
+	attempts int
+	delay    time.Duration
+}
+
+// Option configures a Consumer
+type Option func(c *Consumer)
+
+// WithRetries sets the number of attempts and the delay which is multiplied by the attempt number
+func WithRetries(attempts int, delay time.Duration) Option {
+	return func(c *Consumer) {
+		c.attempts = attempts
+		c.delay = delay
+	}
+}
+
+// WithProducer publishes the dead letters to the topic with the producer instead of creating a
+// producer from the config of the consumer
+func WithProducer(producer sarama.SyncProducer, topic string) Option {
+	return func(c *Consumer) {
+		c.producer = producer
+		c.topic = topic
+	}
+}
+
+// NewConsumer wraps the delegate with the default retry settings
+func NewConsumer(delegate events.MessageConsumer, opts ...Option) *Consumer {
+	c := &Consumer{
+		delegate: delegate,
+		attempts: DefaultAttempts,
+		delay:    DefaultDelay,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *Consumer) Initialize(config *events.CloudEventsConfig) error {
+	if err := c.delegate.Initialize(config); err != nil {
+		return err
+	}
+	if !config.IsDeadLettersEnabled() || c.producer != nil {
+		return nil
+	}
+
+	// We are using a sync producer which requires setting the variables below
+	config.SaramaConfig.Producer.Return.Errors = true
+	config.SaramaConfig.Producer.Return.Successes = true
+	producer, err := sarama.NewSyncProducer(config.KafkaBrokers, config.SaramaConfig)
+	if err != nil {
+		return err
+	}
+	c.producer = producer
+	c.topic = config.GetDeadLettersTopic()
+	return nil
+}
+
+func (c *Consumer) HandleKafkaMessage(cm *sarama.ConsumerMessage) error {
+	var err error
+	attempt := 0
+	for attempt < c.attempts {
+		attempt++
+		if err = c.delegate.HandleKafkaMessage(cm); err == nil {
+			return nil
+		}
+		log.Printf("failed to handle message %v/%v/%v (attempt %v): %v", cm.Topic, cm.Partition, cm.Offset, attempt, err)
+		if attempt < c.attempts {
+			time.Sleep(c.delay * time.Duration(attempt))
+		}
+	}
+	if c.producer == nil {
+		return err
+	}
+
+	log.Printf("Sending message %v/%v/%v to dead-letter topic %v", cm.Topic, cm.Partition, cm.Offset, c.topic)
+	if _, _, sendErr := c.producer.SendMessage(NewMessage(c.topic, cm, err, attempt)); sendErr != nil {
+		return fmt.Errorf("unable to send message to dead-letter topic: %w: %s", sendErr, err.Error())
+	}
+	return nil
+}
+
+// NewMessage creates a dead-letter record with the key, value and headers of the original
+// message and the error metadata
+func NewMessage(topic string, cm *sarama.ConsumerMessage, err error, attempts int) *sarama.ProducerMessage {
+	headers := make([]sarama.RecordHeader, 0, len(cm.Headers)+6)
+	for _, h := range cm.Headers {
+		if h != nil {
+			headers = append(headers, *h)
+		}
+	}
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte(ErrorHeader), Value: []byte(err.Error())},
+		sarama.RecordHeader{Key: []byte(AttemptsHeader), Value: []byte(strconv.Itoa(attempts))},
+		sarama.RecordHeader{Key: []byte(TopicHeader), Value: []byte(cm.Topic)},
+		sarama.RecordHeader{Key: []byte(PartitionHeader), Value: []byte(strconv.FormatInt(int64(cm.Partition), 10))},
+		sarama.RecordHeader{Key: []byte(OffsetHeader), Value: []byte(strconv.FormatInt(cm.Offset, 10))},
+		sarama.RecordHeader{Key: []byte(TimeHeader), Value: []byte(time.Now().UTC().Format(time.RFC3339))},
+	)
+
+	message := &sarama.ProducerMessage{
+		Topic:   topic,
+		Headers: headers,
+	}
+	if cm.Key != nil {
+		message.Key = sarama.ByteEncoder(cm.Key)
+	}
+	if cm.Value != nil {
+		message.Value = sarama.ByteEncoder(cm.Value)
+	}
+	return message
+}
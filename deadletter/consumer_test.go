@@ -0,0 +1,148 @@
+package deadletter_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/tidepool-org/go-common/events"
+
+	"github.com/tidepool-org/marketo-service/deadletter"
+)
+
+func Test_NewMessage(t *testing.T) {
+	cm := &sarama.ConsumerMessage{
+		Topic:     "keycloak.public.user_entity",
+		Partition: 2,
+		Offset:    42,
+		Key:       []byte(`{"id":"1234"}`),
+		Value:     []byte(`{"op":"x"}`),
+		Headers:   []*sarama.RecordHeader{{Key: []byte("ce_type"), Value: []byte("test")}},
+	}
+	message := deadletter.NewMessage("dead-letters", cm, errors.New("unknown op x"), 3)
+	if message.Topic != "dead-letters" {
+		t.Errorf("Expected topic dead-letters, got %s", message.Topic)
+	}
+	key, _ := message.Key.Encode()
+	if string(key) != string(cm.Key) {
+		t.Errorf("Expected key %s, got %s", cm.Key, key)
+	}
+	value, _ := message.Value.Encode()
+	if string(value) != string(cm.Value) {
+		t.Errorf("Expected value %s, got %s", cm.Value, value)
+	}
+	headers := make(map[string]string)
+	for _, h := range message.Headers {
+		headers[string(h.Key)] = string(h.Value)
+	}
+	expected := map[string]string{
+		"ce_type":                  "test",
+		deadletter.ErrorHeader:     "unknown op x",
+		deadletter.AttemptsHeader:  "3",
+		deadletter.TopicHeader:     "keycloak.public.user_entity",
+		deadletter.PartitionHeader: "2",
+		deadletter.OffsetHeader:    "42",
+	}
+	for k, v := range expected {
+		if headers[k] != v {
+			t.Errorf("Expected header %s to be %s, got %s", k, v, headers[k])
+		}
+	}
+}
+
+type MessageConsumerMock struct {
+	Attempts int
+	// FailedAttempts is the number of attempts which fail before the message is handled
+	FailedAttempts int
+}
+
+func (m *MessageConsumerMock) Initialize(config *events.CloudEventsConfig) error {
+	return nil
+}
+
+func (m *MessageConsumerMock) HandleKafkaMessage(cm *sarama.ConsumerMessage) error {
+	m.Attempts++
+	if m.Attempts <= m.FailedAttempts {
+		return errors.New("handler failed")
+	}
+	return nil
+}
+
+type SyncProducerMock struct {
+	sarama.SyncProducer
+	Messages []*sarama.ProducerMessage
+	Err      error
+}
+
+func (p *SyncProducerMock) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.Messages = append(p.Messages, msg)
+	return 0, int64(len(p.Messages)), p.Err
+}
+
+func Test_Consumer_HandleKafkaMessage(t *testing.T) {
+	cm := &sarama.ConsumerMessage{Topic: "clinic.clinicians", Partition: 1, Offset: 7, Value: []byte(`{}`)}
+
+	tests := []struct {
+		name             string
+		failedAttempts   int
+		producer         *SyncProducerMock
+		expectedAttempts int
+		expectedMessages int
+		expectedError    string
+	}{
+		{name: "handled after a retry", failedAttempts: 1, producer: &SyncProducerMock{}, expectedAttempts: 2},
+		{name: "published after the last attempt", failedAttempts: 5, producer: &SyncProducerMock{}, expectedAttempts: 3, expectedMessages: 1},
+		{name: "dead letters disabled", failedAttempts: 5, expectedAttempts: 3, expectedError: "handler failed"},
+		{name: "publishing failed", failedAttempts: 5, producer: &SyncProducerMock{Err: errors.New("broker unavailable")}, expectedAttempts: 3, expectedMessages: 1, expectedError: "unable to send message to dead-letter topic: broker unavailable: handler failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delegate := &MessageConsumerMock{FailedAttempts: tt.failedAttempts}
+			opts := []deadletter.Option{deadletter.WithRetries(3, time.Millisecond)}
+			if tt.producer != nil {
+				opts = append(opts, deadletter.WithProducer(tt.producer, "clinic.clinicians.marketo.dead-letters"))
+			}
+			err := deadletter.NewConsumer(delegate, opts...).HandleKafkaMessage(cm)
+			if tt.expectedError == "" && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tt.expectedError != "" && (err == nil || !strings.Contains(err.Error(), tt.expectedError)) {
+				t.Fatalf("Expected error %q, got %v", tt.expectedError, err)
+			}
+			if delegate.Attempts != tt.expectedAttempts {
+				t.Errorf("Expected %d attempts, got %d", tt.expectedAttempts, delegate.Attempts)
+			}
+			if tt.producer == nil {
+				return
+			}
+			if len(tt.producer.Messages) != tt.expectedMessages {
+				t.Fatalf("Expected %d dead letters, got %d", tt.expectedMessages, len(tt.producer.Messages))
+			}
+			if tt.expectedMessages == 0 {
+				return
+			}
+			message := tt.producer.Messages[0]
+			if message.Topic != "clinic.clinicians.marketo.dead-letters" {
+				t.Errorf("Expected the dead-letter topic, got %s", message.Topic)
+			}
+			headers := make(map[string]string)
+			for _, h := range message.Headers {
+				headers[string(h.Key)] = string(h.Value)
+			}
+			expected := map[string]string{
+				deadletter.ErrorHeader:     "handler failed",
+				deadletter.AttemptsHeader:  "3",
+				deadletter.TopicHeader:     "clinic.clinicians",
+				deadletter.PartitionHeader: "1",
+				deadletter.OffsetHeader:    "7",
+			}
+			for k, v := range expected {
+				if headers[k] != v {
+					t.Errorf("Expected header %s to be %s, got %s", k, v, headers[k])
+				}
+			}
+		})
+	}
+}
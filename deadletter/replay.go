@@ -0,0 +1,243 @@
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/tidepool-org/go-common/events"
+)
+
+const headerPrefix = "x-dead-letter-"
+
+// ReplayOptions select the dead letters which are replayed. Offsets are ignored if
+// the corresponding time is set. Negative offsets and zero times are not applied.
+type ReplayOptions struct {
+	Topic        string
+	StartOffset  int64
+	EndOffset    int64
+	StartTime    time.Time
+	EndTime      time.Time
+	UserID       string
+	ErrorPattern *regexp.Regexp
+	DryRun       bool
+}
+
+// ReplayStats summarize a replay
+type ReplayStats struct {
+	Read     int
+	Matched  int
+	Replayed int
+	Failed   int
+}
+
+// Replayer reads messages from a dead-letter topic and hands the original messages
+// to the consumer which failed to handle them
+type Replayer struct {
+	client   sarama.Client
+	consumer events.MessageConsumer
+	out      io.Writer
+}
+
+func NewReplayer(client sarama.Client, consumer events.MessageConsumer, out io.Writer) *Replayer {
+	return &Replayer{
+		client:   client,
+		consumer: consumer,
+		out:      out,
+	}
+}
+
+// Replay reads all partitions of the dead-letter topic within the selected range
+func (r *Replayer) Replay(ctx context.Context, opts ReplayOptions) (ReplayStats, error) {
+	stats := ReplayStats{}
+	partitions, err := r.client.Partitions(opts.Topic)
+	if err != nil {
+		return stats, err
+	}
+	consumer, err := sarama.NewConsumerFromClient(r.client)
+	if err != nil {
+		return stats, err
+	}
+	defer consumer.Close()
+
+	for _, partition := range partitions {
+		start, end, err := r.offsetRange(opts, partition)
+		if err != nil {
+			return stats, err
+		}
+		if start >= end {
+			continue
+		}
+		if err := r.replayPartition(ctx, consumer, opts, partition, start, end, &stats); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// offsetRange returns the first offset and the offset after the last message to replay
+func (r *Replayer) offsetRange(opts ReplayOptions, partition int32) (int64, int64, error) {
+	oldest, err := r.client.GetOffset(opts.Topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, 0, err
+	}
+	newest, err := r.client.GetOffset(opts.Topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start := oldest
+	if !opts.StartTime.IsZero() {
+		offset, err := r.client.GetOffset(opts.Topic, partition, opts.StartTime.UnixMilli())
+		if err != nil {
+			return 0, 0, err
+		}
+		// There are no messages after the start time
+		if offset < 0 {
+			offset = newest
+		}
+		start = offset
+	} else if opts.StartOffset >= 0 {
+		start = opts.StartOffset
+	}
+	if start < oldest {
+		start = oldest
+	}
+
+	end := newest
+	if !opts.EndTime.IsZero() {
+		offset, err := r.client.GetOffset(opts.Topic, partition, opts.EndTime.UnixMilli())
+		if err != nil {
+			return 0, 0, err
+		}
+		if offset >= 0 && offset < end {
+			end = offset
+		}
+	} else if opts.EndOffset >= 0 && opts.EndOffset+1 < end {
+		end = opts.EndOffset + 1
+	}
+	return start, end, nil
+}
+
+func (r *Replayer) replayPartition(ctx context.Context, consumer sarama.Consumer, opts ReplayOptions, partition int32, start int64, end int64, stats *ReplayStats) error {
+	pc, err := consumer.ConsumePartition(opts.Topic, partition, start)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-pc.Errors():
+			return err
+		case message := <-pc.Messages():
+			stats.Read++
+			if Matches(message, opts) {
+				stats.Matched++
+				r.replayMessage(message, opts.DryRun, stats)
+			}
+			if message.Offset >= end-1 {
+				return nil
+			}
+		}
+	}
+}
+
+func (r *Replayer) replayMessage(message *sarama.ConsumerMessage, dryRun bool, stats *ReplayStats) {
+	original := Original(message)
+	description := fmt.Sprintf("%s/%d/%d (source %s/%d/%d) key=%s error=%q",
+		message.Topic, message.Partition, message.Offset,
+		original.Topic, original.Partition, original.Offset,
+		string(message.Key), header(message, ErrorHeader),
+	)
+	if dryRun {
+		fmt.Fprintf(r.out, "would replay %s value=%s\n", description, string(message.Value))
+		return
+	}
+	if err := r.consumer.HandleKafkaMessage(original); err != nil {
+		stats.Failed++
+		fmt.Fprintf(r.out, "failed %s: %v\n", description, err)
+		return
+	}
+	stats.Replayed++
+	fmt.Fprintf(r.out, "replayed %s\n", description)
+}
+
+// Matches returns true if the dead letter matches the user id and error filters
+func Matches(message *sarama.ConsumerMessage, opts ReplayOptions) bool {
+	if opts.ErrorPattern != nil && !opts.ErrorPattern.MatchString(header(message, ErrorHeader)) {
+		return false
+	}
+	if opts.UserID != "" {
+		for _, userID := range UserIDs(message) {
+			if userID == opts.UserID {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// UserIDs returns the possible user ids of a message. Keycloak CDC messages are keyed
+// by a json document with the user id, while user events are keyed by the user id.
+func UserIDs(message *sarama.ConsumerMessage) []string {
+	var userIDs []string
+	if len(message.Key) == 0 {
+		return userIDs
+	}
+	key := map[string]interface{}{}
+	if err := json.Unmarshal(message.Key, &key); err != nil {
+		return append(userIDs, string(message.Key))
+	}
+	for _, field := range []string{"id", "user_id", "userId"} {
+		if value, ok := key[field].(string); ok {
+			userIDs = append(userIDs, value)
+		}
+	}
+	return userIDs
+}
+
+// Original restores the message as it was received by the consumer which failed to handle it
+func Original(message *sarama.ConsumerMessage) *sarama.ConsumerMessage {
+	original := &sarama.ConsumerMessage{
+		Topic:     message.Topic,
+		Partition: message.Partition,
+		Offset:    message.Offset,
+		Key:       message.Key,
+		Value:     message.Value,
+		Timestamp: message.Timestamp,
+	}
+	for _, h := range message.Headers {
+		if h != nil && !strings.HasPrefix(string(h.Key), headerPrefix) {
+			original.Headers = append(original.Headers, h)
+		}
+	}
+	if topic := header(message, TopicHeader); topic != "" {
+		original.Topic = topic
+	}
+	if partition, err := strconv.ParseInt(header(message, PartitionHeader), 10, 32); err == nil {
+		original.Partition = int32(partition)
+	}
+	if offset, err := strconv.ParseInt(header(message, OffsetHeader), 10, 64); err == nil {
+		original.Offset = offset
+	}
+	return original
+}
+
+func header(message *sarama.ConsumerMessage, key string) string {
+	for _, h := range message.Headers {
+		if h != nil && string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
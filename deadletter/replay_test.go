@@ -0,0 +1,59 @@
+package deadletter_test
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/IBM/sarama"
+
+	"github.com/tidepool-org/marketo-service/deadletter"
+)
+
+func deadLetter() *sarama.ConsumerMessage {
+	return &sarama.ConsumerMessage{
+		Topic:     "keycloak.public.user_entity.marketo-dead-letters",
+		Partition: 0,
+		Offset:    7,
+		Key:       []byte(`{"id":"1234"}`),
+		Value:     []byte(`{"op":"x"}`),
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("ce_type"), Value: []byte("test")},
+			{Key: []byte(deadletter.ErrorHeader), Value: []byte("unknown op x")},
+			{Key: []byte(deadletter.TopicHeader), Value: []byte("keycloak.public.user_entity")},
+			{Key: []byte(deadletter.PartitionHeader), Value: []byte("2")},
+			{Key: []byte(deadletter.OffsetHeader), Value: []byte("42")},
+		},
+	}
+}
+
+func Test_Original(t *testing.T) {
+	original := deadletter.Original(deadLetter())
+	if original.Topic != "keycloak.public.user_entity" || original.Partition != 2 || original.Offset != 42 {
+		t.Errorf("Expected keycloak.public.user_entity/2/42, got %s/%d/%d", original.Topic, original.Partition, original.Offset)
+	}
+	if len(original.Headers) != 1 || string(original.Headers[0].Key) != "ce_type" {
+		t.Errorf("Expected only the original headers, got %v", original.Headers)
+	}
+}
+
+func Test_Matches(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     deadletter.ReplayOptions
+		expected bool
+	}{
+		{name: "no filters", opts: deadletter.ReplayOptions{}, expected: true},
+		{name: "matching user", opts: deadletter.ReplayOptions{UserID: "1234"}, expected: true},
+		{name: "other user", opts: deadletter.ReplayOptions{UserID: "5678"}, expected: false},
+		{name: "matching error", opts: deadletter.ReplayOptions{ErrorPattern: regexp.MustCompile("unknown op")}, expected: true},
+		{name: "other error", opts: deadletter.ReplayOptions{ErrorPattern: regexp.MustCompile("timeout")}, expected: false},
+		{name: "matching user and other error", opts: deadletter.ReplayOptions{UserID: "1234", ErrorPattern: regexp.MustCompile("timeout")}, expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := deadletter.Matches(deadLetter(), tt.opts); actual != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, actual)
+			}
+		})
+	}
+}
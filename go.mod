@@ -11,6 +11,7 @@ require (
 	github.com/tidepool-org/clinic/client v0.0.0-20240412024055-e6391b37e456
 	github.com/tidepool-org/go-common v0.12.2-0.20250129210214-bd36b59b9733
 	go.mongodb.org/mongo-driver v1.12.1
+	golang.org/x/text v0.21.0
 )
 
 require (
@@ -55,7 +56,6 @@ require (
 	golang.org/x/crypto v0.32.0 // indirect
 	golang.org/x/net v0.34.0 // indirect
 	golang.org/x/sync v0.10.0 // indirect
-	golang.org/x/text v0.21.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
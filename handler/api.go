@@ -1,10 +1,13 @@
 package handler
 
 import (
+	"encoding/json"
+	"expvar"
 	"github.com/gorilla/mux"
 	"github.com/tidepool-org/go-common/clients/shoreline"
 	"log"
 	"net/http"
+	"strconv"
 )
 
 const tidepoolSessionTokenKey = "x-tidepool-session-token"
@@ -18,13 +21,19 @@ func RefreshUser(handler *UserEventsHandler, shorelineClient shoreline.Client) h
 			return
 		}
 
-		token := r.Header.Get(tidepoolSessionTokenKey)
-		if td := shorelineClient.CheckToken(token); td == nil || !td.IsServer {
+		td := serverToken(r, shorelineClient)
+		if td == nil {
 			http.Error(w, "session token is invalid", http.StatusForbidden)
 			return
 		}
 
-		err := handler.RefreshUser(r.Context(), userId)
+		force, err := boolQueryParam(r.URL.Query().Get("force"))
+		if err != nil {
+			http.Error(w, "force is invalid", http.StatusBadRequest)
+			return
+		}
+
+		err = handler.RefreshUser(apiContext(r, td), userId, force)
 		if err != nil {
 			log.Printf("unable to refresh user %v: %v\n", userId, err.Error())
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -34,3 +43,83 @@ func RefreshUser(handler *UserEventsHandler, shorelineClient shoreline.Client) h
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+// GetUserMarketoState returns the computed and the actual marketo state of a user
+func GetUserMarketoState(handler *UserEventsHandler, inspector LeadInspector, shorelineClient shoreline.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		userId := vars["userId"]
+		if userId == "" {
+			http.Error(w, "user id is empty", http.StatusBadRequest)
+			return
+		}
+
+		if !isServerRequest(r, shorelineClient) {
+			http.Error(w, "session token is invalid", http.StatusForbidden)
+			return
+		}
+
+		state, err := handler.InspectUser(r.Context(), inspector, userId)
+		if err != nil {
+			log.Printf("unable to inspect user %v: %v\n", userId, err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if state == nil {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, state)
+	}
+}
+
+// GetMetrics returns the expvar metrics of the service, which are only available to servers
+func GetMetrics(shorelineClient shoreline.Client) http.HandlerFunc {
+	metrics := expvar.Handler()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isServerRequest(r, shorelineClient) {
+			http.Error(w, "session token is invalid", http.StatusForbidden)
+			return
+		}
+
+		metrics.ServeHTTP(w, r)
+	}
+}
+
+// userToken returns the token data of the request if it has a server token or the session token of the user
+func userToken(r *http.Request, shorelineClient shoreline.Client, userId string) *shoreline.TokenData {
+	td := shorelineClient.CheckToken(r.Header.Get(tidepoolSessionTokenKey))
+	if td != nil && (td.IsServer || td.UserID == userId) {
+		return td
+	}
+	return nil
+}
+
+func isServerRequest(r *http.Request, shorelineClient shoreline.Client) bool {
+	return serverToken(r, shorelineClient) != nil
+}
+
+// serverToken returns the token data of the request if it has a valid server token
+func serverToken(r *http.Request, shorelineClient shoreline.Client) *shoreline.TokenData {
+	token := r.Header.Get(tidepoolSessionTokenKey)
+	if td := shorelineClient.CheckToken(token); td != nil && td.IsServer {
+		return td
+	}
+	return nil
+}
+
+func boolQueryParam(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("unable to write response: %v\n", err)
+	}
+}
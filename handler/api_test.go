@@ -0,0 +1,107 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	clinic "github.com/tidepool-org/clinic/client"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+
+	"github.com/tidepool-org/marketo-service/handler"
+	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/relationships"
+)
+
+type LeadInspectorMock struct {
+	Lead *marketo.LeadResult
+}
+
+func (l *LeadInspectorMock) InputForUser(ctx context.Context, tidepoolID string, user shoreline.UserData, delete bool, clinics *clinic.ClinicianClinicRelationships) (marketo.Input, error) {
+	return marketo.Input{TidepoolID: tidepoolID, Email: user.Username, UserType: "patient"}, nil
+}
+
+func (l *LeadInspectorMock) FindLead(userId string, email string) (*marketo.LeadResult, error) {
+	return l.Lead, nil
+}
+
+func ClinicsServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte("[]"))
+	}))
+}
+
+func Test_GetUserMarketoState(t *testing.T) {
+	clinicsServer := ClinicsServer(t)
+	defer clinicsServer.Close()
+	clinics, _ := clinic.NewClientWithResponses(clinicsServer.URL)
+	shorelineClient := shoreline.NewMock("token")
+	userEventsHandler := &handler.UserEventsHandler{Clinics: clinics, Relationships: relationships.NewResolver(clinics, relationships.Config{}), Shoreline: shorelineClient}
+	inspector := &LeadInspectorMock{Lead: &marketo.LeadResult{ID: 23, TidepoolID: "1234", Email: "From Mock", UserType: "clinic"}}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/users/{userId}/marketo", handler.GetUserMarketoState(userEventsHandler, inspector, shorelineClient)).Methods("GET")
+
+	tests := []struct {
+		name               string
+		userId             string
+		expectedStatusCode int
+	}{
+		{name: "existing user", userId: "1234", expectedStatusCode: http.StatusOK},
+		{name: "missing user", userId: "NotFound", expectedStatusCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/users/"+tt.userId+"/marketo", nil)
+			req.Header.Set("x-tidepool-session-token", "token")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.expectedStatusCode {
+				t.Fatalf("Expected status code %d, got %d", tt.expectedStatusCode, rec.Code)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			state := handler.UserMarketoState{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if state.Lead == nil || state.Lead.ID != 23 {
+				t.Errorf("Expected lead 23, got %v", state.Lead)
+			}
+			if len(state.Diff) != 1 || state.Diff[0].Field != "userType" {
+				t.Errorf("Expected userType to differ, got %v", state.Diff)
+			}
+		})
+	}
+}
+
+func Test_GetMetrics(t *testing.T) {
+	shorelineClient := &ShorelineTokensMock{ShorelineMockClient: shoreline.NewMock("server")}
+	metrics := handler.GetMetrics(shorelineClient)
+
+	tests := []struct {
+		name               string
+		token              string
+		expectedStatusCode int
+	}{
+		{name: "server token", token: "server", expectedStatusCode: http.StatusOK},
+		{name: "session token of a user", token: "1234", expectedStatusCode: http.StatusForbidden},
+		{name: "no token", expectedStatusCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+			req.Header.Set("x-tidepool-session-token", tt.token)
+			rec := httptest.NewRecorder()
+			metrics(rec, req)
+			if rec.Code != tt.expectedStatusCode {
+				t.Fatalf("Expected status code %d, got %d", tt.expectedStatusCode, rec.Code)
+			}
+		})
+	}
+}
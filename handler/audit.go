@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/gorilla/mux"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+// Limits of the number of audit entries returned by the audit API
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// kafkaContext returns a context which attributes the mutations to the kafka message
+func kafkaContext(cm *sarama.ConsumerMessage) (context.Context, context.CancelFunc) {
+	ctx := marketo.ContextWithSource(context.Background(), kafkaSource(cm))
+	return context.WithTimeout(ctx, timeout)
+}
+
+func kafkaSource(cm *sarama.ConsumerMessage) store.AuditSource {
+	return store.AuditSource{
+		Type:      store.AuditSourceKafka,
+		Topic:     cm.Topic,
+		Partition: cm.Partition,
+		Offset:    cm.Offset,
+	}
+}
+
+// apiContext returns the context of the request which attributes the mutations to the caller
+func apiContext(r *http.Request, td *shoreline.TokenData) context.Context {
+	return marketo.ContextWithSource(r.Context(), store.AuditSource{
+		Type:   store.AuditSourceAPI,
+		Caller: td.UserID,
+	})
+}
+
+// GetUserMarketoAudit returns the audit entries of the mutations of a user, most recent first
+func GetUserMarketoAudit(audit store.AuditRepository, shorelineClient shoreline.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId := mux.Vars(r)["userId"]
+		if userId == "" {
+			http.Error(w, "user id is empty", http.StatusBadRequest)
+			return
+		}
+
+		if !isServerRequest(r, shorelineClient) {
+			http.Error(w, "session token is invalid", http.StatusForbidden)
+			return
+		}
+
+		query := r.URL.Query()
+		filter := store.AuditFilter{UserID: userId, Limit: defaultAuditLimit}
+		var err error
+		if filter.From, err = timeQueryParam(query.Get("from")); err != nil {
+			http.Error(w, "from is invalid", http.StatusBadRequest)
+			return
+		}
+		if filter.To, err = timeQueryParam(query.Get("to")); err != nil {
+			http.Error(w, "to is invalid", http.StatusBadRequest)
+			return
+		}
+		if limit := query.Get("limit"); limit != "" {
+			filter.Limit, err = strconv.Atoi(limit)
+			if err != nil || filter.Limit < 1 || filter.Limit > maxAuditLimit {
+				http.Error(w, "limit is invalid", http.StatusBadRequest)
+				return
+			}
+		}
+
+		entries, err := audit.FindAuditEntries(r.Context(), filter)
+		if err != nil {
+			log.Printf("unable to find audit entries of user %v: %v\n", userId, err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if entries == nil {
+			entries = []*store.AuditEntry{}
+		}
+
+		writeJSON(w, http.StatusOK, entries)
+	}
+}
+
+// timeQueryParam parses an RFC 3339 time, the empty value is the zero time
+func timeQueryParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,128 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/gorilla/mux"
+	clinic "github.com/tidepool-org/clinic/client"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+	"github.com/tidepool-org/go-common/events"
+
+	"github.com/tidepool-org/marketo-service/handler"
+	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+type SourceManagerMock struct {
+	marketo.Manager
+	Sources []store.AuditSource
+}
+
+func (m *SourceManagerMock) UpdateListMembershipForUser(ctx context.Context, tidepoolID string, oldUser shoreline.UserData, newUser shoreline.UserData, delete bool, clinics *clinic.ClinicianClinicRelationships) error {
+	m.Sources = append(m.Sources, marketo.SourceFromContext(ctx))
+	return nil
+}
+
+func Test_UserEventsConsumer_Attributes_Mutations_To_Message(t *testing.T) {
+	manager := &SourceManagerMock{}
+	userEventsHandler := &handler.UserEventsHandler{MarketoManager: manager}
+	consumer, err := handler.NewUserEventsConsumer(userEventsHandler)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	message := &sarama.ConsumerMessage{
+		Topic:     "shoreline-users",
+		Partition: 3,
+		Offset:    42,
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("ce_specversion"), Value: []byte("1.0")},
+			{Key: []byte("ce_id"), Value: []byte("1")},
+			{Key: []byte("ce_source"), Value: []byte("shoreline")},
+			{Key: []byte("ce_type"), Value: []byte("users:delete")},
+			{Key: []byte("content-type"), Value: []byte("application/json")},
+		},
+		Value: []byte(`{"userid":"1234","username":"user@example.com"}`),
+	}
+	if err := consumer.HandleKafkaMessage(message); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := store.AuditSource{Type: store.AuditSourceKafka, Topic: "shoreline-users", Partition: 3, Offset: 42}
+	if len(manager.Sources) != 1 || manager.Sources[0] != expected {
+		t.Errorf("Expected the deletion to be attributed to %+v, got %+v", expected, manager.Sources)
+	}
+
+	// The handler which is shared with the other consumers is not modified
+	if err := userEventsHandler.HandleDeleteUserEvent(events.DeleteUserEvent{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(manager.Sources) != 2 || manager.Sources[1].Type != store.AuditSourceInternal {
+		t.Errorf("Expected an internal source, got %+v", manager.Sources)
+	}
+}
+
+func Test_GetUserMarketoAudit(t *testing.T) {
+	shorelineClient := &ShorelineTokensMock{ShorelineMockClient: shoreline.NewMock("server")}
+	memoryStore := store.NewMemoryStore()
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, action := range []string{"createOnly", "updateOnly", "delete"} {
+		_ = memoryStore.InsertAuditEntry(context.Background(), &store.AuditEntry{UserID: "1234", Action: action, CreatedTime: created.Add(time.Duration(i) * time.Hour)})
+	}
+	_ = memoryStore.InsertAuditEntry(context.Background(), &store.AuditEntry{UserID: "5678", Action: "createOnly", CreatedTime: created})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/users/{userId}/marketo/audit", handler.GetUserMarketoAudit(memoryStore, shorelineClient)).Methods("GET")
+
+	tests := []struct {
+		name               string
+		token              string
+		query              string
+		expectedStatusCode int
+		expectedActions    []string
+	}{
+		{name: "all entries", token: "server", expectedStatusCode: http.StatusOK, expectedActions: []string{"delete", "updateOnly", "createOnly"}},
+		{name: "time range", token: "server", query: "?from=2026-01-01T01:00:00Z&to=2026-01-01T02:00:00Z", expectedStatusCode: http.StatusOK, expectedActions: []string{"updateOnly"}},
+		{name: "limit", token: "server", query: "?limit=1", expectedStatusCode: http.StatusOK, expectedActions: []string{"delete"}},
+		{name: "invalid time", token: "server", query: "?from=yesterday", expectedStatusCode: http.StatusBadRequest},
+		{name: "invalid limit", token: "server", query: "?limit=0", expectedStatusCode: http.StatusBadRequest},
+		{name: "session token of the user", token: "1234", expectedStatusCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/users/1234/marketo/audit"+tt.query, nil)
+			req.Header.Set("x-tidepool-session-token", tt.token)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.expectedStatusCode {
+				t.Fatalf("Expected status code %d, got %d", tt.expectedStatusCode, rec.Code)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var entries []store.AuditEntry
+			if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var actions []string
+			for _, entry := range entries {
+				if entry.UserID != "1234" {
+					t.Errorf("Expected only entries of user 1234, got %v", entry.UserID)
+				}
+				actions = append(actions, entry.Action)
+			}
+			if len(actions) != len(tt.expectedActions) {
+				t.Fatalf("Expected actions %v, got %v", tt.expectedActions, actions)
+			}
+			for i := range actions {
+				if actions[i] != tt.expectedActions[i] {
+					t.Errorf("Expected actions %v, got %v", tt.expectedActions, actions)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tidepool-org/go-common/clients/shoreline"
+	"github.com/tidepool-org/go-common/events"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+const usersChangeStreamCheckpoint = "usersChangeStream"
+
+// ChangeStreamConfig is the env config of the consumer of the users change stream
+type ChangeStreamConfig struct {
+	// Attempts is the number of attempts to handle a change before the stream is reopened
+	Attempts int `envconfig:"MARKETO_CHANGE_STREAM_ATTEMPTS" default:"3"`
+	// AttemptDelay is multiplied by the attempt number to get the delay between two attempts
+	AttemptDelay time.Duration `envconfig:"MARKETO_CHANGE_STREAM_ATTEMPT_DELAY" default:"1s"`
+	// RetryDelay is the delay before the stream is reopened
+	RetryDelay time.Duration `envconfig:"MARKETO_CHANGE_STREAM_RETRY_DELAY" default:"5s"`
+	// ParkAfter is the number of times the stream is reopened for a failing change before the change is parked
+	ParkAfter int `envconfig:"MARKETO_CHANGE_STREAM_PARK_AFTER" default:"3"`
+}
+
+// ChangeStreamStore provides the change stream of the users collection, persists its resume token
+// and the changes which were skipped
+type ChangeStreamStore interface {
+	WatchUsers(ctx context.Context, resumeToken bson.Raw) (store.UserChangeStream, error)
+	store.CheckpointRepository
+	store.ParkedUserChangeRepository
+}
+
+// UserChangesHandler handles the user events of the changes of the users collection
+type UserChangesHandler interface {
+	UpdateUser(ctx context.Context, event events.UpdateUserEvent) error
+	DeleteUser(ctx context.Context, event events.DeleteUserEvent) error
+}
+
+// UsersChangeStreamConsumer translates the changes of the users collection to user events.
+// The resume token is persisted after each handled change, so changes are neither replayed nor
+// skipped when the service is restarted. A change which can't be handled blocks the stream
+// until the stream was reopened for the change ParkAfter times, then the change is parked and
+// the stream continues with the next change.
+type UsersChangeStreamConsumer struct {
+	store             ChangeStreamStore
+	userEventsHandler UserChangesHandler
+	config            ChangeStreamConfig
+	ctx               context.Context
+	cancel            context.CancelFunc
+	wg                sync.WaitGroup
+
+	// failedToken is the resume token of the change which failed failedCycles times in a row
+	failedToken  bson.Raw
+	failedCycles int
+}
+
+func NewUsersChangeStreamConsumer(store ChangeStreamStore, userEventsHandler UserChangesHandler, config ChangeStreamConfig) *UsersChangeStreamConsumer {
+	if config.Attempts <= 0 {
+		config.Attempts = 3
+	}
+	if config.ParkAfter <= 0 {
+		config.ParkAfter = 3
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &UsersChangeStreamConsumer{
+		store:             store,
+		userEventsHandler: userEventsHandler,
+		config:            config,
+		ctx:               ctx,
+		cancel:            cancel,
+	}
+}
+
+// Start consumes the change stream until the consumer is stopped. The stream is reopened
+// from the last persisted resume token if it fails.
+func (c *UsersChangeStreamConsumer) Start() error {
+	c.wg.Add(1)
+	defer c.wg.Done()
+
+	for {
+		err := c.consume(c.ctx)
+		if c.ctx.Err() != nil {
+			return nil
+		}
+		log.Printf("users change stream failed: %v", err)
+		select {
+		case <-c.ctx.Done():
+			return nil
+		case <-time.After(c.config.RetryDelay):
+		}
+	}
+}
+
+// Stop signals the consumer to stop and waits for the current change to be handled
+func (c *UsersChangeStreamConsumer) Stop() error {
+	c.cancel()
+	c.wg.Wait()
+	return nil
+}
+
+func (c *UsersChangeStreamConsumer) consume(ctx context.Context) error {
+	checkpoint, err := c.store.FindCheckpoint(ctx, usersChangeStreamCheckpoint)
+	if err != nil {
+		return err
+	}
+	if checkpoint == nil {
+		checkpoint = &store.Checkpoint{Name: usersChangeStreamCheckpoint}
+	}
+
+	stream, err := c.store.WatchUsers(ctx, checkpoint.ResumeToken)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		change := stream.Change()
+		if err := c.handleWithRetries(ctx, change); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			checkpoint.Failed++
+			if c.failed(change) < c.config.ParkAfter {
+				// The resume token is not advanced, the change is handled again when the stream is reopened
+				log.Printf("ERROR: unable to handle %s change after %d attempts: %v", change.OperationType, c.config.Attempts, err)
+				if err := c.store.UpsertCheckpoint(ctx, checkpoint); err != nil {
+					return err
+				}
+				return err
+			}
+			if err := c.park(ctx, change, err); err != nil {
+				return err
+			}
+		} else {
+			checkpoint.Processed++
+		}
+		c.failedToken, c.failedCycles = nil, 0
+		checkpoint.ResumeToken = change.ResumeToken
+		if err := c.store.UpsertCheckpoint(ctx, checkpoint); err != nil {
+			return err
+		}
+	}
+	return stream.Err()
+}
+
+// failed returns the number of times in a row the change failed to be handled
+func (c *UsersChangeStreamConsumer) failed(change *store.UserChange) int {
+	if !bytes.Equal(c.failedToken, change.ResumeToken) {
+		c.failedToken, c.failedCycles = change.ResumeToken, 0
+	}
+	c.failedCycles++
+	return c.failedCycles
+}
+
+// park persists the change which blocked the stream, so the stream can continue with the next change
+func (c *UsersChangeStreamConsumer) park(ctx context.Context, change *store.UserChange, handleErr error) error {
+	parked := &store.ParkedUserChange{
+		OperationType: change.OperationType,
+		DocumentKey:   change.DocumentKey,
+		UserID:        change.DocumentKey.Id,
+		ResumeToken:   change.ResumeToken,
+		Error:         handleErr.Error(),
+	}
+	if change.After != nil {
+		parked.UserID = change.After.Id
+	} else if change.Before != nil {
+		parked.UserID = change.Before.Id
+	}
+	if err := c.store.InsertParkedUserChange(ctx, parked); err != nil {
+		return err
+	}
+	log.Printf("ERROR: parked %s change of user %q after %d failures: %v", change.OperationType, parked.UserID, c.failedCycles, handleErr)
+	return nil
+}
+
+func (c *UsersChangeStreamConsumer) handleWithRetries(ctx context.Context, change *store.UserChange) error {
+	var err error
+	for attempt := 1; attempt <= c.config.Attempts; attempt++ {
+		if err = c.HandleChange(ctx, change); err == nil {
+			return nil
+		}
+		log.Printf("unable to handle %s change (attempt %d): %v", change.OperationType, attempt, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * c.config.AttemptDelay):
+		}
+	}
+	return err
+}
+
+// HandleChange translates the change to a user event. The mutations are attributed to the change.
+func (c *UsersChangeStreamConsumer) HandleChange(ctx context.Context, change *store.UserChange) error {
+	ctx = marketo.ContextWithSource(ctx, store.AuditSource{
+		Type:        store.AuditSourceChangeStream,
+		ResumeToken: resumeTokenData(change.ResumeToken),
+	})
+	switch change.OperationType {
+	case store.OperationInsert, store.OperationUpdate, store.OperationReplace:
+		// The user was deleted before the change was read
+		if change.After == nil {
+			return nil
+		}
+		updated := change.After.UserData()
+		original := shoreline.UserData{UserID: updated.UserID}
+		if change.Before != nil {
+			original = change.Before.UserData()
+		} else if change.OperationType != store.OperationInsert {
+			// The pre-image is not available anymore. The marketo manager falls back to the last
+			// synced email to find the lead.
+			original = updated
+		}
+		return c.userEventsHandler.UpdateUser(ctx, events.UpdateUserEvent{
+			Original: original,
+			Updated:  updated,
+		})
+	case store.OperationDelete:
+		if change.Before != nil {
+			return c.userEventsHandler.DeleteUser(ctx, events.DeleteUserEvent{
+				UserData: change.Before.UserData(),
+			})
+		}
+		if change.DocumentKey.Id == "" {
+			// The pre-image expired before the change was read, the change is parked once it blocked the stream
+			return fmt.Errorf("deletion of user %s has no pre-image or user id", change.DocumentKey.ObjectID.Hex())
+		}
+		// The users collection is sharded by the user id. The marketo manager falls back to
+		// the last synced email to find the lead.
+		return c.userEventsHandler.DeleteUser(ctx, events.DeleteUserEvent{
+			UserData: shoreline.UserData{UserID: change.DocumentKey.Id},
+		})
+	default:
+		return nil
+	}
+}
+
+// resumeTokenData returns the opaque data of the resume token
+func resumeTokenData(token bson.Raw) string {
+	if data, ok := token.Lookup("_data").StringValueOK(); ok {
+		return data
+	}
+	return token.String()
+}
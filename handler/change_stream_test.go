@@ -0,0 +1,167 @@
+package handler_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidepool-org/go-common/events"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/tidepool-org/marketo-service/handler"
+	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+type UserEventsHandlerMock struct {
+	mu      sync.Mutex
+	Updates []events.UpdateUserEvent
+	Deletes []events.DeleteUserEvent
+	Sources []store.AuditSource
+	Failing map[string]bool
+}
+
+func (u *UserEventsHandlerMock) UpdateUser(ctx context.Context, event events.UpdateUserEvent) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.Updates = append(u.Updates, event)
+	u.Sources = append(u.Sources, marketo.SourceFromContext(ctx))
+	if u.Failing[event.Updated.UserID] {
+		return errors.New("update failed")
+	}
+	return nil
+}
+
+func (u *UserEventsHandlerMock) DeleteUser(ctx context.Context, event events.DeleteUserEvent) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.Deletes = append(u.Deletes, event)
+	u.Sources = append(u.Sources, marketo.SourceFromContext(ctx))
+	return nil
+}
+
+func Test_UsersChangeStreamConsumer_HandleChange(t *testing.T) {
+	before := &store.User{Id: "1234", Username: "old@example.com", EmailVerified: true, TermsAccepted: "2020-01-01"}
+	after := &store.User{Id: "1234", Username: "new@example.com", EmailVerified: true, TermsAccepted: "2020-01-01"}
+
+	tests := []struct {
+		name             string
+		change           store.UserChange
+		expectedOriginal string
+		expectedDeletes  int
+		expectedError    bool
+	}{
+		{name: "insert", change: store.UserChange{OperationType: store.OperationInsert, After: after}, expectedOriginal: ""},
+		{name: "update with pre-image", change: store.UserChange{OperationType: store.OperationUpdate, Before: before, After: after}, expectedOriginal: "old@example.com"},
+		{name: "update without pre-image", change: store.UserChange{OperationType: store.OperationUpdate, After: after}, expectedOriginal: "new@example.com"},
+		{name: "delete with pre-image", change: store.UserChange{OperationType: store.OperationDelete, Before: before}, expectedDeletes: 1},
+		{name: "delete without pre-image", change: store.UserChange{OperationType: store.OperationDelete, DocumentKey: store.UserKey{Id: "1234"}}, expectedDeletes: 1},
+		{name: "delete without pre-image or user id", change: store.UserChange{OperationType: store.OperationDelete}, expectedError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userEventsHandler := &UserEventsHandlerMock{}
+			consumer := handler.NewUsersChangeStreamConsumer(nil, userEventsHandler, handler.ChangeStreamConfig{})
+			tt.change.ResumeToken, _ = bson.Marshal(bson.M{"_data": "8263"})
+			if err := consumer.HandleChange(context.Background(), &tt.change); (err != nil) != tt.expectedError {
+				t.Fatalf("Expected error %v, got %v", tt.expectedError, err)
+			}
+			if len(userEventsHandler.Deletes) != tt.expectedDeletes {
+				t.Errorf("Expected %d delete events, got %d", tt.expectedDeletes, len(userEventsHandler.Deletes))
+			}
+			for _, source := range userEventsHandler.Sources {
+				if source.Type != store.AuditSourceChangeStream || source.ResumeToken != "8263" {
+					t.Errorf("Expected the mutations to be attributed to the change, got %+v", source)
+				}
+			}
+			if tt.change.After == nil {
+				return
+			}
+			if len(userEventsHandler.Updates) != 1 {
+				t.Fatalf("Expected 1 update event, got %d", len(userEventsHandler.Updates))
+			}
+			event := userEventsHandler.Updates[0]
+			if event.Original.UserID != "1234" || event.Original.Username != tt.expectedOriginal {
+				t.Errorf("Expected original user 1234 with username %q, got %+v", tt.expectedOriginal, event.Original)
+			}
+			if event.Updated.Username != "new@example.com" {
+				t.Errorf("Expected updated username new@example.com, got %s", event.Updated.Username)
+			}
+		})
+	}
+}
+
+func Test_UsersChangeStreamConsumer_Resumes_After_Persisted_Token(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+
+	// The insert was handled before the restart
+	stream, _ := s.WatchUsers(ctx, nil)
+	_ = s.UpsertUser(ctx, &store.User{Id: "1234", Username: "old@example.com", EmailVerified: true, TermsAccepted: "2020-01-01"})
+	stream.Next(ctx)
+	_ = s.UpsertCheckpoint(ctx, &store.Checkpoint{Name: "usersChangeStream", ResumeToken: stream.Change().ResumeToken})
+	_ = s.UpsertUser(ctx, &store.User{Id: "1234", Username: "new@example.com", EmailVerified: true})
+
+	userEventsHandler := &UserEventsHandlerMock{}
+	consumer := handler.NewUsersChangeStreamConsumer(s, userEventsHandler, handler.ChangeStreamConfig{})
+	go consumer.Start()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if checkpoint, _ := s.FindCheckpoint(ctx, "usersChangeStream"); checkpoint != nil && checkpoint.Processed == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = consumer.Stop()
+
+	if len(userEventsHandler.Updates) != 1 {
+		t.Fatalf("Expected only the update to be handled, got %d events", len(userEventsHandler.Updates))
+	}
+	event := userEventsHandler.Updates[0]
+	if event.Original.Username != "old@example.com" || event.Updated.Username != "new@example.com" {
+		t.Errorf("Expected update from old@example.com to new@example.com, got %+v", event)
+	}
+}
+
+func Test_UsersChangeStreamConsumer_Parks_Failing_Changes(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	// The stream resumes after the change which was handled before
+	stream, _ := s.WatchUsers(ctx, nil)
+	_ = s.UpsertUser(ctx, &store.User{Id: "0000", Username: "handled@example.com"})
+	stream.Next(ctx)
+	_ = s.UpsertCheckpoint(ctx, &store.Checkpoint{Name: "usersChangeStream", ResumeToken: stream.Change().ResumeToken})
+	_ = s.UpsertUser(ctx, &store.User{Id: "1234", Username: "failing@example.com", EmailVerified: true, TermsAccepted: "2020-01-01"})
+	_ = s.UpsertUser(ctx, &store.User{Id: "5678", Username: "next@example.com", EmailVerified: true, TermsAccepted: "2020-01-01"})
+
+	userEventsHandler := &UserEventsHandlerMock{Failing: map[string]bool{"1234": true}}
+	config := handler.ChangeStreamConfig{Attempts: 2, AttemptDelay: time.Millisecond, RetryDelay: time.Millisecond, ParkAfter: 2}
+	consumer := handler.NewUsersChangeStreamConsumer(s, userEventsHandler, config)
+	go consumer.Start()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if checkpoint, _ := s.FindCheckpoint(ctx, "usersChangeStream"); checkpoint != nil && checkpoint.Processed == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = consumer.Stop()
+
+	parked, _ := s.FindParkedUserChanges(ctx, 10)
+	if len(parked) != 1 || parked[0].UserID != "1234" || parked[0].Error == "" {
+		t.Fatalf("Expected the change of user 1234 to be parked, got %+v", parked)
+	}
+	checkpoint, _ := s.FindCheckpoint(ctx, "usersChangeStream")
+	if checkpoint.Processed != 1 || checkpoint.Failed != 2 {
+		t.Errorf("Expected 1 processed and 2 failed changes, got %+v", checkpoint)
+	}
+	userEventsHandler.mu.Lock()
+	defer userEventsHandler.mu.Unlock()
+	if len(userEventsHandler.Updates) != 5 || userEventsHandler.Updates[4].Updated.UserID != "5678" {
+		t.Errorf("Expected 4 attempts of the failing change before the next change, got %+v", userEventsHandler.Updates)
+	}
+}
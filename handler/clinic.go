@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+	clinic "github.com/tidepool-org/clinic/client"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+)
+
+const (
+	cliniciansPageSize       = 1000
+	clinicRefreshConcurrency = 4
+)
+
+// ErrClinicNotFound is returned when the clinic doesn't exist
+var ErrClinicNotFound = errors.New("clinic not found")
+
+// ClinicRefreshFailure is a clinician who couldn't be refreshed
+type ClinicRefreshFailure struct {
+	UserID string `json:"userId"`
+	Error  string `json:"error"`
+}
+
+// ClinicRefreshSummary is the outcome of refreshing the clinicians of a clinic
+type ClinicRefreshSummary struct {
+	ClinicID   string `json:"clinicId"`
+	Clinicians int    `json:"clinicians"`
+	Refreshed  int    `json:"refreshed"`
+	// Invited is the number of pending invites which don't have a user yet
+	Invited  int                    `json:"invited"`
+	Failed   int                    `json:"failed"`
+	Failures []ClinicRefreshFailure `json:"failures"`
+}
+
+// RefreshClinicians refreshes all clinicians of the clinic. At most concurrency users are refreshed at the same time.
+func (u *UserEventsHandler) RefreshClinicians(ctx context.Context, clinicId string, force bool, concurrency int) (*ClinicRefreshSummary, error) {
+	clinicians, err := u.listClinicians(ctx, clinicId)
+	if err != nil {
+		return nil, err
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	summary := &ClinicRefreshSummary{ClinicID: clinicId, Clinicians: len(clinicians), Failures: []ClinicRefreshFailure{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, clinician := range clinicians {
+		if clinician.Id == nil || *clinician.Id == "" {
+			summary.Invited++
+			continue
+		}
+		userId := *clinician.Id
+		// The roles of the clinician may have changed since the relationships were cached
+		u.Relationships.Invalidate(userId)
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := u.RefreshUser(ctx, userId, force)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("unable to refresh clinician %v of clinic %v: %v", userId, clinicId, err)
+				summary.Failed++
+				summary.Failures = append(summary.Failures, ClinicRefreshFailure{UserID: userId, Error: err.Error()})
+			} else {
+				summary.Refreshed++
+			}
+		}()
+	}
+	wg.Wait()
+
+	return summary, nil
+}
+
+// ClinicianIDs returns the user ids of the clinicians of the clinic. Invited clinicians are not
+// users yet and are skipped. The cached relationships of the clinicians are invalidated, because
+// they may have changed.
+func (u *UserEventsHandler) ClinicianIDs(ctx context.Context, clinicId string) ([]string, error) {
+	clinicians, err := u.listClinicians(ctx, clinicId)
+	if err != nil {
+		return nil, err
+	}
+	var userIds []string
+	for _, clinician := range clinicians {
+		if clinician.Id == nil || *clinician.Id == "" {
+			continue
+		}
+		u.Relationships.Invalidate(*clinician.Id)
+		userIds = append(userIds, *clinician.Id)
+	}
+	return userIds, nil
+}
+
+func (u *UserEventsHandler) listClinicians(ctx context.Context, clinicId string) (clinic.Clinicians, error) {
+	var clinicians clinic.Clinicians
+	limit := clinic.Limit(cliniciansPageSize)
+	for offset := 0; ; offset += cliniciansPageSize {
+		params := &clinic.ListCliniciansParams{
+			Offset: &offset,
+			Limit:  &limit,
+		}
+		response, err := u.Clinics.ListCliniciansWithResponse(ctx, clinic.ClinicId(clinicId), params)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode() == http.StatusNotFound {
+			return nil, ErrClinicNotFound
+		}
+		if response.StatusCode() != http.StatusOK || response.JSON200 == nil {
+			return nil, fmt.Errorf("unexpected status code %v when fetching clinicians of clinic %v", response.StatusCode(), clinicId)
+		}
+		clinicians = append(clinicians, *response.JSON200...)
+		if len(*response.JSON200) < cliniciansPageSize {
+			return clinicians, nil
+		}
+	}
+}
+
+// RefreshClinic refreshes all clinicians of a clinic and returns a summary of the results
+func RefreshClinic(handler *UserEventsHandler, shorelineClient shoreline.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clinicId := mux.Vars(r)["clinicId"]
+		if clinicId == "" {
+			http.Error(w, "clinic id is empty", http.StatusBadRequest)
+			return
+		}
+
+		td := serverToken(r, shorelineClient)
+		if td == nil {
+			http.Error(w, "session token is invalid", http.StatusForbidden)
+			return
+		}
+
+		force, err := boolQueryParam(r.URL.Query().Get("force"))
+		if err != nil {
+			http.Error(w, "force is invalid", http.StatusBadRequest)
+			return
+		}
+
+		summary, err := handler.RefreshClinicians(apiContext(r, td), clinicId, force, clinicRefreshConcurrency)
+		if errors.Is(err, ErrClinicNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("unable to refresh clinic %v: %v\n", clinicId, err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, summary)
+	}
+}
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/IBM/sarama"
+	clinic "github.com/tidepool-org/clinic/client"
+	"github.com/tidepool-org/go-common/events"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+// clinicFields are the fields of a clinic which are synced to the leads of its clinicians
+var clinicFields = []string{"name", "clinicType", "clinicSize", "country", "state", "tier"}
+
+// ClinicEvent is a change event of the clinics collection of the clinic service
+type ClinicEvent struct {
+	OperationType     string                `bson:"operationType"`
+	FullDocument      *ClinicDocument       `bson:"fullDocument"`
+	UpdateDescription *CDCUpdateDescription `bson:"updateDescription"`
+}
+
+type ClinicDocument struct {
+	Id           primitive.ObjectID   `bson:"_id"`
+	Name         string               `bson:"name"`
+	Address      *string              `bson:"address"`
+	City         *string              `bson:"city"`
+	State        *string              `bson:"state"`
+	PostalCode   *string              `bson:"postalCode"`
+	Country      *string              `bson:"country"`
+	Website      *string              `bson:"website"`
+	ClinicType   *string              `bson:"clinicType"`
+	ClinicSize   *string              `bson:"clinicSize"`
+	Tier         *string              `bson:"tier"`
+	PhoneNumbers []clinic.PhoneNumber `bson:"phoneNumbers"`
+}
+
+// Clinic converts the document to the clinic model of the clinic client
+func (d *ClinicDocument) Clinic() clinic.Clinic {
+	id := d.Id.Hex()
+	c := clinic.Clinic{
+		Id:         &id,
+		Name:       d.Name,
+		Address:    d.Address,
+		City:       d.City,
+		State:      d.State,
+		PostalCode: d.PostalCode,
+		Country:    d.Country,
+		Website:    d.Website,
+		Tier:       d.Tier,
+	}
+	if d.ClinicType != nil {
+		clinicType := clinic.ClinicClinicType(*d.ClinicType)
+		c.ClinicType = &clinicType
+	}
+	if d.ClinicSize != nil {
+		clinicSize := clinic.ClinicClinicSize(*d.ClinicSize)
+		c.ClinicSize = &clinicSize
+	}
+	if len(d.PhoneNumbers) > 0 {
+		c.PhoneNumbers = &d.PhoneNumbers
+	}
+	return c
+}
+
+// CompanyManager keeps the marketo companies of the clinics up to date
+type CompanyManager interface {
+	UpsertCompany(ctx context.Context, c clinic.Clinic) error
+}
+
+// ClinicianLister lists the user ids of the clinicians of a clinic
+type ClinicianLister interface {
+	ClinicianIDs(ctx context.Context, clinicId string) ([]string, error)
+}
+
+// ClinicDetailsCache caches the details of the clinics
+type ClinicDetailsCache interface {
+	InvalidateClinic(clinicId string)
+}
+
+var _ events.MessageConsumer = &ClinicEventsConsumer{}
+
+// ClinicEventsConsumer upserts the company of the clinic when a clinic is created or updated.
+// When an attribute which is synced to the leads of the clinicians changes, a refresh job is
+// created for the clinicians, so large clinics are refreshed in the background under rate limits.
+type ClinicEventsConsumer struct {
+	companies  CompanyManager
+	clinicians ClinicianLister
+	jobs       store.RefreshJobRepository
+	cache      ClinicDetailsCache
+}
+
+func NewClinicEventsConsumer(companies CompanyManager, clinicians ClinicianLister, jobs store.RefreshJobRepository, cache ClinicDetailsCache) (*ClinicEventsConsumer, error) {
+	return &ClinicEventsConsumer{companies: companies, clinicians: clinicians, jobs: jobs, cache: cache}, nil
+}
+
+func (c *ClinicEventsConsumer) Initialize(config *events.CloudEventsConfig) error {
+	return nil
+}
+
+func (c *ClinicEventsConsumer) HandleKafkaMessage(cm *sarama.ConsumerMessage) error {
+	if cm.Value == nil {
+		// Ignore tombstone messages
+		return nil
+	}
+
+	event := ClinicEvent{}
+	if err := unmarshalCDCEvent(cm.Value, &event); err != nil {
+		return err
+	}
+	// Companies of deleted clinics are kept for the sales history
+	if event.FullDocument == nil || event.OperationType == store.OperationDelete {
+		return nil
+	}
+
+	details := event.FullDocument.Clinic()
+	clinicId := *details.Id
+	c.cache.InvalidateClinic(clinicId)
+
+	ctx, cancel := kafkaContext(cm)
+	defer cancel()
+	log.Printf("Upserting company of clinic %v after %v event\n", clinicId, event.OperationType)
+	if err := c.companies.UpsertCompany(ctx, details); err != nil {
+		return err
+	}
+
+	// Replace events don't describe the changed fields
+	refresh := event.OperationType == store.OperationReplace ||
+		(event.OperationType == store.OperationUpdate && event.UpdateDescription.touches(clinicFields))
+	if !refresh {
+		return nil
+	}
+	userIds, err := c.clinicians.ClinicianIDs(ctx, clinicId)
+	if err != nil {
+		return err
+	}
+	if len(userIds) == 0 {
+		return nil
+	}
+	job := &store.RefreshJob{
+		Filter:    store.UsersFilter{UserIDs: userIds},
+		CreatedBy: fmt.Sprintf("%s/%d/%d", cm.Topic, cm.Partition, cm.Offset),
+	}
+	if err := c.jobs.CreateRefreshJob(ctx, job); err != nil {
+		return err
+	}
+	log.Printf("Created refresh job %s for %v clinicians of clinic %v\n", job.ID.Hex(), len(userIds), clinicId)
+	return nil
+}
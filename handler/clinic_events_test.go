@@ -0,0 +1,109 @@
+package handler_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IBM/sarama"
+	clinic "github.com/tidepool-org/clinic/client"
+
+	"github.com/tidepool-org/marketo-service/handler"
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+type CompanyManagerMock struct {
+	Upserted []clinic.Clinic
+}
+
+func (c *CompanyManagerMock) UpsertCompany(ctx context.Context, details clinic.Clinic) error {
+	c.Upserted = append(c.Upserted, details)
+	return nil
+}
+
+type ClinicianListerMock struct {
+	Listed []string
+}
+
+func (c *ClinicianListerMock) ClinicianIDs(ctx context.Context, clinicId string) ([]string, error) {
+	c.Listed = append(c.Listed, clinicId)
+	return []string{"1234", "5678"}, nil
+}
+
+type ClinicDetailsCacheMock struct {
+	Invalidated []string
+}
+
+func (c *ClinicDetailsCacheMock) InvalidateClinic(clinicId string) {
+	c.Invalidated = append(c.Invalidated, clinicId)
+}
+
+func Test_ClinicEventsConsumer(t *testing.T) {
+	const clinicId = "6218b2ab3f4f1e5b2c3d4e60"
+	tests := []struct {
+		name               string
+		value              string
+		expectedUpserts    int
+		expectedRefreshes  int
+		expectedCompanyWeb string
+	}{
+		{
+			name:               "clinic created",
+			value:              `{"operationType": "insert", "fullDocument": {"_id": {"$oid": "` + clinicId + `"}, "name": "Example Clinic", "website": "https://example.com", "phoneNumbers": [{"type": "main", "number": "555-0100"}]}}`,
+			expectedUpserts:    1,
+			expectedCompanyWeb: "https://example.com",
+		},
+		{
+			name:              "tier changed",
+			value:             `{"operationType": "update", "fullDocument": {"_id": {"$oid": "` + clinicId + `"}, "name": "Example Clinic", "tier": "tier0300"}, "updateDescription": {"updatedFields": {"tier": "tier0300"}, "removedFields": []}}`,
+			expectedUpserts:   1,
+			expectedRefreshes: 1,
+		},
+		{
+			name:              "clinic replaced",
+			value:             `{"operationType": "replace", "fullDocument": {"_id": {"$oid": "` + clinicId + `"}, "name": "Example Clinic", "tier": "tier0300"}}`,
+			expectedUpserts:   1,
+			expectedRefreshes: 1,
+		},
+		{
+			name:            "patient tags changed",
+			value:           `{"operationType": "update", "fullDocument": {"_id": {"$oid": "` + clinicId + `"}, "name": "Example Clinic"}, "updateDescription": {"updatedFields": {"patientTags": []}, "removedFields": []}}`,
+			expectedUpserts: 1,
+		},
+		{
+			name:  "clinic deleted",
+			value: `{"operationType": "delete", "documentKey": {"_id": {"$oid": "` + clinicId + `"}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			companies := &CompanyManagerMock{}
+			clinicians := &ClinicianListerMock{}
+			jobs := store.NewMemoryStore()
+			cache := &ClinicDetailsCacheMock{}
+			consumer, _ := handler.NewClinicEventsConsumer(companies, clinicians, jobs, cache)
+			if err := consumer.HandleKafkaMessage(&sarama.ConsumerMessage{Value: []byte(tt.value)}); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(companies.Upserted) != tt.expectedUpserts || len(cache.Invalidated) != tt.expectedUpserts {
+				t.Fatalf("Expected %v upserted companies, got %+v", tt.expectedUpserts, companies.Upserted)
+			}
+			created, _ := jobs.FindUnfinishedRefreshJobs(context.Background())
+			if len(created) != tt.expectedRefreshes {
+				t.Fatalf("Expected %v refresh jobs, got %v", tt.expectedRefreshes, len(created))
+			}
+			for _, job := range created {
+				if len(job.Filter.UserIDs) != 2 {
+					t.Errorf("Expected the clinicians to be refreshed, got %v", job.Filter.UserIDs)
+				}
+			}
+			for _, upserted := range companies.Upserted {
+				if *upserted.Id != clinicId {
+					t.Errorf("Expected clinic %v, got %v", clinicId, *upserted.Id)
+				}
+				if tt.expectedCompanyWeb != "" && (upserted.Website == nil || *upserted.Website != tt.expectedCompanyWeb || upserted.PhoneNumbers == nil) {
+					t.Errorf("Expected the details of the clinic, got %+v", upserted)
+				}
+			}
+		})
+	}
+}
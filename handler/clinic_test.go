@@ -0,0 +1,82 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	clinic "github.com/tidepool-org/clinic/client"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+
+	"github.com/tidepool-org/marketo-service/handler"
+	"github.com/tidepool-org/marketo-service/relationships"
+)
+
+func CliniciansServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/clinics/1234/clinicians":
+			_, _ = w.Write([]byte(`[
+				{"id": "1", "email": "one@example.com", "roles": ["CLINIC_ADMIN"]},
+				{"id": "2", "email": "two@example.com", "roles": ["CLINIC_MEMBER"]},
+				{"inviteId": "3", "email": "three@example.com", "roles": ["CLINIC_MEMBER"]}
+			]`))
+		case "/v1/clinicians/1/clinics", "/v1/clinicians/2/clinics":
+			_, _ = w.Write([]byte("[]"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("{}"))
+		}
+	}))
+}
+
+func Test_RefreshClinic(t *testing.T) {
+	clinicsServer := CliniciansServer(t)
+	defer clinicsServer.Close()
+	clinics, _ := clinic.NewClientWithResponses(clinicsServer.URL)
+	shorelineClient := shoreline.NewMock("token")
+	userEventsHandler := &handler.UserEventsHandler{Clinics: clinics, Relationships: relationships.NewResolver(clinics, relationships.Config{}), Shoreline: shorelineClient}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/clinics/{clinicId}/marketo", handler.RefreshClinic(userEventsHandler, shorelineClient)).Methods("POST")
+
+	tests := []struct {
+		name               string
+		clinicId           string
+		expectedStatusCode int
+		expectedSummary    handler.ClinicRefreshSummary
+	}{
+		{
+			name:               "existing clinic",
+			clinicId:           "1234",
+			expectedStatusCode: http.StatusOK,
+			expectedSummary:    handler.ClinicRefreshSummary{ClinicID: "1234", Clinicians: 3, Refreshed: 2, Invited: 1},
+		},
+		{name: "missing clinic", clinicId: "NotFound", expectedStatusCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/clinics/"+tt.clinicId+"/marketo", nil)
+			req.Header.Set("x-tidepool-session-token", "token")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.expectedStatusCode {
+				t.Fatalf("Expected status code %d, got %d", tt.expectedStatusCode, rec.Code)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			summary := handler.ClinicRefreshSummary{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			expected := tt.expectedSummary
+			if summary.ClinicID != expected.ClinicID || summary.Clinicians != expected.Clinicians || summary.Refreshed != expected.Refreshed || summary.Invited != expected.Invited || summary.Failed != expected.Failed {
+				t.Errorf("Expected summary %+v, got %+v", expected, summary)
+			}
+		})
+	}
+}
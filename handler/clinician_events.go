@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/IBM/sarama"
+	"github.com/tidepool-org/go-common/events"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+// clinicianFields are the fields of a clinician which affect the marketo lead
+var clinicianFields = []string{"userId", "roles"}
+
+// ClinicianEvent is a change event of the clinicians collection of the clinic service
+type ClinicianEvent struct {
+	OperationType            string                `bson:"operationType"`
+	FullDocument             *ClinicianDocument    `bson:"fullDocument"`
+	FullDocumentBeforeChange *ClinicianDocument    `bson:"fullDocumentBeforeChange"`
+	UpdateDescription        *CDCUpdateDescription `bson:"updateDescription"`
+}
+
+type ClinicianDocument struct {
+	UserId *string  `bson:"userId"`
+	Roles  []string `bson:"roles"`
+}
+
+type CDCUpdateDescription struct {
+	UpdatedFields bson.M   `bson:"updatedFields"`
+	RemovedFields []string `bson:"removedFields"`
+}
+
+// UserRefresher sends the current state of a user to marketo
+type UserRefresher interface {
+	RefreshUser(ctx context.Context, userId string, force bool) error
+}
+
+// ClinicsCache caches the clinics of the users
+type ClinicsCache interface {
+	Invalidate(userId string)
+}
+
+var _ events.MessageConsumer = &ClinicianEventsConsumer{}
+
+// ClinicianEventsConsumer refreshes the users who were added to or removed from a clinic,
+// or whose roles in a clinic have changed
+type ClinicianEventsConsumer struct {
+	refresher UserRefresher
+	cache     ClinicsCache
+}
+
+func NewClinicianEventsConsumer(refresher UserRefresher, cache ClinicsCache) (*ClinicianEventsConsumer, error) {
+	return &ClinicianEventsConsumer{refresher: refresher, cache: cache}, nil
+}
+
+func (c *ClinicianEventsConsumer) Initialize(config *events.CloudEventsConfig) error {
+	return nil
+}
+
+func (c *ClinicianEventsConsumer) HandleKafkaMessage(cm *sarama.ConsumerMessage) error {
+	if cm.Value == nil {
+		// Ignore tombstone messages
+		return nil
+	}
+
+	event, err := ParseClinicianEvent(cm.Value)
+	if err != nil {
+		return err
+	}
+	if event.OperationType == store.OperationUpdate && !event.UpdateDescription.touches(clinicianFields) {
+		return nil
+	}
+
+	userIds := event.userIds()
+	if len(userIds) == 0 {
+		// Invites and deletes without a pre-image can't be attributed to a user
+		return nil
+	}
+
+	ctx, cancel := kafkaContext(cm)
+	defer cancel()
+	for _, userId := range userIds {
+		c.cache.Invalidate(userId)
+		log.Printf("Refreshing clinician %v after %v event\n", userId, event.OperationType)
+		if err := c.refresher.RefreshUser(ctx, userId, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseClinicianEvent parses the extended JSON of a change event of a clinician
+func ParseClinicianEvent(value []byte) (*ClinicianEvent, error) {
+	event := &ClinicianEvent{}
+	if err := unmarshalCDCEvent(value, event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// unmarshalCDCEvent parses the extended JSON of a change event. The event may be encoded
+// as a JSON string depending on the converter of the source connector.
+func unmarshalCDCEvent(value []byte, event interface{}) error {
+	if strings.HasPrefix(string(value), `"`) {
+		unquoted, err := strconv.Unquote(string(value))
+		if err != nil {
+			return err
+		}
+		value = []byte(unquoted)
+	}
+	return bson.UnmarshalExtJSON(value, false, event)
+}
+
+func (e *ClinicianEvent) userIds() []string {
+	var userIds []string
+	for _, document := range []*ClinicianDocument{e.FullDocument, e.FullDocumentBeforeChange} {
+		if document == nil || document.UserId == nil || *document.UserId == "" {
+			continue
+		}
+		userIds = appendUnique(userIds, *document.UserId)
+	}
+	return userIds
+}
+
+func (u *CDCUpdateDescription) touches(fields []string) bool {
+	// Without the description the change is assumed to be relevant
+	if u == nil {
+		return true
+	}
+	for _, field := range fields {
+		prefix := field + "."
+		for updated := range u.UpdatedFields {
+			if updated == field || strings.HasPrefix(updated, prefix) {
+				return true
+			}
+		}
+		for _, removed := range u.RemovedFields {
+			if removed == field || strings.HasPrefix(removed, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package handler_test
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/IBM/sarama"
+
+	"github.com/tidepool-org/marketo-service/handler"
+)
+
+type UserRefresherMock struct {
+	Refreshed []string
+}
+
+func (u *UserRefresherMock) RefreshUser(ctx context.Context, userId string, force bool) error {
+	u.Refreshed = append(u.Refreshed, userId)
+	return nil
+}
+
+type ClinicsCacheMock struct {
+	Invalidated []string
+}
+
+func (c *ClinicsCacheMock) Invalidate(userId string) {
+	c.Invalidated = append(c.Invalidated, userId)
+}
+
+func Test_ClinicianEventsConsumer(t *testing.T) {
+	tests := []struct {
+		name              string
+		value             string
+		expectedRefreshed []string
+	}{
+		{
+			name:              "clinician added",
+			value:             `{"operationType": "insert", "fullDocument": {"_id": {"$oid": "6218b2ab3f4f1e5b2c3d4e5f"}, "clinicId": {"$oid": "6218b2ab3f4f1e5b2c3d4e60"}, "userId": "1234", "roles": ["CLINIC_MEMBER"]}}`,
+			expectedRefreshed: []string{"1234"},
+		},
+		{
+			name:              "role changed",
+			value:             `{"operationType": "update", "fullDocument": {"userId": "1234", "roles": ["CLINIC_ADMIN", "PRESCRIBER"]}, "updateDescription": {"updatedFields": {"roles.1": "PRESCRIBER"}, "removedFields": []}}`,
+			expectedRefreshed: []string{"1234"},
+		},
+		{
+			name:  "name changed",
+			value: `{"operationType": "update", "fullDocument": {"userId": "1234", "roles": ["CLINIC_ADMIN"]}, "updateDescription": {"updatedFields": {"name": "Dr. Smith"}, "removedFields": []}}`,
+		},
+		{
+			name:              "clinician removed",
+			value:             `{"operationType": "delete", "fullDocumentBeforeChange": {"userId": "1234", "roles": ["CLINIC_MEMBER"]}}`,
+			expectedRefreshed: []string{"1234"},
+		},
+		{
+			name:  "clinician removed without a pre-image",
+			value: `{"operationType": "delete", "documentKey": {"_id": {"$oid": "6218b2ab3f4f1e5b2c3d4e5f"}}}`,
+		},
+		{
+			name:  "invite created",
+			value: `{"operationType": "insert", "fullDocument": {"inviteId": "5678", "roles": ["CLINIC_MEMBER"]}}`,
+		},
+		{
+			name:              "string encoded event",
+			value:             strconv.Quote(`{"operationType": "replace", "fullDocument": {"userId": "1234", "roles": ["CLINIC_MEMBER"]}}`),
+			expectedRefreshed: []string{"1234"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refresher := &UserRefresherMock{}
+			cache := &ClinicsCacheMock{}
+			consumer, _ := handler.NewClinicianEventsConsumer(refresher, cache)
+			if err := consumer.HandleKafkaMessage(&sarama.ConsumerMessage{Value: []byte(tt.value)}); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(refresher.Refreshed, tt.expectedRefreshed) {
+				t.Errorf("Expected refreshed users %v, got %v", tt.expectedRefreshed, refresher.Refreshed)
+			}
+			if !reflect.DeepEqual(cache.Invalidated, tt.expectedRefreshed) {
+				t.Errorf("Expected the clinics of %v to be invalidated, got %v", tt.expectedRefreshed, cache.Invalidated)
+			}
+		})
+	}
+}
@@ -2,15 +2,17 @@ package handler
 
 import (
 	"context"
-	"fmt"
 	clinic "github.com/tidepool-org/clinic/client"
 	"github.com/tidepool-org/go-common/clients/shoreline"
 	"log"
-	"net/http"
+	"sync"
 	"time"
 
+	"github.com/IBM/sarama"
 	"github.com/tidepool-org/go-common/events"
 	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/relationships"
+	"github.com/tidepool-org/marketo-service/store"
 )
 
 const timeout = time.Second * 30
@@ -21,12 +23,25 @@ type UserEventsHandler struct {
 	events.NoopUserEventsHandler
 	MarketoManager marketo.Manager
 	Clinics        clinic.ClientWithResponsesInterface
+	Relationships  *relationships.Resolver
 	Shoreline      shoreline.Client
+
+	// source is the source of the mutations of the events, it's set by the user events consumer
+	source *store.AuditSource
 }
 
 func (u *UserEventsHandler) HandleUpdateUserEvent(event events.UpdateUserEvent) error {
+	return u.UpdateUser(u.sourceContext(), event)
+}
+
+func (u *UserEventsHandler) HandleDeleteUserEvent(event events.DeleteUserEvent) error {
+	return u.DeleteUser(u.sourceContext(), event)
+}
+
+// UpdateUser creates or updates the lead of the user once the user is verified and has accepted the terms
+func (u *UserEventsHandler) UpdateUser(ctx context.Context, event events.UpdateUserEvent) error {
 	if event.Updated.EmailVerified && event.Updated.TermsAccepted != "" {
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		ctx, cancel := context.WithTimeout(ctx, timeout)
 		defer cancel()
 
 		userId := event.Original.UserID
@@ -36,22 +51,71 @@ func (u *UserEventsHandler) HandleUpdateUserEvent(event events.UpdateUserEvent)
 		}
 		if event.Original.TermsAccepted == "" {
 			log.Printf("Received create user event: %v", event)
-			u.MarketoManager.CreateListMembershipForUser(event.Updated.UserID, event.Updated, clinics)
+			return u.MarketoManager.CreateListMembershipForUser(ctx, event.Updated.UserID, event.Updated, clinics)
 		} else {
 			log.Printf("Received update user event: %v", event)
-			u.MarketoManager.UpdateListMembershipForUser(event.Updated.UserID, event.Original, event.Updated, false, clinics)
+			return u.MarketoManager.UpdateListMembershipForUser(ctx, event.Updated.UserID, event.Original, event.Updated, false, clinics)
 		}
 	}
 	return nil
 }
 
-func (u *UserEventsHandler) HandleDeleteUserEvent(event events.DeleteUserEvent) error {
+// DeleteUser marks the lead of the user as deleted
+func (u *UserEventsHandler) DeleteUser(ctx context.Context, event events.DeleteUserEvent) error {
 	log.Printf("Received delete user event: %v", event)
-	u.MarketoManager.UpdateListMembershipForUser(event.UserID, event.UserData, event.UserData, true, nil)
-	return nil
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return u.MarketoManager.UpdateListMembershipForUser(ctx, event.UserID, event.UserData, event.UserData, true, nil)
+}
+
+// sourceContext returns a context which attributes the mutations to the source of the handler
+func (u *UserEventsHandler) sourceContext() context.Context {
+	if u.source == nil {
+		return context.Background()
+	}
+	return marketo.ContextWithSource(context.Background(), *u.source)
+}
+
+// UserEventsConsumer consumes the user events published by shoreline and attributes the mutations
+// to the kafka message of each event. The messages are handled one at a time.
+type UserEventsConsumer struct {
+	mu       sync.Mutex
+	handler  *UserEventsHandler
+	delegate *events.CloudEventsMessageConsumer
+}
+
+func NewUserEventsConsumer(userEventsHandler *UserEventsHandler) (*UserEventsConsumer, error) {
+	// The consumer sets the source of its own copy of the handler
+	handler := *userEventsHandler
+	delegate, err := events.NewCloudEventsMessageHandler([]events.EventHandler{
+		events.NewUserEventsHandler(&handler),
+		&events.DebugEventHandler{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &UserEventsConsumer{
+		handler:  &handler,
+		delegate: delegate,
+	}, nil
+}
+
+func (c *UserEventsConsumer) Initialize(config *events.CloudEventsConfig) error {
+	return c.delegate.Initialize(config)
+}
+
+func (c *UserEventsConsumer) HandleKafkaMessage(cm *sarama.ConsumerMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	source := kafkaSource(cm)
+	c.handler.source = &source
+	defer func() { c.handler.source = nil }()
+	return c.delegate.HandleKafkaMessage(cm)
 }
 
-func (u *UserEventsHandler) RefreshUser(ctx context.Context, userId string) error {
+// RefreshUser sends the current state of the user to marketo. If force is set, the user
+// is sent even if nothing has changed since the last sync.
+func (u *UserEventsHandler) RefreshUser(ctx context.Context, userId string, force bool) error {
 	user, err := u.Shoreline.GetUser(userId, u.Shoreline.TokenProvide())
 	if err != nil {
 		return err
@@ -70,21 +134,9 @@ func (u *UserEventsHandler) RefreshUser(ctx context.Context, userId string) erro
 		return err
 	}
 
-	u.MarketoManager.UpdateListMembershipForUser(user.UserID, *user, *user, false, clinics)
-	return nil
+	return u.MarketoManager.RefreshListMembershipForUser(ctx, user.UserID, *user, force, clinics)
 }
 
 func (u *UserEventsHandler) getClinicsForClinician(ctx context.Context, userId string) (*clinic.ClinicianClinicRelationships, error) {
-	maxClinics := clinic.Limit(1000)
-	params := &clinic.ListClinicsForClinicianParams{
-		Limit: &maxClinics,
-	}
-	response, err := u.Clinics.ListClinicsForClinicianWithResponse(ctx, clinic.UserId(userId), params)
-	if err != nil {
-		return nil, err
-	}
-	if response.StatusCode() != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code %v when fetching clinics for user %v", response.StatusCode(), userId)
-	}
-	return response.JSON200, nil
+	return u.Relationships.GetClinicsForClinician(ctx, userId)
 }
@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	clinic "github.com/tidepool-org/clinic/client"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+	"github.com/tidepool-org/go-common/clients/status"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+)
+
+// LeadInspector computes the lead attributes of a user and finds the actual lead in marketo
+type LeadInspector interface {
+	InputForUser(ctx context.Context, tidepoolID string, user shoreline.UserData, delete bool, clinics *clinic.ClinicianClinicRelationships) (marketo.Input, error)
+	FindLead(userId string, email string) (*marketo.LeadResult, error)
+}
+
+// UserMarketoState is the computed and the actual marketo state of a user
+type UserMarketoState struct {
+	User    *shoreline.UserData                  `json:"user"`
+	Clinics *clinic.ClinicianClinicRelationships `json:"clinics"`
+	Input   marketo.Input                        `json:"input"`
+	Lead    *marketo.LeadResult                  `json:"lead"`
+	Diff    []marketo.FieldDiff                  `json:"diff"`
+}
+
+// InspectUser returns the state of the user in marketo and the state computed from the
+// current user and clinic relationships. Returns nil if the user doesn't exist.
+func (u *UserEventsHandler) InspectUser(ctx context.Context, inspector LeadInspector, userId string) (*UserMarketoState, error) {
+	user, err := u.Shoreline.GetUser(userId, u.Shoreline.TokenProvide())
+	if err != nil {
+		if e, ok := err.(*status.StatusError); ok && e.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if user == nil {
+		return nil, nil
+	}
+	clinics, err := u.getClinicsForClinician(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	input, err := inspector.InputForUser(ctx, user.UserID, *user, false, clinics)
+	if err != nil {
+		return nil, err
+	}
+	lead, err := inspector.FindLead(user.UserID, input.Email)
+	if err != nil {
+		return nil, err
+	}
+	return &UserMarketoState{
+		User:    user,
+		Clinics: clinics,
+		Input:   input,
+		Lead:    lead,
+		Diff:    marketo.DiffLead(input, lead),
+	}, nil
+}
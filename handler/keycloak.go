@@ -11,6 +11,7 @@ import (
 	"github.com/tidepool-org/go-common/clients/status"
 	"github.com/tidepool-org/go-common/events"
 	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/relationships"
 	"log"
 	"net/http"
 )
@@ -71,13 +72,16 @@ func (k *KeycloakUserEventsConsumer) HandleKafkaMessage(cm *sarama.ConsumerMessa
 		return err
 	}
 
+	ctx, cancel := kafkaContext(cm)
+	defer cancel()
+
 	switch event.Op {
 	case Snapshot, Create, Update:
 		log.Printf("Upserting user %v\n", string(m.Value))
-		return k.userEventsHandler.UpsertUser(event)
+		return k.userEventsHandler.UpsertUser(ctx, event)
 	case Delete:
 		log.Printf("Deleting user %v\n", string(m.Value))
-		return k.userEventsHandler.DeleteUser(event)
+		return k.userEventsHandler.DeleteUser(ctx, event)
 	default:
 		return fmt.Errorf("unknown op %s", event.Op)
 	}
@@ -103,7 +107,7 @@ func (k *KeycloakRoleEventsConsumer) HandleKafkaMessage(cm *sarama.ConsumerMessa
 		return err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := kafkaContext(cm)
 	defer cancel()
 
 	log.Printf("Refreshing user %v\n", key.UserId)
@@ -111,12 +115,12 @@ func (k *KeycloakRoleEventsConsumer) HandleKafkaMessage(cm *sarama.ConsumerMessa
 }
 
 type KeycloakEventsHandler struct {
-	Clinics        clinic.ClientWithResponsesInterface
+	Relationships  *relationships.Resolver
 	Shoreline      shoreline.Client
 	MarketoManager marketo.Manager
 }
 
-func (k *KeycloakEventsHandler) UpsertUser(event KeycloakUsersEvent) error {
+func (k *KeycloakEventsHandler) UpsertUser(ctx context.Context, event KeycloakUsersEvent) error {
 	if event.After == nil || !event.After.EmailVerified {
 		return nil
 	}
@@ -126,14 +130,14 @@ func (k *KeycloakEventsHandler) UpsertUser(event KeycloakUsersEvent) error {
 	old := shoreline.UserData{
 		UserID: userId,
 	}
+	// The before image is missing for snapshots or when the replica identity of the table
+	// is not FULL. The marketo manager falls back to the last synced email in that case.
 	if event.Before != nil {
 		old.Username = event.Before.Username
 		old.Emails = []string{event.Before.Email}
 		old.EmailVerified = event.Before.EmailVerified
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
 	clinics, err := k.getClinicsForClinician(ctx, userId)
 	if err != nil {
 		return err
@@ -156,11 +160,10 @@ func (k *KeycloakEventsHandler) UpsertUser(event KeycloakUsersEvent) error {
 	old.PasswordExists = user.PasswordExists
 	old.TermsAccepted = user.TermsAccepted
 
-	k.MarketoManager.UpdateListMembershipForUser(userId, old, *user, false, clinics)
-	return nil
+	return k.MarketoManager.UpdateListMembershipForUser(ctx, userId, old, *user, false, clinics)
 }
 
-func (k *KeycloakEventsHandler) DeleteUser(event KeycloakUsersEvent) error {
+func (k *KeycloakEventsHandler) DeleteUser(ctx context.Context, event KeycloakUsersEvent) error {
 	if event.Before == nil || !event.Before.EmailVerified {
 		return nil
 	}
@@ -173,8 +176,7 @@ func (k *KeycloakEventsHandler) DeleteUser(event KeycloakUsersEvent) error {
 	}
 
 	clinics := make(clinic.ClinicianClinicRelationships, 0)
-	k.MarketoManager.UpdateListMembershipForUser(old.UserID, old, old, true, &clinics)
-	return nil
+	return k.MarketoManager.UpdateListMembershipForUser(ctx, old.UserID, old, old, true, &clinics)
 }
 
 func (k *KeycloakEventsHandler) RefreshUser(ctx context.Context, userId string) error {
@@ -196,23 +198,11 @@ func (k *KeycloakEventsHandler) RefreshUser(ctx context.Context, userId string)
 		return err
 	}
 
-	k.MarketoManager.UpdateListMembershipForUser(user.UserID, *user, *user, false, clinics)
-	return nil
+	return k.MarketoManager.UpdateListMembershipForUser(ctx, user.UserID, *user, *user, false, clinics)
 }
 
 func (k *KeycloakEventsHandler) getClinicsForClinician(ctx context.Context, userId string) (*clinic.ClinicianClinicRelationships, error) {
-	maxClinics := clinic.Limit(1000)
-	params := &clinic.ListClinicsForClinicianParams{
-		Limit: &maxClinics,
-	}
-	response, err := k.Clinics.ListClinicsForClinicianWithResponse(ctx, clinic.UserId(userId), params)
-	if err != nil {
-		return nil, err
-	}
-	if response.StatusCode() != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code %v when fetching clinics for user %v", response.StatusCode(), userId)
-	}
-	return response.JSON200, nil
+	return k.Relationships.GetClinicsForClinician(ctx, userId)
 }
 
 func (k *KeycloakEventsHandler) getUserById(userId string) (*shoreline.UserData, error) {
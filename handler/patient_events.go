@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"log"
+
+	"github.com/IBM/sarama"
+	"github.com/tidepool-org/go-common/events"
+
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+// patientFields are the fields of a patient which affect the marketo lead
+var patientFields = []string{"userId"}
+
+// PatientEvent is a change event of the patients collection of the clinic service
+type PatientEvent struct {
+	OperationType            string                `bson:"operationType"`
+	FullDocument             *PatientDocument      `bson:"fullDocument"`
+	FullDocumentBeforeChange *PatientDocument      `bson:"fullDocumentBeforeChange"`
+	UpdateDescription        *CDCUpdateDescription `bson:"updateDescription"`
+}
+
+type PatientDocument struct {
+	UserId *string `bson:"userId"`
+}
+
+// PatientClinicsCache caches the clinics of the patients
+type PatientClinicsCache interface {
+	InvalidatePatient(userId string)
+}
+
+var _ events.MessageConsumer = &PatientEventsConsumer{}
+
+// PatientEventsConsumer refreshes the users who became or stopped being patients of a clinic
+type PatientEventsConsumer struct {
+	refresher UserRefresher
+	cache     PatientClinicsCache
+}
+
+func NewPatientEventsConsumer(refresher UserRefresher, cache PatientClinicsCache) (*PatientEventsConsumer, error) {
+	return &PatientEventsConsumer{refresher: refresher, cache: cache}, nil
+}
+
+func (p *PatientEventsConsumer) Initialize(config *events.CloudEventsConfig) error {
+	return nil
+}
+
+func (p *PatientEventsConsumer) HandleKafkaMessage(cm *sarama.ConsumerMessage) error {
+	if cm.Value == nil {
+		// Ignore tombstone messages
+		return nil
+	}
+
+	event := PatientEvent{}
+	if err := unmarshalCDCEvent(cm.Value, &event); err != nil {
+		return err
+	}
+	// Patient documents are updated frequently, e.g. with summaries and tags, which doesn't change the relationship
+	if event.OperationType == store.OperationUpdate && !event.UpdateDescription.touches(patientFields) {
+		return nil
+	}
+
+	var userIds []string
+	for _, document := range []*PatientDocument{event.FullDocument, event.FullDocumentBeforeChange} {
+		if document != nil && document.UserId != nil && *document.UserId != "" {
+			userIds = appendUnique(userIds, *document.UserId)
+		}
+	}
+
+	ctx, cancel := kafkaContext(cm)
+	defer cancel()
+	for _, userId := range userIds {
+		p.cache.InvalidatePatient(userId)
+		log.Printf("Refreshing patient %v after %v event\n", userId, event.OperationType)
+		if err := p.refresher.RefreshUser(ctx, userId, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
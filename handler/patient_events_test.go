@@ -0,0 +1,66 @@
+package handler_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/IBM/sarama"
+
+	"github.com/tidepool-org/marketo-service/handler"
+)
+
+type PatientClinicsCacheMock struct {
+	Invalidated []string
+}
+
+func (c *PatientClinicsCacheMock) InvalidatePatient(userId string) {
+	c.Invalidated = append(c.Invalidated, userId)
+}
+
+func Test_PatientEventsConsumer(t *testing.T) {
+	tests := []struct {
+		name              string
+		value             string
+		expectedRefreshed []string
+	}{
+		{
+			name:              "patient added",
+			value:             `{"operationType": "insert", "fullDocument": {"_id": {"$oid": "6218b2ab3f4f1e5b2c3d4e5f"}, "clinicId": {"$oid": "6218b2ab3f4f1e5b2c3d4e60"}, "userId": "1234"}}`,
+			expectedRefreshed: []string{"1234"},
+		},
+		{
+			name:  "summary updated",
+			value: `{"operationType": "update", "fullDocument": {"userId": "1234"}, "updateDescription": {"updatedFields": {"summary.cgmStats.dates.lastUpdatedDate": "2024-01-01"}, "removedFields": []}}`,
+		},
+		{
+			name:              "patient removed",
+			value:             `{"operationType": "delete", "fullDocumentBeforeChange": {"userId": "1234"}}`,
+			expectedRefreshed: []string{"1234"},
+		},
+		{
+			name:  "patient removed without a pre-image",
+			value: `{"operationType": "delete", "documentKey": {"_id": {"$oid": "6218b2ab3f4f1e5b2c3d4e5f"}}}`,
+		},
+		{
+			name:              "patient replaced",
+			value:             `{"operationType": "replace", "fullDocument": {"userId": "1234"}, "fullDocumentBeforeChange": {"userId": "1234"}}`,
+			expectedRefreshed: []string{"1234"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refresher := &UserRefresherMock{}
+			cache := &PatientClinicsCacheMock{}
+			consumer, _ := handler.NewPatientEventsConsumer(refresher, cache)
+			if err := consumer.HandleKafkaMessage(&sarama.ConsumerMessage{Value: []byte(tt.value)}); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(refresher.Refreshed, tt.expectedRefreshed) {
+				t.Errorf("Expected refreshed users %v, got %v", tt.expectedRefreshed, refresher.Refreshed)
+			}
+			if !reflect.DeepEqual(cache.Invalidated, tt.expectedRefreshed) {
+				t.Errorf("Expected the clinics of %v to be invalidated, got %v", tt.expectedRefreshed, cache.Invalidated)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+)
+
+// PreferencesManager reads and updates the marketing preferences of users in marketo
+type PreferencesManager interface {
+	GetMarketingPreferences(userId string) (*marketo.MarketingPreferences, error)
+	UpdateSubscriptionCategories(ctx context.Context, userId string, categories marketo.SubscriptionCategories) error
+}
+
+// GetMarketingPreferences returns the marketing preferences of a user
+func GetMarketingPreferences(preferences PreferencesManager, shorelineClient shoreline.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId := mux.Vars(r)["userId"]
+		if userId == "" {
+			http.Error(w, "user id is empty", http.StatusBadRequest)
+			return
+		}
+
+		if userToken(r, shorelineClient, userId) == nil {
+			http.Error(w, "session token is invalid", http.StatusForbidden)
+			return
+		}
+
+		result, err := preferences.GetMarketingPreferences(userId)
+		if err != nil {
+			log.Printf("unable to get marketing preferences of user %v: %v\n", userId, err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if result == nil {
+			http.Error(w, "marketing preferences not found", http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// UpdateMarketingPreferences replaces the subscription categories of a user. The unsubscribed flag of the
+// request is ignored, it's managed by the sync.
+func UpdateMarketingPreferences(preferences PreferencesManager, shorelineClient shoreline.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId := mux.Vars(r)["userId"]
+		if userId == "" {
+			http.Error(w, "user id is empty", http.StatusBadRequest)
+			return
+		}
+
+		td := userToken(r, shorelineClient, userId)
+		if td == nil {
+			http.Error(w, "session token is invalid", http.StatusForbidden)
+			return
+		}
+
+		body := marketo.MarketingPreferences{}
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&body); err != nil {
+			http.Error(w, "marketing preferences are invalid", http.StatusBadRequest)
+			return
+		}
+
+		if err := preferences.UpdateSubscriptionCategories(apiContext(r, td), userId, body.Categories); err != nil {
+			if errors.Is(err, marketo.ErrLeadNotFound) {
+				http.Error(w, "marketing preferences not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("unable to update marketing preferences of user %v: %v\n", userId, err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,101 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+
+	"github.com/tidepool-org/marketo-service/handler"
+	"github.com/tidepool-org/marketo-service/marketo"
+)
+
+// ShorelineTokensMock accepts the server token and the session tokens of users, which are the user ids
+type ShorelineTokensMock struct {
+	*shoreline.ShorelineMockClient
+}
+
+func (s *ShorelineTokensMock) CheckToken(token string) *shoreline.TokenData {
+	switch token {
+	case "":
+		return nil
+	case "server":
+		return &shoreline.TokenData{UserID: "server", IsServer: true}
+	default:
+		return &shoreline.TokenData{UserID: token}
+	}
+}
+
+type PreferencesManagerMock struct {
+	Preferences map[string]*marketo.MarketingPreferences
+}
+
+func (p *PreferencesManagerMock) GetMarketingPreferences(userId string) (*marketo.MarketingPreferences, error) {
+	return p.Preferences[userId], nil
+}
+
+func (p *PreferencesManagerMock) UpdateSubscriptionCategories(ctx context.Context, userId string, categories marketo.SubscriptionCategories) error {
+	preferences, ok := p.Preferences[userId]
+	if !ok {
+		return marketo.ErrLeadNotFound
+	}
+	preferences.Categories = categories
+	return nil
+}
+
+func Test_MarketingPreferences(t *testing.T) {
+	shorelineClient := &ShorelineTokensMock{ShorelineMockClient: shoreline.NewMock("server")}
+	preferences := &PreferencesManagerMock{Preferences: map[string]*marketo.MarketingPreferences{
+		"1234": {Categories: marketo.SubscriptionCategories{ProductUpdates: true}},
+	}}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/users/{userId}/marketing-preferences", handler.GetMarketingPreferences(preferences, shorelineClient)).Methods("GET")
+	router.HandleFunc("/v1/users/{userId}/marketing-preferences", handler.UpdateMarketingPreferences(preferences, shorelineClient)).Methods("PUT")
+
+	tests := []struct {
+		name               string
+		method             string
+		userId             string
+		token              string
+		body               string
+		expectedStatusCode int
+	}{
+		{name: "get with the session token of the user", method: http.MethodGet, userId: "1234", token: "1234", expectedStatusCode: http.StatusOK},
+		{name: "get with a server token", method: http.MethodGet, userId: "1234", token: "server", expectedStatusCode: http.StatusOK},
+		{name: "get with the session token of another user", method: http.MethodGet, userId: "1234", token: "5678", expectedStatusCode: http.StatusForbidden},
+		{name: "get without a lead", method: http.MethodGet, userId: "5678", token: "5678", expectedStatusCode: http.StatusNotFound},
+		{name: "update", method: http.MethodPut, userId: "1234", token: "1234", body: `{"categories": {"researchOpportunities": true}}`, expectedStatusCode: http.StatusNoContent},
+		{name: "update with an unknown category", method: http.MethodPut, userId: "1234", token: "1234", body: `{"categories": {"sweepstakes": true}}`, expectedStatusCode: http.StatusBadRequest},
+		{name: "update without a lead", method: http.MethodPut, userId: "5678", token: "server", body: `{"categories": {}}`, expectedStatusCode: http.StatusNotFound},
+		{name: "update without a token", method: http.MethodPut, userId: "1234", body: `{"categories": {}}`, expectedStatusCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/v1/users/"+tt.userId+"/marketing-preferences", strings.NewReader(tt.body))
+			req.Header.Set("x-tidepool-session-token", tt.token)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.expectedStatusCode {
+				t.Fatalf("Expected status code %d, got %d", tt.expectedStatusCode, rec.Code)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/users/1234/marketing-preferences", nil)
+	req.Header.Set("x-tidepool-session-token", "1234")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	result := marketo.MarketingPreferences{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := (marketo.SubscriptionCategories{ResearchOpportunities: true}); result.Categories != expected {
+		t.Errorf("Expected categories %+v, got %+v", expected, result.Categories)
+	}
+}
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+const (
+	maxRefreshJobUserIds       = 10000
+	defaultRefreshResultsLimit = 100
+	maxRefreshResultsLimit     = 1000
+)
+
+// RefreshJobRequest selects the users refreshed by a job. The user ids and the filter are combined.
+type RefreshJobRequest struct {
+	UserIDs []string           `json:"userIds,omitempty"`
+	Filter  *store.UsersFilter `json:"filter,omitempty"`
+	Force   bool               `json:"force,omitempty"`
+}
+
+// RefreshJobProgress is computed from the results of the job
+type RefreshJobProgress struct {
+	Processed int `json:"processed"`
+	Refreshed int `json:"refreshed"`
+	Failed    int `json:"failed"`
+}
+
+type RefreshJobResponse struct {
+	*store.RefreshJob
+	Progress RefreshJobProgress        `json:"progress"`
+	Results  []*store.RefreshJobResult `json:"results"`
+}
+
+// CreateRefreshJob persists a job which refreshes the selected users in the background
+func CreateRefreshJob(jobs store.RefreshJobRepository, shorelineClient shoreline.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		td := serverToken(r, shorelineClient)
+		if td == nil {
+			http.Error(w, "session token is invalid", http.StatusForbidden)
+			return
+		}
+
+		request := RefreshJobRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "request body is invalid", http.StatusBadRequest)
+			return
+		}
+		filter := store.UsersFilter{}
+		if request.Filter != nil {
+			filter = *request.Filter
+		}
+		if len(request.UserIDs) > 0 {
+			filter.UserIDs = request.UserIDs
+		}
+		if len(filter.UserIDs) > maxRefreshJobUserIds {
+			http.Error(w, "too many user ids", http.StatusBadRequest)
+			return
+		}
+		if request.Filter == nil && len(filter.UserIDs) == 0 {
+			http.Error(w, "user ids or filter are required", http.StatusBadRequest)
+			return
+		}
+
+		job := &store.RefreshJob{
+			Filter:    filter,
+			Force:     request.Force,
+			CreatedBy: td.UserID,
+		}
+		if err := jobs.CreateRefreshJob(r.Context(), job); err != nil {
+			log.Printf("unable to create refresh job: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusAccepted, RefreshJobResponse{RefreshJob: job, Results: []*store.RefreshJobResult{}})
+	}
+}
+
+// GetRefreshJob returns the status, the progress and a page of the results of a job. The results
+// can be filtered by status and paginated with the offset and limit query parameters.
+func GetRefreshJob(jobs store.RefreshJobRepository, shorelineClient shoreline.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isServerRequest(r, shorelineClient) {
+			http.Error(w, "session token is invalid", http.StatusForbidden)
+			return
+		}
+
+		id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "job id is invalid", http.StatusBadRequest)
+			return
+		}
+		query := r.URL.Query()
+		status := query.Get("status")
+		offset, err := intQueryParam(query.Get("offset"), 0)
+		if err != nil || offset < 0 {
+			http.Error(w, "offset is invalid", http.StatusBadRequest)
+			return
+		}
+		limit, err := intQueryParam(query.Get("limit"), defaultRefreshResultsLimit)
+		if err != nil || limit <= 0 || limit > maxRefreshResultsLimit {
+			http.Error(w, "limit is invalid", http.StatusBadRequest)
+			return
+		}
+
+		ctx := r.Context()
+		job, err := jobs.FindRefreshJob(ctx, id)
+		if err != nil {
+			log.Printf("unable to find refresh job %v: %v\n", id.Hex(), err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if job == nil {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+
+		response := RefreshJobResponse{RefreshJob: job}
+		if response.Progress.Refreshed, err = jobs.CountRefreshJobResults(ctx, id, store.RefreshResultStatusRefreshed); err == nil {
+			response.Progress.Failed, err = jobs.CountRefreshJobResults(ctx, id, store.RefreshResultStatusFailed)
+		}
+		if err == nil {
+			response.Results, err = jobs.FindRefreshJobResults(ctx, id, status, offset, limit)
+		}
+		if err != nil {
+			log.Printf("unable to find the results of refresh job %v: %v\n", id.Hex(), err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.Progress.Processed = response.Progress.Refreshed + response.Progress.Failed
+		if response.Results == nil {
+			response.Results = []*store.RefreshJobResult{}
+		}
+
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+func intQueryParam(value string, defaultValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(value)
+}
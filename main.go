@@ -6,11 +6,18 @@ import (
 	"github.com/kelseyhightower/envconfig"
 	clinic "github.com/tidepool-org/clinic/client"
 	"github.com/tidepool-org/go-common/clients/disc"
+	tpMongo "github.com/tidepool-org/go-common/clients/mongo"
 	"github.com/tidepool-org/go-common/clients/shoreline"
 	"github.com/tidepool-org/go-common/errors"
 	"github.com/tidepool-org/go-common/events"
+	"github.com/tidepool-org/marketo-service/consent"
+	"github.com/tidepool-org/marketo-service/deadletter"
 	"github.com/tidepool-org/marketo-service/handler"
 	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/profile"
+	"github.com/tidepool-org/marketo-service/refreshjob"
+	"github.com/tidepool-org/marketo-service/relationships"
+	"github.com/tidepool-org/marketo-service/store"
 	"log"
 	"net/http"
 	"os"
@@ -25,6 +32,23 @@ import (
 const (
 	keycloakUsersTopic = "keycloak.public.user_entity"
 	keycloakRolesTopic = "keycloak.public.user_role_mapping"
+
+	clinicCliniciansTopic = "clinic.clinicians"
+	clinicClinicsTopic    = "clinic.clinics"
+	clinicPatientsTopic   = "clinic.patients"
+
+	keycloakUsersDeadLettersTopic    = keycloakUsersTopic + ".marketo" + events.DeadLetterSuffix
+	keycloakRolesDeadLettersTopic    = keycloakRolesTopic + ".marketo" + events.DeadLetterSuffix
+	clinicCliniciansDeadLettersTopic = clinicCliniciansTopic + ".marketo" + events.DeadLetterSuffix
+	clinicClinicsDeadLettersTopic    = clinicClinicsTopic + ".marketo" + events.DeadLetterSuffix
+	clinicPatientsDeadLettersTopic   = clinicPatientsTopic + ".marketo" + events.DeadLetterSuffix
+
+	// cliniciansConsumerGroupSuffix separates the offsets of the clinicians consumer from the other consumers
+	cliniciansConsumerGroupSuffix = "-clinicians"
+	// clinicsConsumerGroupSuffix separates the offsets of the clinics consumer from the other consumers
+	clinicsConsumerGroupSuffix = "-clinics"
+	// patientsConsumerGroupSuffix separates the offsets of the patients consumer from the other consumers
+	patientsConsumerGroupSuffix = "-patients"
 )
 
 type Config struct {
@@ -36,13 +60,66 @@ type ServiceConfig struct {
 	ListenAddress string `envconfig:"LISTEN_ADDRESS" default:":8080"`
 	ServerSecret  string `envconfig:"TIDEPOOL_SERVER_SECRET" required:"true"`
 	ShorelineHost string `envconfig:"TIDEPOOL_SHORELINE_CLIENT_ADDRESS" default:"http://shoreline:9107"`
+	// ProfilesHost is the address of the metadata service, the profiles of users are not synced if it's empty
+	ProfilesHost string `envconfig:"TIDEPOOL_SEAGULL_CLIENT_ADDRESS"`
+	// UserEventsSource is the source of user changes: kafka, mongo (users change stream) or all. The
+	// users change stream requires pre-images to be enabled on the users collection.
+	UserEventsSource string `envconfig:"USER_EVENTS_SOURCE" default:"kafka"`
+}
+
+const (
+	userEventsSourceKafka = "kafka"
+	userEventsSourceMongo = "mongo"
+	userEventsSourceAll   = "all"
+)
+
+func (s *ServiceConfig) KafkaEnabled() bool {
+	return s.UserEventsSource == userEventsSourceKafka || s.UserEventsSource == userEventsSourceAll
+}
+
+func (s *ServiceConfig) ChangeStreamEnabled() bool {
+	return s.UserEventsSource == userEventsSourceMongo || s.UserEventsSource == userEventsSourceAll
 }
 
 func (s *ServiceConfig) LoadFromEnv() error {
 	return envconfig.Process("", s)
 }
 
+// dependencies are shared by the service and the maintenance commands
+type dependencies struct {
+	logger                *log.Logger
+	serviceConfig         *ServiceConfig
+	cloudEventsConfig     *events.CloudEventsConfig
+	mongoStore            *store.MongoStoreClient
+	marketoManager        marketo.Manager
+	outboxDrainer         *marketo.OutboxDrainer
+	refreshJobsConfig     refreshjob.Config
+	shorelineClient       shoreline.Client
+	clinicService         clinic.ClientWithResponsesInterface
+	clinicRelationships   *relationships.Resolver
+	userEventsHandler     *handler.UserEventsHandler
+	keycloakEventsHandler *handler.KeycloakEventsHandler
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay-dlq":
+			replayDeadLetters(os.Args[2:])
+			return
+		case "reconcile":
+			reconcileLeads(os.Args[2:])
+			return
+		case "backfill":
+			backfillUsers(os.Args[2:])
+			return
+		}
+	}
+
+	runService()
+}
+
+func buildDependencies() *dependencies {
 	var config Config
 
 	logger := log.New(os.Stdout, "marketo-service", log.LstdFlags|log.Lshortfile)
@@ -51,6 +128,11 @@ func main() {
 	config.Marketo.Secret, _ = os.LookupEnv("MARKETO_SECRET")
 	config.Marketo.ClinicRole, _ = os.LookupEnv("MARKETO_CLINIC_ROLE")
 	config.Marketo.PatientRole, _ = os.LookupEnv("MARKETO_PATIENT_ROLE")
+	config.Marketo.PrimaryClinicRule, _ = os.LookupEnv("MARKETO_PRIMARY_CLINIC_RULE")
+	config.Marketo.MembershipObject, _ = os.LookupEnv("MARKETO_MEMBERSHIP_OBJECT")
+	if profileFields, found := os.LookupEnv("MARKETO_PROFILE_FIELDS"); found && profileFields != "" {
+		config.Marketo.ProfileFields = strings.Split(profileFields, ",")
+	}
 	unParsedTimeout, found := os.LookupEnv("MARKETO_TIMEOUT")
 	if found {
 		parsedTimeout64, err := strconv.ParseInt(unParsedTimeout, 10, 32)
@@ -61,23 +143,53 @@ func main() {
 		config.Marketo.Timeout = parsedTimeout
 	}
 
-	var marketoManager marketo.Manager
-	if err := config.Marketo.Validate(); err != nil {
-		//log.Fatalf("WARNING: Marketo config is invalid: %v", err)
-	} else {
-		log.Print("initializing marketo manager")
-		marketoManager, _ = marketo.NewManager(logger, config.Marketo)
+	mongoConfig := &tpMongo.Config{}
+	if err := envconfig.Process("", mongoConfig); err != nil {
+		log.Fatalln(err)
+	}
+	mongoStore := store.NewMongoStoreClient(mongoConfig)
+	if err := mongoStore.EnsureMarketoIndexes(context.Background()); err != nil {
+		log.Fatalln(err)
+	}
+
+	outboxConfig := marketo.OutboxConfig{}
+	if err := envconfig.Process("", &outboxConfig); err != nil {
+		log.Fatalln(err)
+	}
+
+	consentConfig := marketo.ConsentConfig{}
+	if err := envconfig.Process("", &consentConfig); err != nil {
+		log.Fatalln(err)
+	}
+	if err := consentConfig.Validate(); err != nil {
+		log.Fatalln(err)
+	}
+
+	auditConfig := marketo.AuditConfig{}
+	if err := envconfig.Process("", &auditConfig); err != nil {
+		log.Fatalln(err)
+	}
+
+	refreshJobsConfig := refreshjob.Config{}
+	if err := envconfig.Process("", &refreshJobsConfig); err != nil {
+		log.Fatalln(err)
 	}
 
 	serviceConfig := &ServiceConfig{}
 	if err := serviceConfig.LoadFromEnv(); err != nil {
 		log.Fatalln(err)
 	}
+	if !serviceConfig.KafkaEnabled() && !serviceConfig.ChangeStreamEnabled() {
+		log.Fatalf("unknown user events source %s", serviceConfig.UserEventsSource)
+	}
 
-	cloudEventsConfig := events.NewConfig()
-	if err := cloudEventsConfig.LoadFromEnv(); err != nil {
-		logger.Println("error loading kafka config")
-		log.Fatalln(err)
+	var cloudEventsConfig *events.CloudEventsConfig
+	if serviceConfig.KafkaEnabled() {
+		cloudEventsConfig = events.NewConfig()
+		if err := cloudEventsConfig.LoadFromEnv(); err != nil {
+			logger.Println("error loading kafka config")
+			log.Fatalln(err)
+		}
 	}
 
 	shorelineClient, err := buildShoreline(serviceConfig)
@@ -90,65 +202,116 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	userEventsHandler := &handler.UserEventsHandler{
-		Clinics:        clinicService,
-		Shoreline:      shorelineClient,
-		MarketoManager: marketoManager,
+	relationshipsConfig := relationships.Config{}
+	if err := envconfig.Process("", &relationshipsConfig); err != nil {
+		log.Fatalln(err)
 	}
+	clinicRelationships := relationships.NewResolver(clinicService, relationshipsConfig)
 
-	handlers := []events.EventHandler{
-		events.NewUserEventsHandler(userEventsHandler),
-		&events.DebugEventHandler{},
+	// The handlers call the manager for every event, the service can't run without it
+	if err := config.Marketo.Validate(); err != nil {
+		log.Fatalf("marketo config is invalid: %v", err)
 	}
-
-	createConsumer := func() (events.MessageConsumer, error) {
-		return events.NewCloudEventsMessageHandler(handlers)
+	log.Print("initializing marketo manager")
+	opts := []marketo.Option{marketo.WithSyncStates(mongoStore), marketo.WithOutbox(mongoStore), marketo.WithPatientClinics(clinicRelationships), marketo.WithAudit(mongoStore, auditConfig)}
+	var profiles *profile.Client
+	if serviceConfig.ProfilesHost != "" {
+		profiles = profile.NewClient(serviceConfig.ProfilesHost, &http.Client{Timeout: time.Minute}, shorelineClient)
+		opts = append(opts, marketo.WithProfiles(profiles))
 	}
-
-	cg, err := events.NewFaultTolerantConsumerGroup(cloudEventsConfig, createConsumer)
+	if consentResolver := buildConsent(consentConfig, profiles, shorelineClient); consentResolver != nil {
+		opts = append(opts, marketo.WithConsent(consentResolver))
+	}
+	marketoManager, err := marketo.NewManager(logger, config.Marketo, opts...)
 	if err != nil {
-		log.Fatalln(err)
+		log.Fatalf("unable to initialize marketo manager: %v", err)
 	}
+	outboxDrainer := marketo.NewOutboxDrainer(logger, marketoManager.(*marketo.Connector), mongoStore, outboxConfig)
 
-	keycloakEventsHandler := handler.KeycloakEventsHandler{
+	userEventsHandler := &handler.UserEventsHandler{
 		Clinics:        clinicService,
-		MarketoManager: marketoManager,
+		Relationships:  clinicRelationships,
 		Shoreline:      shorelineClient,
+		MarketoManager: marketoManager,
 	}
 
-	keycloakUsersConfig := *cloudEventsConfig
-	keycloakUsersConfig.KafkaTopic = keycloakUsersTopic
-	keycloakUsersConfig.KafkaDeadLettersTopic = ""
-	// CDC topic use '.' separator instead of '-'
-	if strings.HasSuffix(keycloakUsersConfig.KafkaTopicPrefix, "-") {
-		keycloakUsersConfig.KafkaTopicPrefix = strings.TrimSuffix(keycloakUsersConfig.KafkaTopicPrefix, "-") + "."
+	keycloakEventsHandler := &handler.KeycloakEventsHandler{
+		Relationships:  clinicRelationships,
+		MarketoManager: marketoManager,
+		Shoreline:      shorelineClient,
 	}
 
-	keycloakUsersCg, err := events.NewFaultTolerantConsumerGroup(&keycloakUsersConfig, func() (events.MessageConsumer, error) {
-		return handler.NewKeycloakUserEventsConsumer(&keycloakEventsHandler)
-	})
-	if err != nil {
-		log.Fatalln(err)
+	return &dependencies{
+		logger:                logger,
+		serviceConfig:         serviceConfig,
+		cloudEventsConfig:     cloudEventsConfig,
+		mongoStore:            mongoStore,
+		marketoManager:        marketoManager,
+		outboxDrainer:         outboxDrainer,
+		refreshJobsConfig:     refreshJobsConfig,
+		shorelineClient:       shorelineClient,
+		clinicService:         clinicService,
+		clinicRelationships:   clinicRelationships,
+		userEventsHandler:     userEventsHandler,
+		keycloakEventsHandler: keycloakEventsHandler,
 	}
+}
 
-	keycloakRolesConfig := *cloudEventsConfig
-	keycloakRolesConfig.KafkaTopic = keycloakRolesTopic
-	keycloakRolesConfig.KafkaDeadLettersTopic = ""
-	// CDC topic use '.' separator instead of '-'
-	if strings.HasSuffix(keycloakRolesConfig.KafkaTopicPrefix, "-") {
-		keycloakRolesConfig.KafkaTopicPrefix = strings.TrimSuffix(keycloakRolesConfig.KafkaTopicPrefix, "-") + "."
-	}
+// backgroundService is started when the service starts and is stopped on shutdown
+type backgroundService struct {
+	name  string
+	start func() error
+	stop  func() error
+}
 
-	keycloakRolesCg, err := events.NewFaultTolerantConsumerGroup(&keycloakRolesConfig, func() (events.MessageConsumer, error) {
-		return handler.NewKeycloakRoleEventsConsumer(&keycloakEventsHandler)
-	})
-	if err != nil {
-		log.Fatalln(err)
+func runService() {
+	deps := buildDependencies()
+	serviceConfig := deps.serviceConfig
+	mongoStore := deps.mongoStore
+	outboxDrainer := deps.outboxDrainer
+	shorelineClient := deps.shorelineClient
+	userEventsHandler := deps.userEventsHandler
+
+	var services []backgroundService
+	if serviceConfig.KafkaEnabled() {
+		services = append(services, kafkaConsumers(deps)...)
+	}
+	if serviceConfig.ChangeStreamEnabled() {
+		// Deleted users can only be identified with the pre-images of the changes
+		enabled, err := mongoStore.UsersPreImagesEnabled(context.Background())
+		if err != nil {
+			log.Fatalf("unable to check the pre-images of the users collection: %v", err)
+		}
+		if !enabled {
+			log.Fatalln("pre-images must be enabled on the users collection to consume its change stream")
+		}
+		changeStreamConfig := handler.ChangeStreamConfig{}
+		if err := envconfig.Process("", &changeStreamConfig); err != nil {
+			log.Fatalln(err)
+		}
+		changeStreamConsumer := handler.NewUsersChangeStreamConsumer(mongoStore, userEventsHandler, changeStreamConfig)
+		services = append(services, backgroundService{name: "users change stream consumer", start: changeStreamConsumer.Start, stop: changeStreamConsumer.Stop})
 	}
+	if outboxDrainer != nil {
+		services = append(services, backgroundService{name: "outbox drainer", start: outboxDrainer.Start, stop: outboxDrainer.Stop})
+	}
+	refreshJobsRunner := refreshjob.NewRunner(deps.logger, mongoStore, userEventsHandler, deps.refreshJobsConfig)
+	services = append(services, backgroundService{name: "refresh jobs runner", start: refreshJobsRunner.Start, stop: refreshJobsRunner.Stop})
 
 	router := mux.NewRouter()
 	refreshUser := handler.RefreshUser(userEventsHandler, shorelineClient)
 	router.HandleFunc("/v1/users/{userId}/marketo", refreshUser).Methods("POST")
+	if connector, ok := deps.marketoManager.(*marketo.Connector); ok {
+		getUserMarketoState := handler.GetUserMarketoState(userEventsHandler, connector, shorelineClient)
+		router.HandleFunc("/v1/users/{userId}/marketo", getUserMarketoState).Methods("GET")
+		router.HandleFunc("/v1/users/{userId}/marketing-preferences", handler.GetMarketingPreferences(connector, shorelineClient)).Methods("GET")
+		router.HandleFunc("/v1/users/{userId}/marketing-preferences", handler.UpdateMarketingPreferences(connector, shorelineClient)).Methods("PUT")
+	}
+	router.HandleFunc("/v1/users/{userId}/marketo/audit", handler.GetUserMarketoAudit(mongoStore, shorelineClient)).Methods("GET")
+	router.HandleFunc("/v1/clinics/{clinicId}/marketo", handler.RefreshClinic(userEventsHandler, shorelineClient)).Methods("POST")
+	router.HandleFunc("/v1/marketo/refresh-jobs", handler.CreateRefreshJob(mongoStore, shorelineClient)).Methods("POST")
+	router.HandleFunc("/v1/marketo/refresh-jobs/{id}", handler.GetRefreshJob(mongoStore, shorelineClient)).Methods("GET")
+	router.HandleFunc("/debug/vars", handler.GetMetrics(shorelineClient)).Methods("GET")
 
 	srv := &http.Server{
 		Addr:    serviceConfig.ListenAddress,
@@ -156,8 +319,8 @@ func main() {
 	}
 
 	wg := sync.WaitGroup{}
-	wg.Add(4)
-	shutdown := make(chan struct{}, 2)
+	wg.Add(1 + len(services))
+	shutdown := make(chan struct{}, 2+len(services))
 
 	// listen to signals to stop consumer
 	stop := make(chan os.Signal, 1)
@@ -178,39 +341,17 @@ func main() {
 		}
 	}(&wg)
 
-	go func(wg *sync.WaitGroup) {
-		defer func() { shutdown <- struct{}{} }()
-
-		err = cg.Start()
-		if err != nil {
-			log.Println(errors.Wrap(err, "Unable to start consumer"))
-		} else {
-			log.Println("Consumer stopped")
-		}
-
-	}(&wg)
-
-	go func(wg *sync.WaitGroup) {
-		defer func() { shutdown <- struct{}{} }()
-
-		err = keycloakUsersCg.Start()
-		if err != nil {
-			log.Println(errors.Wrap(err, "Unable to start consumer"))
-		} else {
-			log.Println("Consumer stopped")
-		}
-	}(&wg)
-
-	go func(wg *sync.WaitGroup) {
-		defer func() { shutdown <- struct{}{} }()
+	for _, service := range services {
+		go func(service backgroundService) {
+			defer func() { shutdown <- struct{}{} }()
 
-		err = keycloakRolesCg.Start()
-		if err != nil {
-			log.Println(errors.Wrap(err, "Unable to start consumer"))
-		} else {
-			log.Println("Consumer stopped")
-		}
-	}(&wg)
+			if err := service.start(); err != nil {
+				log.Println(errors.Wrap(err, "Unable to start "+service.name))
+			} else {
+				log.Println(service.name + " stopped")
+			}
+		}(service)
+	}
 
 	go func(shutdown chan struct{}, cancel context.CancelFunc, wg *sync.WaitGroup) {
 		defer cancel()
@@ -226,29 +367,151 @@ func main() {
 			}
 		}()
 
-		go func() {
-			defer wg.Done()
-			if err := cg.Stop(); err != nil {
-				log.Println(errors.Wrap(err, "Unable to stop user events consumer group"))
-			}
-		}()
-
-		go func() {
-			defer wg.Done()
-			if err := keycloakUsersCg.Stop(); err != nil {
-				log.Println(errors.Wrap(err, "Unable to stop keycloak users consumer group"))
-			}
-		}()
-
-		go func() {
-			defer wg.Done()
-			if err := keycloakRolesCg.Stop(); err != nil {
-				log.Println(errors.Wrap(err, "Unable to stop keycloak roles consumer group"))
-			}
-		}()
+		for _, service := range services {
+			go func(service backgroundService) {
+				defer wg.Done()
+				if err := service.stop(); err != nil {
+					log.Println(errors.Wrap(err, "Unable to stop "+service.name))
+				}
+			}(service)
+		}
 	}(shutdown, cancel, &wg)
 
 	wg.Wait()
+
+	disconnectCtx, disconnectCancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer disconnectCancel()
+	if err := mongoStore.Disconnect(disconnectCtx); err != nil {
+		log.Println(errors.Wrap(err, "Unable to disconnect from mongo"))
+	}
+}
+
+// kafkaConsumers creates the consumer groups of the user events, the keycloak and the clinic service CDC topics
+func kafkaConsumers(deps *dependencies) []backgroundService {
+	cloudEventsConfig := deps.cloudEventsConfig
+	userEventsHandler := deps.userEventsHandler
+	keycloakEventsHandler := deps.keycloakEventsHandler
+
+	createConsumer := func() (events.MessageConsumer, error) {
+		return handler.NewUserEventsConsumer(userEventsHandler)
+	}
+
+	cg, err := events.NewFaultTolerantConsumerGroup(cloudEventsConfig, createConsumer)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	keycloakUsersConfig := cdcConfig(cloudEventsConfig, keycloakUsersTopic, keycloakUsersDeadLettersTopic)
+	keycloakUsersConsumer, err := handler.NewKeycloakUserEventsConsumer(keycloakEventsHandler)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	keycloakUsersDeadLetterConsumer := deadletter.NewConsumer(keycloakUsersConsumer)
+	keycloakUsersCg, err := events.NewFaultTolerantConsumerGroup(keycloakUsersConfig, func() (events.MessageConsumer, error) {
+		return keycloakUsersDeadLetterConsumer, nil
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	keycloakRolesConfig := cdcConfig(cloudEventsConfig, keycloakRolesTopic, keycloakRolesDeadLettersTopic)
+	keycloakRolesConsumer, err := handler.NewKeycloakRoleEventsConsumer(keycloakEventsHandler)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	keycloakRolesDeadLetterConsumer := deadletter.NewConsumer(keycloakRolesConsumer)
+	keycloakRolesCg, err := events.NewFaultTolerantConsumerGroup(keycloakRolesConfig, func() (events.MessageConsumer, error) {
+		return keycloakRolesDeadLetterConsumer, nil
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	cliniciansConfig := cliniciansCdcConfig(cloudEventsConfig)
+	cliniciansConsumer, err := handler.NewClinicianEventsConsumer(userEventsHandler, deps.clinicRelationships)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	cliniciansDeadLetterConsumer := deadletter.NewConsumer(cliniciansConsumer)
+	cliniciansCg, err := events.NewFaultTolerantConsumerGroup(cliniciansConfig, func() (events.MessageConsumer, error) {
+		return cliniciansDeadLetterConsumer, nil
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	patientsConfig := patientsCdcConfig(cloudEventsConfig)
+	patientsConsumer, err := handler.NewPatientEventsConsumer(userEventsHandler, deps.clinicRelationships)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	patientsDeadLetterConsumer := deadletter.NewConsumer(patientsConsumer)
+	patientsCg, err := events.NewFaultTolerantConsumerGroup(patientsConfig, func() (events.MessageConsumer, error) {
+		return patientsDeadLetterConsumer, nil
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	services := []backgroundService{
+		{name: "user events consumer", start: cg.Start, stop: cg.Stop},
+		{name: "keycloak users consumer", start: keycloakUsersCg.Start, stop: keycloakUsersCg.Stop},
+		{name: "keycloak roles consumer", start: keycloakRolesCg.Start, stop: keycloakRolesCg.Stop},
+		{name: "clinicians consumer", start: cliniciansCg.Start, stop: cliniciansCg.Stop},
+		{name: "patients consumer", start: patientsCg.Start, stop: patientsCg.Stop},
+	}
+
+	// Companies are synced only if marketo is configured
+	if connector, ok := deps.marketoManager.(*marketo.Connector); ok {
+		clinicsConfig := clinicsCdcConfig(cloudEventsConfig)
+		clinicsConsumer, err := handler.NewClinicEventsConsumer(connector, userEventsHandler, deps.mongoStore, deps.clinicRelationships)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		clinicsDeadLetterConsumer := deadletter.NewConsumer(clinicsConsumer)
+		clinicsCg, err := events.NewFaultTolerantConsumerGroup(clinicsConfig, func() (events.MessageConsumer, error) {
+			return clinicsDeadLetterConsumer, nil
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+		services = append(services, backgroundService{name: "clinics consumer", start: clinicsCg.Start, stop: clinicsCg.Stop})
+	}
+
+	return services
+}
+
+// cdcConfig returns the config of a consumer of a CDC topic
+func cdcConfig(cloudEventsConfig *events.CloudEventsConfig, topic string, deadLettersTopic string) *events.CloudEventsConfig {
+	config := *cloudEventsConfig
+	config.KafkaTopic = topic
+	config.KafkaDeadLettersTopic = deadLettersTopic
+	// CDC topic use '.' separator instead of '-'
+	if strings.HasSuffix(config.KafkaTopicPrefix, "-") {
+		config.KafkaTopicPrefix = strings.TrimSuffix(config.KafkaTopicPrefix, "-") + "."
+	}
+	return &config
+}
+
+// cliniciansCdcConfig returns the config of the consumer of the clinicians CDC topic of the clinic service
+func cliniciansCdcConfig(cloudEventsConfig *events.CloudEventsConfig) *events.CloudEventsConfig {
+	config := cdcConfig(cloudEventsConfig, clinicCliniciansTopic, clinicCliniciansDeadLettersTopic)
+	config.KafkaConsumerGroup = config.KafkaConsumerGroup + cliniciansConsumerGroupSuffix
+	return config
+}
+
+// clinicsCdcConfig returns the config of the consumer of the clinics CDC topic of the clinic service
+func clinicsCdcConfig(cloudEventsConfig *events.CloudEventsConfig) *events.CloudEventsConfig {
+	config := cdcConfig(cloudEventsConfig, clinicClinicsTopic, clinicClinicsDeadLettersTopic)
+	config.KafkaConsumerGroup = config.KafkaConsumerGroup + clinicsConsumerGroupSuffix
+	return config
+}
+
+// patientsCdcConfig returns the config of the consumer of the patients CDC topic of the clinic service
+func patientsCdcConfig(cloudEventsConfig *events.CloudEventsConfig) *events.CloudEventsConfig {
+	config := cdcConfig(cloudEventsConfig, clinicPatientsTopic, clinicPatientsDeadLettersTopic)
+	config.KafkaConsumerGroup = config.KafkaConsumerGroup + patientsConsumerGroupSuffix
+	return config
 }
 
 func buildShoreline(config *ServiceConfig) (shoreline.Client, error) {
@@ -264,6 +527,23 @@ func buildShoreline(config *ServiceConfig) (shoreline.Client, error) {
 	return client, client.Start()
 }
 
+// buildConsent returns the resolver of the configured consent source or nil if all users have full consent
+func buildConsent(config marketo.ConsentConfig, profiles *profile.Client, shorelineClient shoreline.Client) marketo.ConsentResolver {
+	switch config.Source {
+	case marketo.ConsentSourceRole:
+		return &marketo.RoleConsent{Role: config.Role, WithoutConsent: config.WithoutConsent}
+	case marketo.ConsentSourceProfile:
+		if profiles == nil {
+			log.Fatalln("the profile consent source requires TIDEPOOL_SEAGULL_CLIENT_ADDRESS")
+		}
+		return &marketo.ProfileConsent{Profiles: profiles, WithoutConsent: config.WithoutConsent}
+	case marketo.ConsentSourceService:
+		return consent.NewClient(config.ServiceHost, &http.Client{Timeout: time.Minute}, shorelineClient, config.WithoutConsent)
+	default:
+		return nil
+	}
+}
+
 func buildClinicService(config *ServiceConfig, shorelineClient shoreline.Client) (clinic.ClientWithResponsesInterface, error) {
 	opts := clinic.WithRequestEditorFn(func(ctx context.Context, req *http.Request) error {
 		req.Header.Add("x-tidepool-session-token", shorelineClient.TokenProvide())
@@ -0,0 +1,130 @@
+package marketo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/SpeakData/minimarketo"
+
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+// AuditConfig is the env config of the audit log
+type AuditConfig struct {
+	// Retention is the time the audit entries are kept
+	Retention time.Duration `envconfig:"MARKETO_AUDIT_RETENTION" default:"2160h"`
+}
+
+type sourceKey struct{}
+
+// ContextWithSource returns a context which attributes the mutations to the source
+func ContextWithSource(ctx context.Context, source store.AuditSource) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+// SourceFromContext returns the source of the mutations or an internal source if the context doesn't have one
+func SourceFromContext(ctx context.Context) store.AuditSource {
+	if source, ok := ctx.Value(sourceKey{}).(store.AuditSource); ok {
+		return source
+	}
+	return store.AuditSource{Type: store.AuditSourceInternal}
+}
+
+// sourceForOutbox returns the source of the context which has to be kept with an outbox entry
+func sourceForOutbox(ctx context.Context) *store.AuditSource {
+	if source, ok := ctx.Value(sourceKey{}).(store.AuditSource); ok {
+		return &source
+	}
+	return nil
+}
+
+// WithAudit records every lead, company and custom object mutation in the audit log
+func WithAudit(audit store.AuditRepository, config AuditConfig) Option {
+	return func(m *Connector) {
+		m.audit = audit
+		m.auditConfig = config
+	}
+}
+
+// recordAudit appends the mutation and its result to the audit log. Failures are logged, they
+// don't fail the mutation which was already sent to marketo.
+func (m *Connector) recordAudit(ctx context.Context, tidepoolID string, leadID int, action string, previous map[string]interface{}, current map[string]interface{}, result minimarketo.RecordResult, mutationErr error) {
+	entry := &store.AuditEntry{
+		UserID:  tidepoolID,
+		LeadID:  leadID,
+		Action:  action,
+		Changes: payloadChanges(previous, current),
+	}
+	if result.ID != 0 {
+		entry.LeadID = result.ID
+	}
+	m.insertAuditEntry(ctx, entry, result, mutationErr)
+}
+
+// recordObjectAudit appends the mutation of a company or a custom object and its result to the
+// audit log. The entries of companies are keyed by the clinic id.
+func (m *Connector) recordObjectAudit(ctx context.Context, object string, id string, action string, previous map[string]interface{}, current map[string]interface{}, result minimarketo.RecordResult, mutationErr error) {
+	m.insertAuditEntry(ctx, &store.AuditEntry{
+		UserID:  id,
+		Object:  object,
+		Action:  action,
+		Changes: payloadChanges(previous, current),
+	}, result, mutationErr)
+}
+
+func (m *Connector) insertAuditEntry(ctx context.Context, entry *store.AuditEntry, result minimarketo.RecordResult, mutationErr error) {
+	if m.audit == nil {
+		return
+	}
+	now := time.Now()
+	entry.Source = SourceFromContext(ctx)
+	entry.Status = result.Status
+	entry.CreatedTime = now
+	entry.ExpiresAt = now.Add(m.auditConfig.Retention)
+	for _, reason := range result.Reasons {
+		entry.Reasons = append(entry.Reasons, reason.Code+": "+reason.Message)
+	}
+	if mutationErr != nil {
+		entry.Status = store.AuditStatusFailed
+		if errors.Is(mutationErr, ErrPolicyViolation) {
+			entry.Status = store.AuditStatusRejected
+		}
+		entry.Error = mutationErr.Error()
+	}
+	if err := m.audit.InsertAuditEntry(ctx, entry); err != nil {
+		m.logger.Printf("unable to record audit entry of %v: %v", entry.UserID, err)
+	}
+}
+
+// payloadChanges returns the fields which differ between the previous and the current payload
+func payloadChanges(previous map[string]interface{}, current map[string]interface{}) []store.AuditChange {
+	// The payloads of the sync states are decoded from bson, the values are compared in their json representation
+	previous, current = normalizePayload(previous), normalizePayload(current)
+	var changes []store.AuditChange
+	for field, value := range current {
+		if field == "id" {
+			continue
+		}
+		if old, ok := previous[field]; !ok || !reflect.DeepEqual(old, value) {
+			changes = append(changes, store.AuditChange{Field: field, Previous: old, Current: value})
+		}
+	}
+	for field, old := range previous {
+		if _, ok := current[field]; !ok && field != "id" {
+			changes = append(changes, store.AuditChange{Field: field, Previous: old})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+func normalizePayload(payload map[string]interface{}) map[string]interface{} {
+	var result map[string]interface{}
+	data, _ := json.Marshal(payload)
+	_ = json.Unmarshal(data, &result)
+	return result
+}
@@ -0,0 +1,130 @@
+package marketo_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	clinic "github.com/tidepool-org/clinic/client"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+func AuditServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.EscapedPath() == "/identity/oauth/token" {
+			w.Write([]byte(fmt.Sprintf(authResponseSuccess, token)))
+			return
+		}
+		if r.Method == "POST" {
+			w.Write([]byte(`{"requestId":"1000","result":[{"id":23,"status":"created"}],"success":true}`))
+			return
+		}
+		w.Write([]byte(`{"requestId":"1000","result":[],"success":true}`))
+	}))
+}
+
+func Test_Audit_Records_Mutations(t *testing.T) {
+	ts := AuditServer(t)
+	defer ts.Close()
+	memoryStore := store.NewMemoryStore()
+	config := marketo.AuditConfig{Retention: time.Hour}
+	manager, _ := marketo.NewManager(log.New(io.Discard, "", log.LstdFlags), NewTestConfig(t, ts), marketo.WithSyncStates(memoryStore), marketo.WithAudit(memoryStore, config))
+
+	source := store.AuditSource{Type: store.AuditSourceKafka, Topic: "marketo-service-keycloak-users", Partition: 2, Offset: 42}
+	ctx := marketo.ContextWithSource(context.Background(), source)
+	user := shoreline.UserData{Username: "user@example.com"}
+	if err := manager.RefreshListMembershipForUser(ctx, "1234", user, false, &clinic.ClinicianClinicRelationships{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	user.Username = "updated@example.com"
+	if err := manager.RefreshListMembershipForUser(context.Background(), "1234", user, false, &clinic.ClinicianClinicRelationships{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	entries, err := memoryStore.FindAuditEntries(context.Background(), store.AuditFilter{UserID: "1234"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 audit entries, got %d", len(entries))
+	}
+	created, updated := entries[1], entries[0]
+	if created.Source != source || created.LeadID != 23 || created.Status != "created" {
+		t.Errorf("Expected the creation of lead 23 to be attributed to the kafka message, got %+v", created)
+	}
+	if created.ExpiresAt.Sub(created.CreatedTime) != time.Hour {
+		t.Errorf("Expected the entry to expire after the retention, got %v", created.ExpiresAt)
+	}
+	if updated.Source.Type != store.AuditSourceInternal {
+		t.Errorf("Expected an internal source, got %+v", updated.Source)
+	}
+	if len(updated.Changes) != 1 || updated.Changes[0].Field != "email" || updated.Changes[0].Previous != "user@example.com" || updated.Changes[0].Current != "updated@example.com" {
+		t.Errorf("Expected only the email to change, got %+v", updated.Changes)
+	}
+}
+
+func Test_Audit_Records_Rejections(t *testing.T) {
+	ts := AuditServer(t)
+	defer ts.Close()
+	memoryStore := store.NewMemoryStore()
+	manager, _ := marketo.NewManager(log.New(io.Discard, "", log.LstdFlags), NewTestConfig(t, ts), marketo.WithAudit(memoryStore, marketo.AuditConfig{Retention: time.Hour}))
+
+	user := shoreline.UserData{Username: "not an email"}
+	if err := manager.RefreshListMembershipForUser(context.Background(), "1234", user, false, &clinic.ClinicianClinicRelationships{}); err == nil {
+		t.Fatalf("Expected a policy violation")
+	}
+	entries, _ := memoryStore.FindAuditEntries(context.Background(), store.AuditFilter{UserID: "1234"})
+	if len(entries) != 1 || entries[0].Status != store.AuditStatusRejected {
+		t.Fatalf("Expected a rejected audit entry, got %+v", entries)
+	}
+}
+
+func Test_Audit_Records_Company_And_Membership_Mutations(t *testing.T) {
+	ts := AuditServer(t)
+	defer ts.Close()
+	memoryStore := store.NewMemoryStore()
+	config := NewTestConfig(t, ts)
+	config.MembershipObject = "clinicMembership_c"
+	manager, _ := marketo.NewManager(log.New(io.Discard, "", log.LstdFlags), config, marketo.WithSyncStates(memoryStore), marketo.WithAudit(memoryStore, marketo.AuditConfig{Retention: time.Hour}))
+
+	clinicId := "6218b2ab3f4f1e5b2c3d4e60"
+	clinics := clinic.ClinicianClinicRelationships{{
+		Clinic:    clinic.Clinic{Id: &clinicId, Name: "Example Clinic"},
+		Clinician: clinic.Clinician{Roles: []string{"CLINIC_ADMIN"}},
+	}}
+	user := shoreline.UserData{UserID: "1234", Username: "clinician@example.com"}
+	if err := manager.RefreshListMembershipForUser(context.Background(), "1234", user, true, &clinics); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	companies, _ := memoryStore.FindAuditEntries(context.Background(), store.AuditFilter{UserID: clinicId})
+	if len(companies) != 1 || companies[0].Object != store.AuditObjectCompany || companies[0].Action != "createOrUpdate" || companies[0].Status != "created" {
+		t.Fatalf("Expected the company upsert to be recorded, got %+v", companies)
+	}
+	entries, _ := memoryStore.FindAuditEntries(context.Background(), store.AuditFilter{UserID: "1234"})
+	var memberships []*store.AuditEntry
+	for _, entry := range entries {
+		if entry.Object == store.AuditObjectMembership {
+			memberships = append(memberships, entry)
+		}
+	}
+	if len(memberships) != 1 || memberships[0].Action != "createOrUpdate" || memberships[0].Status != "created" || memberships[0].LeadID != 0 {
+		t.Fatalf("Expected the membership upsert to be recorded, got %+v", memberships)
+	}
+	found := false
+	for _, change := range memberships[0].Changes {
+		found = found || (change.Field == "clinicId" && change.Current == clinicId)
+	}
+	if !found {
+		t.Errorf("Expected the clinic id of the membership to be recorded, got %+v", memberships[0].Changes)
+	}
+}
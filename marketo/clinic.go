@@ -0,0 +1,155 @@
+package marketo
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	clinic "github.com/tidepool-org/clinic/client"
+)
+
+// Rules which select the primary clinic of a clinician who is a member of multiple clinics
+const (
+	// PrimaryClinicEarliestJoined selects the clinic the clinician joined first
+	PrimaryClinicEarliestJoined = "earliest-joined"
+	// PrimaryClinicLatestJoined selects the clinic the clinician joined last
+	PrimaryClinicLatestJoined = "latest-joined"
+	// PrimaryClinicAdminFirst selects a clinic the clinician administers, the earliest joined one if there are many
+	PrimaryClinicAdminFirst = "admin-first"
+	// PrimaryClinicLargest selects the clinic with the largest size, the earliest joined one if there are many
+	PrimaryClinicLargest = "largest"
+)
+
+// joinedDateLayout is the date format of marketo date fields
+const joinedDateLayout = "2006-01-02"
+
+// unknownJoinedTime sorts the memberships with an unknown join time last
+var unknownJoinedTime = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// ClinicAttributes are the attributes of the primary clinic of a clinician
+type ClinicAttributes struct {
+	Name       string `json:"clinicWorkspaceClinicName"`
+	Type       string `json:"clinicWorkspaceClinicType"`
+	Country    string `json:"clinicWorkspaceClinicCountry"`
+	State      string `json:"clinicWorkspaceClinicState"`
+	Tier       string `json:"clinicWorkspaceClinicTier"`
+	Size       string `json:"clinicWorkspaceClinicSize"`
+	JoinedDate string `json:"clinicWorkspaceJoinedDate"`
+}
+
+func validatePrimaryClinicRule(rule string) error {
+	switch rule {
+	case "", PrimaryClinicEarliestJoined, PrimaryClinicLatestJoined, PrimaryClinicAdminFirst, PrimaryClinicLargest:
+		return nil
+	default:
+		return fmt.Errorf("marketo: unknown primary clinic rule %s", rule)
+	}
+}
+
+// PrimaryClinic returns the clinic selected by the rule, or nil if the user isn't a member of any clinic.
+// The earliest joined clinic is selected by default.
+func PrimaryClinic(rule string, clinics *clinic.ClinicianClinicRelationships) *clinic.ClinicianClinicRelationship {
+	if clinics == nil || len(*clinics) == 0 {
+		return nil
+	}
+
+	candidates := make([]clinic.ClinicianClinicRelationship, len(*clinics))
+	copy(candidates, *clinics)
+	// Ties are broken by the join date and the clinic id, so the selection is stable across syncs
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := joinedTime(candidates[i]), joinedTime(candidates[j])
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return clinicId(candidates[i]) < clinicId(candidates[j])
+	})
+
+	switch rule {
+	case PrimaryClinicLatestJoined:
+		return &candidates[len(candidates)-1]
+	case PrimaryClinicAdminFirst:
+		for i := range candidates {
+			for _, r := range candidates[i].Clinician.Roles {
+				if r == clinicAdminRole {
+					return &candidates[i]
+				}
+			}
+		}
+	case PrimaryClinicLargest:
+		largest := 0
+		for i := range candidates {
+			if clinicSize(candidates[i]) > clinicSize(candidates[largest]) {
+				largest = i
+			}
+		}
+		return &candidates[largest]
+	}
+	return &candidates[0]
+}
+
+func (m *Connector) clinicAttributes(clinics *clinic.ClinicianClinicRelationships) ClinicAttributes {
+	primary := PrimaryClinic(m.config.PrimaryClinicRule, clinics)
+	if primary == nil {
+		return ClinicAttributes{}
+	}
+
+	attributes := ClinicAttributes{
+		Name:    primary.Clinic.Name,
+		Country: stringValue(primary.Clinic.Country),
+		State:   stringValue(primary.Clinic.State),
+		Tier:    stringValue(primary.Clinic.Tier),
+	}
+	if primary.Clinic.ClinicType != nil {
+		attributes.Type = string(*primary.Clinic.ClinicType)
+	}
+	if primary.Clinic.ClinicSize != nil {
+		attributes.Size = string(*primary.Clinic.ClinicSize)
+	}
+	if primary.Clinician.CreatedTime != nil {
+		attributes.JoinedDate = primary.Clinician.CreatedTime.UTC().Format(joinedDateLayout)
+	}
+	return attributes
+}
+
+// externalCompanyID returns the id of the company of the primary clinic
+func (m *Connector) externalCompanyID(clinics *clinic.ClinicianClinicRelationships) string {
+	primary := PrimaryClinic(m.config.PrimaryClinicRule, clinics)
+	if primary == nil {
+		return ""
+	}
+	return clinicId(*primary)
+}
+
+// joinedTime returns the time the clinician joined the clinic
+func joinedTime(relationship clinic.ClinicianClinicRelationship) time.Time {
+	if relationship.Clinician.CreatedTime == nil {
+		return unknownJoinedTime
+	}
+	return *relationship.Clinician.CreatedTime
+}
+
+func clinicId(relationship clinic.ClinicianClinicRelationship) string {
+	return stringValue(relationship.Clinic.Id)
+}
+
+// clinicSize returns the lower bound of the size range of the clinic, e.g. 250 for "250-499"
+func clinicSize(relationship clinic.ClinicianClinicRelationship) int {
+	if relationship.Clinic.ClinicSize == nil {
+		return -1
+	}
+	value := strings.TrimSuffix(strings.SplitN(string(*relationship.Clinic.ClinicSize), "-", 2)[0], "+")
+	size, err := strconv.Atoi(value)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
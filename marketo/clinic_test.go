@@ -0,0 +1,99 @@
+package marketo_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	clinic "github.com/tidepool-org/clinic/client"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+)
+
+func relationship(id string, joined time.Time, size clinic.ClinicClinicSize, roles ...string) clinic.ClinicianClinicRelationship {
+	return clinic.ClinicianClinicRelationship{
+		Clinic:    clinic.Clinic{Id: &id, Name: "Clinic " + id, ClinicSize: &size},
+		Clinician: clinic.Clinician{CreatedTime: &joined, Roles: roles},
+	}
+}
+
+func Test_PrimaryClinic(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, time.January, d, 0, 0, 0, 0, time.UTC) }
+	clinics := clinic.ClinicianClinicRelationships{
+		relationship("b", day(2), clinic.N1000, "CLINIC_MEMBER"),
+		relationship("a", day(1), clinic.N0249, "CLINIC_MEMBER"),
+		relationship("c", day(3), clinic.N250499, "CLINIC_ADMIN"),
+	}
+
+	tests := []struct {
+		name     string
+		rule     string
+		expected string
+	}{
+		{name: "default", rule: "", expected: "a"},
+		{name: "earliest joined", rule: marketo.PrimaryClinicEarliestJoined, expected: "a"},
+		{name: "latest joined", rule: marketo.PrimaryClinicLatestJoined, expected: "c"},
+		{name: "admin first", rule: marketo.PrimaryClinicAdminFirst, expected: "c"},
+		{name: "largest", rule: marketo.PrimaryClinicLargest, expected: "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := marketo.PrimaryClinic(tt.rule, &clinics)
+			if primary == nil || *primary.Clinic.Id != tt.expected {
+				t.Errorf("Expected clinic %v, got %+v", tt.expected, primary)
+			}
+		})
+	}
+
+	if primary := marketo.PrimaryClinic(marketo.PrimaryClinicEarliestJoined, &clinic.ClinicianClinicRelationships{}); primary != nil {
+		t.Errorf("Expected no primary clinic, got %+v", primary)
+	}
+}
+
+func Test_InputForUser_ClinicAttributes(t *testing.T) {
+	ts := MockServer(t)
+	defer ts.Close()
+	config := NewTestConfig(t, ts)
+	config.PrimaryClinicRule = marketo.PrimaryClinicAdminFirst
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	manager, _ := marketo.NewManager(log.New(io.Discard, "", log.LstdFlags), config)
+	connector := manager.(*marketo.Connector)
+
+	country, state, tier := "US", "CA", "tier0300"
+	clinicType := clinic.ProviderPractice
+	admin := relationship("c", time.Date(2023, time.March, 4, 22, 0, 0, 0, time.UTC), clinic.N250499, "CLINIC_ADMIN")
+	admin.Clinic.Country, admin.Clinic.State, admin.Clinic.Tier, admin.Clinic.ClinicType = &country, &state, &tier, &clinicType
+	clinics := clinic.ClinicianClinicRelationships{
+		relationship("a", time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC), clinic.N0249, "CLINIC_MEMBER"),
+		admin,
+	}
+
+	input, _ := connector.InputForUser(context.Background(), "1234", shoreline.UserData{Username: "clinician@example.com"}, false, &clinics)
+	expected := marketo.ClinicAttributes{
+		Name:       "Clinic c",
+		Type:       "provider_practice",
+		Country:    "US",
+		State:      "CA",
+		Tier:       "tier0300",
+		Size:       "250-499",
+		JoinedDate: "2023-03-04",
+	}
+	if input.ClinicAttributes != expected {
+		t.Errorf("Expected clinic attributes %+v, got %+v", expected, input.ClinicAttributes)
+	}
+
+	input, _ = connector.InputForUser(context.Background(), "1234", shoreline.UserData{Username: "patient@example.com"}, false, nil)
+	if input.ClinicAttributes != (marketo.ClinicAttributes{}) {
+		t.Errorf("Expected no clinic attributes, got %+v", input.ClinicAttributes)
+	}
+
+	config.PrimaryClinicRule = "unknown"
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected an error for an unknown primary clinic rule")
+	}
+}
@@ -0,0 +1,196 @@
+package marketo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/SpeakData/minimarketo"
+	clinic "github.com/tidepool-org/clinic/client"
+
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+const (
+	// companiesPath is used to look up companies
+	companiesPath = "/rest/v1/companies.json?"
+	// syncCompaniesPath creates or updates companies
+	syncCompaniesPath = "/rest/v1/companies/sync.json"
+)
+
+// Company is the marketo company of a clinic. The company is keyed by the clinic id.
+type Company struct {
+	ExternalCompanyID string `json:"externalCompanyId"`
+	Name              string `json:"company"`
+	Website           string `json:"website,omitempty"`
+	MainPhone         string `json:"mainPhone,omitempty"`
+	BillingStreet     string `json:"billingStreet,omitempty"`
+	BillingCity       string `json:"billingCity,omitempty"`
+	BillingState      string `json:"billingState,omitempty"`
+	BillingCountry    string `json:"billingCountry,omitempty"`
+	BillingPostalCode string `json:"billingPostalCode,omitempty"`
+}
+
+// CompanyResult is a company returned by the companies query
+type CompanyResult struct {
+	Company
+	ID int `json:"id"`
+}
+
+// SyncCompaniesData is the marketo request format of the company upserts
+type SyncCompaniesData struct {
+	Action   string    `json:"action"`
+	DedupeBy string    `json:"dedupeBy"`
+	Input    []Company `json:"input"`
+}
+
+// CompanyForClinic returns the company attributes of the clinic
+func CompanyForClinic(c clinic.Clinic) Company {
+	company := Company{
+		ExternalCompanyID: stringValue(c.Id),
+		Name:              c.Name,
+		Website:           stringValue(c.Website),
+		BillingStreet:     stringValue(c.Address),
+		BillingCity:       stringValue(c.City),
+		BillingState:      stringValue(c.State),
+		BillingCountry:    stringValue(c.Country),
+		BillingPostalCode: stringValue(c.PostalCode),
+	}
+	if c.PhoneNumbers != nil && len(*c.PhoneNumbers) > 0 {
+		company.MainPhone = (*c.PhoneNumbers)[0].Number
+	}
+	return company
+}
+
+// Hash returns a digest of the company attributes
+func (c Company) Hash() string {
+	data, _ := json.Marshal(c)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// UpsertCompany creates or updates the company of the clinic. Companies which didn't
+// change since they were last upserted by this process are not sent again.
+func (m *Connector) UpsertCompany(ctx context.Context, c clinic.Clinic) error {
+	return m.upsertCompany(ctx, CompanyForClinic(c))
+}
+
+func (m *Connector) upsertCompany(ctx context.Context, company Company) error {
+	if company.ExternalCompanyID == "" {
+		return fmt.Errorf("marketo: clinic id is missing")
+	}
+	hash := company.Hash()
+	if m.companySynced(company.ExternalCompanyID, hash) {
+		return nil
+	}
+
+	result, err := m.postCompany(company)
+	m.recordObjectAudit(ctx, store.AuditObjectCompany, company.ExternalCompanyID, "createOrUpdate", nil, payloadMap(company), result, err)
+	if err != nil {
+		return err
+	}
+	if result.Status == skippedStatus {
+		return fmt.Errorf("marketo: company of clinic %v was skipped %v", company.ExternalCompanyID, result.Reasons)
+	}
+
+	m.saveCompanyHash(company.ExternalCompanyID, hash)
+	return nil
+}
+
+// postCompany sends the upsert request of the company and returns the result. Companies which
+// violate the company policy are not sent.
+func (m *Connector) postCompany(company Company) (minimarketo.RecordResult, error) {
+	var result minimarketo.RecordResult
+	if err := m.checkPayload(CompanyPolicy, "createOrUpdate", "company of clinic", company.ExternalCompanyID, payloadMap(company)); err != nil {
+		return result, err
+	}
+	data, err := json.Marshal(SyncCompaniesData{
+		Action:   "createOrUpdate",
+		DedupeBy: "dedupeFields",
+		Input:    []Company{company},
+	})
+	if err != nil {
+		return result, err
+	}
+	companyWrites.Add(1)
+	response, err := m.client.Post(syncCompaniesPath, data)
+	if err != nil {
+		m.logger.Println(err)
+		return result, fmt.Errorf("marketo: could not get a response %v", err)
+	}
+	if !response.Success {
+		m.logger.Println(response.Errors)
+		return result, fmt.Errorf("marketo: issue with request %v", response.Errors)
+	}
+	var results []minimarketo.RecordResult
+	if err = json.Unmarshal(response.Result, &results); err != nil {
+		return result, fmt.Errorf("marketo: could not get a response %v", err)
+	}
+	if len(results) == 1 {
+		result = results[0]
+	}
+	return result, nil
+}
+
+func companyFromMap(payload map[string]interface{}) (*Company, error) {
+	var company Company
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &company)
+	return &company, err
+}
+
+// FindCompany returns the company of the clinic or nil if it doesn't exist
+func (m *Connector) FindCompany(clinicId string) (*CompanyResult, error) {
+	v := url.Values{
+		"filterType":   {"externalCompanyId"},
+		"filterValues": {clinicId},
+	}
+	response, err := m.client.Get(companiesPath + v.Encode())
+	if err != nil {
+		m.logger.Println(err)
+		return nil, err
+	}
+	if !response.Success {
+		m.logger.Println(response.Errors)
+		return nil, fmt.Errorf("marketo: issue with request %v", response.Errors)
+	}
+	var companies []CompanyResult
+	if err = json.Unmarshal(response.Result, &companies); err != nil {
+		return nil, err
+	}
+	if len(companies) != 1 {
+		return nil, nil
+	}
+	return &companies[0], nil
+}
+
+// primaryCompany returns the company of the primary clinic or nil if the clinician has no primary clinic
+func (m *Connector) primaryCompany(clinics *clinic.ClinicianClinicRelationships) *Company {
+	primary := PrimaryClinic(m.config.PrimaryClinicRule, clinics)
+	if primary == nil || primary.Clinic.Id == nil {
+		return nil
+	}
+	company := CompanyForClinic(primary.Clinic)
+	return &company
+}
+
+func (m *Connector) companySynced(clinicId string, hash string) bool {
+	m.companiesMu.Lock()
+	defer m.companiesMu.Unlock()
+	return m.companyHashes[clinicId] == hash
+}
+
+func (m *Connector) saveCompanyHash(clinicId string, hash string) {
+	m.companiesMu.Lock()
+	defer m.companiesMu.Unlock()
+	if m.companyHashes == nil {
+		m.companyHashes = make(map[string]string)
+	}
+	m.companyHashes[clinicId] = hash
+}
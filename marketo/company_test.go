@@ -0,0 +1,83 @@
+package marketo_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	clinic "github.com/tidepool-org/clinic/client"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+)
+
+func Test_UpsertCompany_Links_Lead_To_Primary_Clinic(t *testing.T) {
+	syncCompanyResponse := `{
+		"requestId":"1000",
+		"result":[{"seq":0,"id":12,"status":"created"}],
+		"success":true
+	}`
+	emptyResponse := `{
+		"requestId":"1000",
+		"result":[],
+		"success":true
+	}`
+	var mu sync.Mutex
+	var companies []marketo.SyncCompaniesData
+	var leads []marketo.CreateData
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Type", "application/json")
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case r.URL.EscapedPath() == "/identity/oauth/token":
+			w.Write([]byte(fmt.Sprintf(authResponseSuccess, token)))
+		case r.URL.EscapedPath() == "/rest/v1/companies/sync.json":
+			data := marketo.SyncCompaniesData{}
+			_ = json.Unmarshal(body, &data)
+			companies = append(companies, data)
+			w.Write([]byte(syncCompanyResponse))
+		case r.Method == "GET":
+			w.Write([]byte(emptyResponse))
+		default:
+			data := marketo.CreateData{}
+			_ = json.Unmarshal(body, &data)
+			leads = append(leads, data)
+			w.Write([]byte(createLeadResponseSuccess))
+		}
+	}))
+	defer ts.Close()
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	manager, _ := marketo.NewManager(logger, NewTestConfig(t, ts))
+
+	clinicId, website := "6218b2ab3f4f1e5b2c3d4e60", "https://example.com"
+	clinics := clinic.ClinicianClinicRelationships{{
+		Clinic:    clinic.Clinic{Id: &clinicId, Name: "Example Clinic", Website: &website, PhoneNumbers: &[]clinic.PhoneNumber{{Number: "555-0100"}}},
+		Clinician: clinic.Clinician{Roles: []string{"CLINIC_ADMIN"}},
+	}}
+	user := shoreline.UserData{UserID: "1234", Username: "clinician@example.com"}
+	for i := 0; i < 2; i++ {
+		if err := manager.RefreshListMembershipForUser(context.Background(), "1234", user, true, &clinics); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if len(companies) != 1 {
+		t.Fatalf("Expected the unchanged company to be upserted once, got %v", companies)
+	}
+	expected := marketo.Company{ExternalCompanyID: clinicId, Name: "Example Clinic", Website: website, MainPhone: "555-0100"}
+	if companies[0].Action != "createOrUpdate" || companies[0].DedupeBy != "dedupeFields" || len(companies[0].Input) != 1 || companies[0].Input[0] != expected {
+		t.Errorf("Expected company %+v, got %+v", expected, companies[0])
+	}
+	if len(leads) != 2 || leads[0].Input[0].ExternalCompanyID != clinicId {
+		t.Errorf("Expected the lead to be linked to company %v, got %+v", clinicId, leads)
+	}
+}
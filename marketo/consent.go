@@ -0,0 +1,221 @@
+package marketo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/SpeakData/minimarketo"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+// deleteLeadsPath is the path of the marketo API which deletes leads
+const deleteLeadsPath = "/rest/v1/leads/delete.json"
+
+// deleteAction is the action of lead deletions in the audit log
+const deleteAction = "delete"
+
+// ConsentLevel decides which lead is synced for a user
+type ConsentLevel string
+
+const (
+	// ConsentFull syncs a lead which receives marketing emails
+	ConsentFull ConsentLevel = "full"
+	// ConsentTransactional syncs an unsubscribed lead which only receives transactional emails
+	ConsentTransactional ConsentLevel = "transactional"
+	// ConsentNone doesn't sync a lead, the existing lead of the user is removed
+	ConsentNone ConsentLevel = "none"
+)
+
+// Sources of the marketing consent of users
+const (
+	// ConsentSourceRole grants consent to users with the consent role in shoreline
+	ConsentSourceRole = "role"
+	// ConsentSourceProfile reads the consent from the profile of users
+	ConsentSourceProfile = "profile"
+	// ConsentSourceService reads the consent level from the consent service
+	ConsentSourceService = "service"
+)
+
+// ConsentConfig is the env config of the marketing consent. All users have full consent if the source is empty.
+type ConsentConfig struct {
+	Source string `envconfig:"MARKETO_CONSENT_SOURCE"`
+	// Role is the shoreline role of the users who opted into marketing, used by the role source
+	Role string `envconfig:"MARKETO_CONSENT_ROLE" default:"marketing_consent"`
+	// WithoutConsent is the consent level of users who didn't opt into marketing or withdrew their consent
+	WithoutConsent ConsentLevel `envconfig:"MARKETO_CONSENT_WITHOUT_OPT_IN" default:"transactional"`
+	// ServiceHost is the address of the consent service, used by the service source
+	ServiceHost string `envconfig:"MARKETO_CONSENT_SERVICE_ADDRESS"`
+}
+
+// Validate returns an error if the source or the consent level are unknown
+func (c ConsentConfig) Validate() error {
+	switch c.Source {
+	case "", ConsentSourceRole, ConsentSourceProfile, ConsentSourceService:
+	default:
+		return fmt.Errorf("marketo: unknown consent source %s", c.Source)
+	}
+	if c.Source == ConsentSourceService && c.ServiceHost == "" {
+		return fmt.Errorf("marketo: consent service address is missing")
+	}
+	return validateConsentLevel(c.WithoutConsent)
+}
+
+func validateConsentLevel(level ConsentLevel) error {
+	switch level {
+	case ConsentFull, ConsentTransactional, ConsentNone:
+		return nil
+	default:
+		return fmt.Errorf("marketo: unknown consent level %s", level)
+	}
+}
+
+// ConsentResolver returns the marketing consent level of a user
+type ConsentResolver interface {
+	MarketingConsent(ctx context.Context, tidepoolID string, user shoreline.UserData) (ConsentLevel, error)
+}
+
+// WithConsent syncs the leads of users according to their marketing consent
+func WithConsent(consent ConsentResolver) Option {
+	return func(m *Connector) {
+		m.consent = consent
+	}
+}
+
+// RoleConsent grants full consent to the users with the role
+type RoleConsent struct {
+	Role           string
+	WithoutConsent ConsentLevel
+}
+
+func (r *RoleConsent) MarketingConsent(ctx context.Context, tidepoolID string, user shoreline.UserData) (ConsentLevel, error) {
+	if user.HasRole(r.Role) {
+		return ConsentFull, nil
+	}
+	return r.WithoutConsent, nil
+}
+
+// ProfileConsent grants full consent to the users who opted into marketing in their profile
+type ProfileConsent struct {
+	Profiles       ProfileResolver
+	WithoutConsent ConsentLevel
+}
+
+func (p *ProfileConsent) MarketingConsent(ctx context.Context, tidepoolID string, user shoreline.UserData) (ConsentLevel, error) {
+	userProfile, err := p.Profiles.GetProfile(ctx, tidepoolID)
+	if err != nil {
+		return "", err
+	}
+	if userProfile != nil && userProfile.MarketingConsent != nil && *userProfile.MarketingConsent {
+		return ConsentFull, nil
+	}
+	return p.WithoutConsent, nil
+}
+
+// consentLevel returns the consent level of the user, users have full consent if the connector has no resolver
+func (m *Connector) consentLevel(ctx context.Context, tidepoolID string, user shoreline.UserData) (ConsentLevel, error) {
+	if m.consent == nil {
+		return ConsentFull, nil
+	}
+	level, err := m.consent.MarketingConsent(ctx, tidepoolID, user)
+	if err != nil {
+		return "", fmt.Errorf("marketo: could not resolve the marketing consent of user %v: %w", tidepoolID, err)
+	}
+	if err := validateConsentLevel(level); err != nil {
+		return "", err
+	}
+	return level, nil
+}
+
+// removeLead persists the removal in the outbox or deletes the lead of the user directly
+func (m *Connector) removeLead(ctx context.Context, tidepoolID string, listEmail string) error {
+	if m.outbox != nil {
+		entry := &store.OutboxEntry{
+			UserID:     tidepoolID,
+			ListEmail:  listEmail,
+			RemoveLead: true,
+			Source:     sourceForOutbox(ctx),
+		}
+		if err := m.outbox.EnqueueOutboxEntry(ctx, entry); err != nil {
+			return fmt.Errorf("marketo: could not enqueue removal of user %v: %w", tidepoolID, err)
+		}
+		return nil
+	}
+	return m.deliverRemoval(ctx, tidepoolID)
+}
+
+// deliverRemoval deletes the lead of the user in marketo if the user has a lead
+func (m *Connector) deliverRemoval(ctx context.Context, tidepoolID string) error {
+	leadID := 0
+	state := m.findSyncState(ctx, tidepoolID)
+	if state != nil && state.Status == store.SyncStatusRemoved {
+		return nil
+	}
+	if state != nil {
+		leadID = state.LeadID
+	}
+	if leadID <= 0 {
+		id, exists, err := m.FindLeadByUserId(tidepoolID)
+		if err != nil {
+			return fmt.Errorf("marketo: could not find a lead %v", err)
+		}
+		if !exists {
+			m.saveRemovedStatus(ctx, tidepoolID)
+			return nil
+		}
+		leadID = id
+	}
+
+	var previous map[string]interface{}
+	if state != nil {
+		previous = state.Payload
+	}
+	result, err := m.deleteLead(leadID)
+	m.recordAudit(ctx, tidepoolID, leadID, deleteAction, previous, nil, result, err)
+	if err != nil {
+		m.saveSyncFailure(ctx, tidepoolID, err)
+		return err
+	}
+	m.logger.Printf("removed lead %v of user %v without marketing consent", leadID, tidepoolID)
+	m.saveRemovedStatus(ctx, tidepoolID)
+	return nil
+}
+
+// saveRemovedStatus records that the user has no lead, the state is created if the user was never synced
+func (m *Connector) saveRemovedStatus(ctx context.Context, tidepoolID string) {
+	if m.syncStates == nil {
+		return
+	}
+	if err := m.syncStates.UpdateSyncStatus(ctx, tidepoolID, store.SyncStatusRemoved, ""); err != nil {
+		m.logger.Printf("unable to save sync status of user %v: %v", tidepoolID, err)
+	}
+}
+
+// deleteLead deletes the lead and returns the result of the lead
+func (m *Connector) deleteLead(leadID int) (minimarketo.RecordResult, error) {
+	var result minimarketo.RecordResult
+	body := map[string]interface{}{
+		"input": []map[string]int{{"id": leadID}},
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return result, err
+	}
+	leadRemovals.Add(1)
+	response, err := m.client.Post(deleteLeadsPath, data)
+	if err != nil {
+		m.logger.Println(err)
+		return result, fmt.Errorf("marketo: could not get a response %v", err)
+	}
+	if !response.Success {
+		m.logger.Println(response.Errors)
+		return result, fmt.Errorf("marketo: issue with request %v", response.Errors)
+	}
+	var results []minimarketo.RecordResult
+	if err = json.Unmarshal(response.Result, &results); err == nil && len(results) == 1 {
+		result = results[0]
+	}
+	return result, nil
+}
@@ -0,0 +1,166 @@
+package marketo_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	clinic "github.com/tidepool-org/clinic/client"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+func Test_ConsentConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        marketo.ConsentConfig
+		expectedError bool
+	}{
+		{name: "disabled", config: marketo.ConsentConfig{WithoutConsent: marketo.ConsentTransactional}},
+		{name: "role", config: marketo.ConsentConfig{Source: marketo.ConsentSourceRole, WithoutConsent: marketo.ConsentNone}},
+		{name: "unknown source", config: marketo.ConsentConfig{Source: "shoreline", WithoutConsent: marketo.ConsentNone}, expectedError: true},
+		{name: "unknown level", config: marketo.ConsentConfig{Source: marketo.ConsentSourceRole, WithoutConsent: "partial"}, expectedError: true},
+		{name: "service without address", config: marketo.ConsentConfig{Source: marketo.ConsentSourceService, WithoutConsent: marketo.ConsentNone}, expectedError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.expectedError {
+				t.Errorf("Expected error %v, got %v", tt.expectedError, err)
+			}
+		})
+	}
+}
+
+func Test_UpsertListMembership_Consent(t *testing.T) {
+	tests := []struct {
+		name                 string
+		roles                []string
+		withoutConsent       marketo.ConsentLevel
+		expectedRemoval      bool
+		expectedUnsubscribed bool
+	}{
+		{name: "consent", roles: []string{"marketing_consent"}, withoutConsent: marketo.ConsentNone},
+		{name: "transactional only", withoutConsent: marketo.ConsentTransactional, expectedUnsubscribed: true},
+		{name: "no consent", withoutConsent: marketo.ConsentNone, expectedRemoval: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := MockServer(t)
+			defer ts.Close()
+			outbox := &OutboxRepositoryMock{}
+			consent := &marketo.RoleConsent{Role: "marketing_consent", WithoutConsent: tt.withoutConsent}
+			manager, _ := marketo.NewManager(log.New(io.Discard, "", log.LstdFlags), NewTestConfig(t, ts), marketo.WithOutbox(outbox), marketo.WithConsent(consent))
+
+			user := shoreline.UserData{Username: "user@example.com", Roles: tt.roles}
+			if err := manager.RefreshListMembershipForUser(context.Background(), "1234", user, false, &clinic.ClinicianClinicRelationships{}); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(outbox.Entries) != 1 {
+				t.Fatalf("Expected a single outbox entry, got %v", len(outbox.Entries))
+			}
+			entry := outbox.Entries[0]
+			if entry.RemoveLead != tt.expectedRemoval {
+				t.Errorf("Expected removal %v, got %v", tt.expectedRemoval, entry.RemoveLead)
+			}
+			if !tt.expectedRemoval && entry.Payload["unsubscribed"] != tt.expectedUnsubscribed {
+				t.Errorf("Expected unsubscribed %v, got %v", tt.expectedUnsubscribed, entry.Payload["unsubscribed"])
+			}
+		})
+	}
+}
+
+func Test_OutboxDrainer_Removes_Lead(t *testing.T) {
+	deletes := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.EscapedPath() == "/identity/oauth/token" {
+			w.Write([]byte(fmt.Sprintf(authResponseSuccess, token)))
+			return
+		}
+		if r.URL.EscapedPath() == "/rest/v1/leads/delete.json" {
+			deletes++
+		}
+		w.Write([]byte(`{"requestId":"1000","result":[{"id":23,"status":"deleted"}],"success":true}`))
+	}))
+	defer ts.Close()
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	outbox := &OutboxRepositoryMock{}
+	syncStates := &SyncStateRepositoryMock{States: map[string]*store.SyncState{
+		"1234": {UserID: "1234", Email: "user@example.com", LeadID: 23, Status: store.SyncStatusSynced},
+	}}
+	consent := &marketo.RoleConsent{Role: "marketing_consent", WithoutConsent: marketo.ConsentNone}
+	manager, _ := marketo.NewManager(logger, NewTestConfig(t, ts), marketo.WithOutbox(outbox), marketo.WithSyncStates(syncStates), marketo.WithConsent(consent))
+
+	user := shoreline.UserData{Username: "user@example.com"}
+	for i := 0; i < 2; i++ {
+		if err := manager.RefreshListMembershipForUser(context.Background(), "1234", user, false, nil); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	drainer := marketo.NewOutboxDrainer(logger, manager.(*marketo.Connector), outbox, marketo.OutboxConfig{MaxAttempts: 2, BatchSize: 10})
+	if _, err := drainer.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if deletes != 1 {
+		t.Errorf("Expected the lead to be deleted once, got %v requests", deletes)
+	}
+	if status := syncStates.States["1234"].Status; status != store.SyncStatusRemoved {
+		t.Errorf("Expected status removed, got %v", status)
+	}
+}
+
+func Test_Delete_After_Consent_Withdrawn(t *testing.T) {
+	var writes, deletes int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.EscapedPath() == "/identity/oauth/token":
+			w.Write([]byte(fmt.Sprintf(authResponseSuccess, token)))
+		case r.URL.EscapedPath() == "/rest/v1/leads/delete.json":
+			deletes++
+			w.Write([]byte(`{"requestId":"1000","result":[{"id":23,"status":"deleted"}],"success":true}`))
+		case r.Method == "POST":
+			writes++
+			w.Write([]byte(`{"requestId":"1000","result":[{"id":42,"status":"created"}],"success":true}`))
+		default:
+			w.Write([]byte(`{"requestId":"1000","result":[],"success":true}`))
+		}
+	}))
+	defer ts.Close()
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	syncStates := store.NewMemoryStore()
+	_ = syncStates.UpsertSyncState(context.Background(), &store.SyncState{UserID: "1234", Email: "user@example.com", LeadID: 23, Status: store.SyncStatusSynced})
+	consent := &marketo.RoleConsent{Role: "marketing_consent", WithoutConsent: marketo.ConsentNone}
+	manager, _ := marketo.NewManager(logger, NewTestConfig(t, ts), marketo.WithSyncStates(syncStates), marketo.WithConsent(consent))
+
+	// The consent of user 1234 was withdrawn, user 5678 never had a lead
+	for _, id := range []string{"1234", "5678"} {
+		user := shoreline.UserData{UserID: id, Username: id + "@example.com"}
+		if err := manager.RefreshListMembershipForUser(context.Background(), id, user, false, nil); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if state, _ := syncStates.FindSyncState(context.Background(), id); state == nil || state.Status != store.SyncStatusRemoved {
+			t.Errorf("Expected the removal of user %v to be recorded, got %+v", id, state)
+		}
+	}
+	// The deletion events still carry the consent role of the users
+	for _, id := range []string{"1234", "5678", "9012"} {
+		user := shoreline.UserData{UserID: id, Username: id + "@example.com", Roles: []string{"marketing_consent"}}
+		if err := manager.UpdateListMembershipForUser(context.Background(), id, user, user, true, nil); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if deletes != 1 {
+		t.Errorf("Expected the lead of user 1234 to be deleted once, got %d requests", deletes)
+	}
+	if writes != 0 {
+		t.Errorf("Expected no leads to be written for deleted users, got %d requests", writes)
+	}
+}
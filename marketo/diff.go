@@ -0,0 +1,51 @@
+package marketo
+
+import "strings"
+
+// FieldDiff is a lead attribute which differs from the attribute computed for the user
+type FieldDiff struct {
+	Field    string      `json:"field"`
+	Expected interface{} `json:"expected"`
+	Actual   interface{} `json:"actual"`
+}
+
+// DiffLead compares the computed attributes with the attributes of the lead. All attributes
+// are reported if the lead doesn't exist. Emails and types are compared ignoring case.
+func DiffLead(input Input, lead *LeadResult) []FieldDiff {
+	diff := make([]FieldDiff, 0)
+	compare := func(field string, expected interface{}, actual func(*LeadResult) interface{}) {
+		if lead == nil {
+			diff = append(diff, FieldDiff{Field: field, Expected: expected})
+			return
+		}
+		value := actual(lead)
+		if e, ok := expected.(string); ok {
+			if a, ok := value.(string); ok && strings.EqualFold(e, a) {
+				return
+			}
+		} else if expected == value {
+			return
+		}
+		diff = append(diff, FieldDiff{Field: field, Expected: expected, Actual: value})
+	}
+
+	compare("tidepoolID", input.TidepoolID, func(l *LeadResult) interface{} { return l.TidepoolID })
+	compare("email", input.Email, func(l *LeadResult) interface{} { return l.Email })
+	compare("userType", input.UserType, func(l *LeadResult) interface{} { return l.UserType })
+	compare("unsubscribed", input.Unsubscribed, func(l *LeadResult) interface{} { return l.Unsubscribed })
+	compare("deletedAccount", input.DeletedAccount, func(l *LeadResult) interface{} { return l.DeletedAccount })
+	compare("clinicWorkspaceMemberofMultipleClinics", input.IsMemberOfMultipleClinics, func(l *LeadResult) interface{} { return l.IsMemberOfMultipleClinics })
+	compare("clinicWorkspacePrescriber", input.IsPrescriber, func(l *LeadResult) interface{} { return l.IsPrescriber })
+	compare("externalCompanyId", input.ExternalCompanyID, func(l *LeadResult) interface{} { return l.ExternalCompanyID })
+	compare("clinicWorkspaceClinicName", input.Name, func(l *LeadResult) interface{} { return l.Name })
+	compare("clinicWorkspaceClinicType", input.Type, func(l *LeadResult) interface{} { return l.Type })
+	compare("clinicWorkspaceClinicCountry", input.ClinicAttributes.Country, func(l *LeadResult) interface{} { return l.Country })
+	compare("clinicWorkspaceClinicState", input.State, func(l *LeadResult) interface{} { return l.State })
+	compare("clinicWorkspaceClinicTier", input.Tier, func(l *LeadResult) interface{} { return l.Tier })
+	compare("clinicWorkspaceClinicSize", input.Size, func(l *LeadResult) interface{} { return l.Size })
+	compare("clinicWorkspaceJoinedDate", input.JoinedDate, func(l *LeadResult) interface{} { return l.JoinedDate })
+	compare("patientConnectedToClinic", input.ConnectedToClinic, func(l *LeadResult) interface{} { return l.ConnectedToClinic })
+	compare("patientClinicCount", input.ClinicCount, func(l *LeadResult) interface{} { return l.ClinicCount })
+	compare("patientFirstClinicConnectionDate", input.FirstConnectionDate, func(l *LeadResult) interface{} { return l.FirstConnectionDate })
+	return diff
+}
@@ -0,0 +1,26 @@
+package marketo_test
+
+import (
+	"testing"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+)
+
+func Test_DiffLead(t *testing.T) {
+	input := marketo.Input{TidepoolID: "1234", Email: "tester@example.com", UserType: "clinic_admin", IsPrescriber: true}
+
+	diff := marketo.DiffLead(input, &marketo.LeadResult{ID: 23, TidepoolID: "1234", Email: "Tester@Example.com", UserType: "patient"})
+	if len(diff) != 2 {
+		t.Fatalf("Expected 2 different fields, got %v", diff)
+	}
+	if diff[0].Field != "userType" || diff[0].Expected != "clinic_admin" || diff[0].Actual != "patient" {
+		t.Errorf("Expected userType to differ, got %+v", diff[0])
+	}
+	if diff[1].Field != "clinicWorkspacePrescriber" || diff[1].Expected != true || diff[1].Actual != false {
+		t.Errorf("Expected clinicWorkspacePrescriber to differ, got %+v", diff[1])
+	}
+
+	if diff := marketo.DiffLead(input, nil); len(diff) != 18 {
+		t.Errorf("Expected all fields to differ for a missing lead, got %v", diff)
+	}
+}
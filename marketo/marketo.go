@@ -1,6 +1,9 @@
 package marketo
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,14 +11,28 @@ import (
 	"log"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/tidepool-org/go-common/clients/shoreline"
+	"github.com/tidepool-org/marketo-service/store"
 
 	"github.com/SpeakData/minimarketo"
 )
 
 const path = "/rest/v1/leads.json?"
 
+// leadFields are the fields returned when the synced attributes of leads are requested
+const leadFields = "id,email,tidepoolID,userType,unsubscribed,deletedAccount,clinicWorkspaceMemberofMultipleClinics,clinicWorkspacePrescriber," +
+	"externalCompanyId,clinicWorkspaceClinicName,clinicWorkspaceClinicType,clinicWorkspaceClinicCountry,clinicWorkspaceClinicState,clinicWorkspaceClinicTier,clinicWorkspaceClinicSize,clinicWorkspaceJoinedDate," +
+	"patientConnectedToClinic,patientClinicCount,patientFirstClinicConnectionDate,createdAt,updatedAt"
+
+// MaxFilterValues is the max number of values marketo accepts in a single lead lookup
+const MaxFilterValues = 300
+
+// skippedStatus is returned by marketo for records which were not created or updated
+const skippedStatus = "skipped"
+
 const (
 	clinicianRole    = "clinician"
 	clinicAdminRole  = "CLINIC_ADMIN"
@@ -25,8 +42,9 @@ const (
 
 // Manager interface for managing leads
 type Manager interface {
-	CreateListMembershipForUser(tidepoolID string, newUser shoreline.UserData, clinics *clinic.ClinicianClinicRelationships)
-	UpdateListMembershipForUser(tidepoolID string, oldUser shoreline.UserData, newUser shoreline.UserData, delete bool, clinics *clinic.ClinicianClinicRelationships)
+	CreateListMembershipForUser(ctx context.Context, tidepoolID string, newUser shoreline.UserData, clinics *clinic.ClinicianClinicRelationships) error
+	UpdateListMembershipForUser(ctx context.Context, tidepoolID string, oldUser shoreline.UserData, newUser shoreline.UserData, delete bool, clinics *clinic.ClinicianClinicRelationships) error
+	RefreshListMembershipForUser(ctx context.Context, tidepoolID string, user shoreline.UserData, force bool, clinics *clinic.ClinicianClinicRelationships) error
 	IsAvailable() bool
 }
 
@@ -40,6 +58,15 @@ type LeadResult struct {
 	UserType   string `json:"userType"`
 	Created    string `json:"createdAt"`
 	Updated    string `json:"updatedAt"`
+
+	Unsubscribed              bool   `json:"unsubscribed"`
+	DeletedAccount            bool   `json:"deletedAccount"`
+	IsMemberOfMultipleClinics bool   `json:"clinicWorkspaceMemberofMultipleClinics"`
+	IsPrescriber              bool   `json:"clinicWorkspacePrescriber"`
+	ExternalCompanyID         string `json:"externalCompanyId"`
+
+	ClinicAttributes
+	PatientAttributes
 }
 
 // RecordResult Create/update lead uses this format
@@ -62,6 +89,43 @@ type Input struct {
 	DeletedAccount            bool   `json:"deletedAccount"`
 	IsMemberOfMultipleClinics bool   `json:"clinicWorkspaceMemberofMultipleClinics"`
 	IsPrescriber              bool   `json:"clinicWorkspacePrescriber"`
+	// ExternalCompanyID links the lead to the company of the primary clinic. Leads are not
+	// unlinked when the clinician leaves all clinics.
+	ExternalCompanyID string `json:"externalCompanyId,omitempty"`
+	// Consent is the resolved marketing consent level of the user, it is not sent to marketo
+	Consent ConsentLevel `json:"-"`
+
+	// ClinicAttributes describe the primary clinic of clinicians
+	ClinicAttributes
+	// PatientAttributes describe the clinics the user is a patient of
+	PatientAttributes
+	// ProfileAttributes are the allowlisted fields of the profile of the user
+	ProfileAttributes
+}
+
+// Hash returns a digest of the lead attributes which doesn't depend on the marketo lead id
+func (i Input) Hash() string {
+	i.ID = 0
+	data, _ := json.Marshal(i)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (i Input) toMap() map[string]interface{} {
+	var result map[string]interface{}
+	data, _ := json.Marshal(i)
+	_ = json.Unmarshal(data, &result)
+	return result
+}
+
+func inputFromMap(payload map[string]interface{}) (Input, error) {
+	var input Input
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return input, err
+	}
+	err = json.Unmarshal(data, &input)
+	return input, err
 }
 
 // CreateData is the full marketo request format
@@ -73,9 +137,39 @@ type CreateData struct {
 
 // Connector manages the connection to the client
 type Connector struct {
-	logger *log.Logger
-	client minimarketo.Client
-	config Config
+	logger         *log.Logger
+	client         minimarketo.Client
+	config         Config
+	syncStates     store.SyncStateRepository
+	outbox         store.OutboxRepository
+	patientClinics PatientClinicsResolver
+	profiles       ProfileResolver
+	consent        ConsentResolver
+	audit          store.AuditRepository
+	auditConfig    AuditConfig
+
+	// companyHashes are the hashes of the companies which were upserted by this process
+	companiesMu   sync.Mutex
+	companyHashes map[string]string
+}
+
+// Option configures optional dependencies of the connector
+type Option func(*Connector)
+
+// WithSyncStates persists the identity of each synced user, so updates can find the
+// lead by the last synced email, even if the previous email is not known to the caller
+func WithSyncStates(syncStates store.SyncStateRepository) Option {
+	return func(m *Connector) {
+		m.syncStates = syncStates
+	}
+}
+
+// WithOutbox persists the mutations in the outbox instead of sending them to marketo directly.
+// The mutations are delivered asynchronously by the OutboxDrainer.
+func WithOutbox(outbox store.OutboxRepository) Option {
+	return func(m *Connector) {
+		m.outbox = outbox
+	}
 }
 
 // Config is the env config
@@ -89,6 +183,13 @@ type Config struct {
 	ClinicRole  string
 	PatientRole string
 	Timeout     uint
+	// PrimaryClinicRule selects the clinic described by the clinic attributes of clinicians
+	PrimaryClinicRule string
+	// MembershipObject is the API name of the custom object of the clinician memberships.
+	// Memberships are not synced if it's empty.
+	MembershipObject string
+	// ProfileFields are the profile fields which are synced to marketo, see ProfileFieldFirstName etc.
+	ProfileFields []string
 }
 
 // Validate used to validate in marketo_test.go
@@ -114,6 +215,12 @@ func (c *Config) Validate() error {
 	if c.Timeout == 0 {
 		return errors.New("marketo: timeout error")
 	}
+	if err := validatePrimaryClinicRule(c.PrimaryClinicRule); err != nil {
+		return err
+	}
+	if err := validateProfileFields(c.ProfileFields); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -146,11 +253,14 @@ func (m *Connector) repairManager() {
 }
 
 // NewManager creates a new manager based off of input arguments
-func NewManager(logger *log.Logger, config Config) (Manager, error) {
+func NewManager(logger *log.Logger, config Config, opts ...Option) (Manager, error) {
 	connector := Connector{
 		logger: logger,
 		config: config,
 	}
+	for _, opt := range opts {
+		opt(&connector)
+	}
 	if err := config.Validate(); err != nil {
 		return &connector, fmt.Errorf("marketo: config is not valid; %s", err)
 	}
@@ -170,19 +280,41 @@ func NewManager(logger *log.Logger, config Config) (Manager, error) {
 }
 
 // CreateListMembershipForUser is an asynchronous function that creates a user
-func (m *Connector) CreateListMembershipForUser(tidepoolID string, newUser shoreline.UserData, clinics *clinic.ClinicianClinicRelationships) {
+func (m *Connector) CreateListMembershipForUser(ctx context.Context, tidepoolID string, newUser shoreline.UserData, clinics *clinic.ClinicianClinicRelationships) error {
 	m.logger.Printf("CreateListMembershipForUser %v", newUser)
-	m.UpsertListMembership(tidepoolID, newUser, newUser, false, clinics)
+	return m.UpsertListMembership(ctx, tidepoolID, newUser, newUser, false, false, clinics)
 }
 
 // UpdateListMembershipForUser is an asynchronous function that updates a user
-func (m *Connector) UpdateListMembershipForUser(tidepoolID string, oldUser shoreline.UserData, newUser shoreline.UserData, delete bool, clinics *clinic.ClinicianClinicRelationships) {
+func (m *Connector) UpdateListMembershipForUser(ctx context.Context, tidepoolID string, oldUser shoreline.UserData, newUser shoreline.UserData, delete bool, clinics *clinic.ClinicianClinicRelationships) error {
 	m.logger.Printf("UpdateListMembershipForUser %v", newUser)
-	m.UpsertListMembership(tidepoolID, oldUser, newUser, delete, clinics)
+	return m.UpsertListMembership(ctx, tidepoolID, oldUser, newUser, delete, false, clinics)
 }
 
-// UpsertListMembership creates or updates a user depending on if the user already exists or not
-func (m *Connector) UpsertListMembership(tidepoolID string, oldUser shoreline.UserData, newUser shoreline.UserData, delete bool, clinics *clinic.ClinicianClinicRelationships) error {
+// RefreshListMembershipForUser updates a user with the current state. If force is set the user is
+// sent to marketo even if nothing has changed since the last sync.
+func (m *Connector) RefreshListMembershipForUser(ctx context.Context, tidepoolID string, user shoreline.UserData, force bool, clinics *clinic.ClinicianClinicRelationships) error {
+	m.logger.Printf("RefreshListMembershipForUser %v", user)
+	return m.UpsertListMembership(ctx, tidepoolID, user, user, false, force, clinics)
+}
+
+// UpsertListMembership creates or updates a user depending on if the user already exists or not.
+// The marketing consent of the user decides whether a full or an unsubscribed lead is synced, the
+// lead of users without any consent is removed. If the connector has an outbox, the mutation is
+// persisted and delivered asynchronously.
+func (m *Connector) UpsertListMembership(ctx context.Context, tidepoolID string, oldUser shoreline.UserData, newUser shoreline.UserData, delete bool, force bool, clinics *clinic.ClinicianClinicRelationships) error {
+	if delete {
+		state := m.findSyncState(ctx, tidepoolID)
+		// Users who were never synced or whose lead was removed have no lead to mark as deleted
+		if m.syncStates != nil && (state == nil || state.Status == store.SyncStatusRemoved) {
+			m.logger.Printf("no lead to delete for user %v", tidepoolID)
+			return nil
+		}
+		// Deletions without the user data, e.g. from a change stream without pre-images, use the last synced email
+		if newUser.Username == "" && state != nil {
+			newUser.Username = state.Email
+		}
+	}
 	newEmail := strings.ToLower(newUser.Username)
 	oldEmail := strings.ToLower(oldUser.Username)
 	if newEmail == "" {
@@ -202,35 +334,199 @@ func (m *Connector) UpsertListMembership(tidepoolID string, oldUser shoreline.Us
 		listEmail = newEmail
 	}
 
+	// The lead of deleted users without consent is removed rather than marked as deleted
+	level, err := m.consentLevel(ctx, tidepoolID, newUser)
+	if err != nil {
+		return err
+	}
+	if level == ConsentNone {
+		return m.removeLead(ctx, tidepoolID, listEmail)
+	}
+
+	input, err := m.inputForUser(ctx, tidepoolID, newUser, delete, clinics, level)
+	if err != nil {
+		return err
+	}
+	var company *Company
+	if input.ExternalCompanyID != "" {
+		company = m.primaryCompany(clinics)
+	}
+	memberships := m.membershipsForSync(ctx, tidepoolID, input, clinics)
+	if m.outbox != nil {
+		return m.enqueue(ctx, tidepoolID, listEmail, input, company, memberships, force)
+	}
+	if err := m.deliver(ctx, tidepoolID, listEmail, input, company, memberships, force); err != nil {
+		m.logger.Printf(`ERROR: marketo failure upserting member "%s" to "%s"; %s`, tidepoolID, newEmail, err)
+		return err
+	}
+	return nil
+}
+
+// InputForUser returns the lead attributes of the user as they are sent to marketo. The clinics
+// the user is a patient of, the profile and the marketing consent are resolved if the connector
+// is configured with resolvers.
+func (m *Connector) InputForUser(ctx context.Context, tidepoolID string, user shoreline.UserData, delete bool, clinics *clinic.ClinicianClinicRelationships) (Input, error) {
+	level := ConsentFull
+	if !delete {
+		var err error
+		if level, err = m.consentLevel(ctx, tidepoolID, user); err != nil {
+			return Input{}, err
+		}
+	}
+	return m.inputForUser(ctx, tidepoolID, user, delete, clinics, level)
+}
+
+func (m *Connector) inputForUser(ctx context.Context, tidepoolID string, user shoreline.UserData, delete bool, clinics *clinic.ClinicianClinicRelationships, level ConsentLevel) (Input, error) {
 	input := Input{
 		TidepoolID:                tidepoolID,
-		Email:                     newEmail,
-		UserType:                  m.TypeForUser(newUser, clinics),
+		Email:                     strings.ToLower(user.Username),
+		UserType:                  m.TypeForUser(user, clinics),
 		IsPrescriber:              hasPrescriberRole(clinics),
 		IsMemberOfMultipleClinics: isMemberOfMultipleClinics(clinics),
-		Unsubscribed:              delete,
-		DeletedAccount:            delete,
+		ExternalCompanyID:         m.externalCompanyID(clinics),
+		ClinicAttributes:          m.clinicAttributes(clinics),
+		// Users without marketing consent only receive transactional emails
+		Unsubscribed:   delete || level != ConsentFull,
+		DeletedAccount: delete,
+		Consent:        level,
 	}
-	if err := m.UpsertListMember(tidepoolID, listEmail, input); err != nil {
-		m.logger.Printf(`ERROR: marketo failure upserting member "%s" to "%s"; %s`, tidepoolID, newEmail, err)
+	if delete {
+		return input, nil
+	}
+
+	var err error
+	if input.PatientAttributes, err = m.patientAttributes(ctx, tidepoolID); err != nil {
+		return input, fmt.Errorf("marketo: could not resolve the patient clinics of user %v: %w", tidepoolID, err)
+	}
+	if input.ProfileAttributes, err = m.profileAttributes(ctx, tidepoolID); err != nil {
+		return input, fmt.Errorf("marketo: could not resolve the profile of user %v: %w", tidepoolID, err)
+	}
+	return input, nil
+}
+
+// enqueue persists the mutation in the outbox
+func (m *Connector) enqueue(ctx context.Context, tidepoolID string, listEmail string, input Input, company *Company, memberships []Membership, force bool) error {
+	entry := &store.OutboxEntry{
+		UserID:    tidepoolID,
+		ListEmail: listEmail,
+		Payload:   input.toMap(),
+		Force:     force,
+		Source:    sourceForOutbox(ctx),
+	}
+	if company != nil {
+		entry.Company = payloadMap(company)
+	}
+	if memberships != nil {
+		entry.SyncMemberships = true
+		entry.Memberships = membershipsToMaps(memberships)
+	}
+	if err := m.outbox.EnqueueOutboxEntry(ctx, entry); err != nil {
+		return fmt.Errorf("marketo: could not enqueue mutation for user %v: %w", tidepoolID, err)
+	}
+	return nil
+}
+
+// deliver sends the mutation to marketo and records the result in the sync state. The company
+// the lead is linked to is upserted before the lead and the memberships are synced after the lead,
+// unless they are nil. Writes which would not change the lead since the last successful sync are
+// skipped, unless force is set.
+func (m *Connector) deliver(ctx context.Context, tidepoolID string, listEmail string, input Input, company *Company, memberships []Membership, force bool) error {
+	if company != nil {
+		if err := m.upsertCompany(ctx, *company); err != nil {
+			return fmt.Errorf("marketo: could not upsert company of user %v: %w", tidepoolID, err)
+		}
+	}
+	if err := m.deliverLead(ctx, tidepoolID, listEmail, input, force); err != nil {
 		return err
 	}
+	if memberships != nil {
+		return m.SyncMemberships(ctx, tidepoolID, memberships, force)
+	}
+	return nil
+}
+
+func (m *Connector) deliverLead(ctx context.Context, tidepoolID string, listEmail string, input Input, force bool) error {
+	state := m.findSyncState(ctx, tidepoolID)
+	// The previous email may be unknown to the caller (e.g. CDC rows without a before image),
+	// the email which was last synced to marketo is the most reliable lookup value
+	if state != nil && state.Email != "" {
+		listEmail = state.Email
+	}
+	// The lead of the state was deleted when the consent was withdrawn
+	if state != nil && state.Status == store.SyncStatusRemoved {
+		if input.DeletedAccount {
+			m.logger.Printf("no lead to delete for user %v", tidepoolID)
+			return nil
+		}
+		removed := *state
+		removed.LeadID, removed.InputHash = 0, ""
+		state = &removed
+	}
+	if !force && state != nil && state.InputHash == input.Hash() {
+		m.logger.Printf("skipping unchanged member %s", tidepoolID)
+		skippedWrites.Add(1)
+		return nil
+	}
+	leadID, err := m.upsertListMember(ctx, tidepoolID, listEmail, input, state)
+	if err != nil {
+		m.saveSyncFailure(ctx, tidepoolID, err)
+		return err
+	}
+	if leadID == 0 {
+		return nil
+	}
+	m.saveSyncState(ctx, tidepoolID, leadID, input)
 	return nil
 }
 
 // UpsertListMember creates or updates lead based on if lead already exists
-func (m *Connector) UpsertListMember(userId, listEmail string, input Input) error {
+func (m *Connector) UpsertListMember(ctx context.Context, userId, listEmail string, input Input) error {
+	_, err := m.upsertListMember(ctx, userId, listEmail, input, m.findSyncState(ctx, userId))
+	return err
+}
+
+// upsertListMember creates or updates lead and returns the id of the lead. The lead id
+// of the last sync is used if available, otherwise the lead is looked up by user id and email.
+// Deletions of users without a lead return 0.
+func (m *Connector) upsertListMember(ctx context.Context, userId, listEmail string, input Input, state *store.SyncState) (int, error) {
+	var previous map[string]interface{}
+	if state != nil {
+		previous = state.Payload
+	}
+	if state != nil && state.LeadID > 0 {
+		input.ID = state.LeadID
+		result, err := m.postLead(ctx, CreateData{
+			"updateOnly",
+			"id",
+			[]Input{input},
+		}, previous)
+		if err != nil {
+			return -1, err
+		}
+		if result.Status != skippedStatus {
+			return state.LeadID, nil
+		}
+		// The lead was deleted or merged in marketo
+		m.logger.Printf("lead %v of user %v was not updated, looking up the lead", state.LeadID, userId)
+	}
+
 	id, exists, err := m.FindLeadByUserId(userId)
 	if err != nil {
-		return fmt.Errorf("marketo: could not find a lead %v", err)
+		return -1, fmt.Errorf("marketo: could not find a lead %v", err)
 	}
 	if !exists {
 		id, exists, err = m.FindLeadByEmail(listEmail)
 		if err != nil {
-			return fmt.Errorf("marketo: could not find a lead %v", err)
+			return -1, fmt.Errorf("marketo: could not find a lead %v", err)
 		}
 	}
 
+	if !exists && input.DeletedAccount {
+		// Deletions never create a lead
+		m.logger.Printf("no lead to delete for user %v", userId)
+		return 0, nil
+	}
+
 	input.ID = id
 	data := CreateData{
 		"updateOnly",
@@ -245,22 +541,102 @@ func (m *Connector) UpsertListMember(userId, listEmail string, input Input) erro
 			[]Input{input},
 		}
 	}
+	result, err := m.postLead(ctx, data, previous)
+	if err != nil {
+		return -1, err
+	}
+	if result.ID != 0 {
+		id = result.ID
+	}
+	return id, nil
+}
+
+// postLead sends the create or update request of a single lead and returns the result. Leads which
+// violate the lead policy are not sent. The mutation is recorded in the audit log with the changes
+// since the previous payload.
+func (m *Connector) postLead(ctx context.Context, data CreateData, previous map[string]interface{}) (minimarketo.RecordResult, error) {
+	result, err := m.sendLead(data)
+	for _, input := range data.Input {
+		m.recordAudit(ctx, input.TidepoolID, input.ID, data.Action, previous, input.toMap(), result, err)
+	}
+	return result, err
+}
+
+func (m *Connector) sendLead(data CreateData) (minimarketo.RecordResult, error) {
+	var result minimarketo.RecordResult
+	for _, input := range data.Input {
+		if err := m.checkLead(data.Action, input); err != nil {
+			return result, err
+		}
+	}
 	dataInBytes, err := json.Marshal(data)
+	if err != nil {
+		return result, err
+	}
+	writes.Add(1)
 	response, err := m.client.Post(path, dataInBytes)
 	if err != nil {
 		m.logger.Println(err)
-		return fmt.Errorf("marketo: could not get a response %v", err)
+		return result, fmt.Errorf("marketo: could not get a response %v", err)
 	}
 	if !response.Success {
 		m.logger.Println(response.Errors)
-		return fmt.Errorf("marketo: issue with request %v", response.Errors)
+		return result, fmt.Errorf("marketo: issue with request %v", response.Errors)
 	}
 	var createResults []minimarketo.RecordResult
 	if err = json.Unmarshal(response.Result, &createResults); err != nil {
 		m.logger.Println(err)
-		return fmt.Errorf("marketo: could not get a response %v", err)
+		return result, fmt.Errorf("marketo: could not get a response %v", err)
+	}
+	if len(createResults) == 1 {
+		result = createResults[0]
+	}
+	return result, nil
+}
+
+// findSyncState returns the last synced state of the user or nil if it's not available
+func (m *Connector) findSyncState(ctx context.Context, tidepoolID string) *store.SyncState {
+	if m.syncStates == nil {
+		return nil
+	}
+	state, err := m.syncStates.FindSyncState(ctx, tidepoolID)
+	if err != nil {
+		m.logger.Printf("unable to find sync state of user %v: %v", tidepoolID, err)
+		return nil
+	}
+	return state
+}
+
+// saveSyncState records the lead id and the payload which was synced to marketo
+func (m *Connector) saveSyncState(ctx context.Context, tidepoolID string, leadID int, input Input) {
+	if m.syncStates == nil {
+		return
+	}
+	now := time.Now()
+	input.ID = leadID
+	state := &store.SyncState{
+		UserID:      tidepoolID,
+		Email:       input.Email,
+		LeadID:      leadID,
+		InputHash:   input.Hash(),
+		Payload:     input.toMap(),
+		Status:      store.SyncStatusSynced,
+		SyncedTime:  now,
+		UpdatedTime: now,
+	}
+	if err := m.syncStates.UpsertSyncState(ctx, state); err != nil {
+		m.logger.Printf("unable to save sync state of user %v: %v", tidepoolID, err)
+	}
+}
+
+// saveSyncFailure records the failure without modifying the last synced state
+func (m *Connector) saveSyncFailure(ctx context.Context, tidepoolID string, syncErr error) {
+	if m.syncStates == nil {
+		return
+	}
+	if err := m.syncStates.UpdateSyncStatus(ctx, tidepoolID, store.SyncStatusFailed, syncErr.Error()); err != nil {
+		m.logger.Printf("unable to save sync status of user %v: %v", tidepoolID, err)
 	}
-	return nil
 }
 
 // FindLeadByEmail is used to find a lead in Marketo by email
@@ -323,6 +699,59 @@ func (m *Connector) FindLeadByUserId(userId string) (int, bool, error) {
 	return leads[0].ID, true, nil
 }
 
+// FindLeadsByUserIds returns the synced attributes of the leads of the users. Users without
+// a lead are not included in the result. At most MaxFilterValues users can be looked up at once.
+func (m *Connector) FindLeadsByUserIds(userIds []string) ([]LeadResult, error) {
+	return m.findLeads("tidepoolID", userIds)
+}
+
+// FindLead returns the synced attributes of the lead of the user. The lead is looked up by
+// the user id first and by email if the user id is not found. Returns nil if there's no lead.
+func (m *Connector) FindLead(userId string, email string) (*LeadResult, error) {
+	leads, err := m.findLeads("tidepoolID", []string{userId})
+	if err != nil {
+		return nil, err
+	}
+	if len(leads) == 0 && email != "" {
+		if leads, err = m.findLeads("email", []string{email}); err != nil {
+			return nil, err
+		}
+	}
+	if len(leads) != 1 {
+		return nil, nil
+	}
+	return &leads[0], nil
+}
+
+func (m *Connector) findLeads(filterType string, values []string) ([]LeadResult, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	if len(values) > MaxFilterValues {
+		return nil, fmt.Errorf("marketo: at most %v leads can be looked up at once", MaxFilterValues)
+	}
+	v := url.Values{
+		"filterType":   {filterType},
+		"filterValues": {strings.Join(values, ",")},
+		"fields":       {leadFields},
+	}
+	response, err := m.client.Get(path + v.Encode())
+	if err != nil {
+		m.logger.Println(err)
+		return nil, err
+	}
+	if !response.Success {
+		m.logger.Println(response.Errors)
+		return nil, fmt.Errorf("marketo: issue with request %v", response.Errors)
+	}
+	var leads []LeadResult
+	if err = json.Unmarshal(response.Result, &leads); err != nil {
+		m.logger.Println(err)
+		return nil, err
+	}
+	return leads, nil
+}
+
 // TypeForUser Identifies if the user is a clinic or patient
 func (m *Connector) TypeForUser(user shoreline.UserData, clinics *clinic.ClinicianClinicRelationships) string {
 	if clinics != nil && len(*clinics) > 0 {
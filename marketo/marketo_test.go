@@ -1,6 +1,7 @@
 package marketo_test
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	clinic "github.com/tidepool-org/clinic/client"
@@ -15,6 +16,7 @@ import (
 
 	"github.com/tidepool-org/go-common/clients/shoreline"
 	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/store"
 )
 
 func Test_Config_Validate_Missing(t *testing.T) {
@@ -167,7 +169,7 @@ func Test_NewManager_Success(t *testing.T) {
 
 func Test_CreateListMembershipForUser_User_Missing(t *testing.T) {
 	manager := NewTestManagerWithClientMock(t)
-	manager.CreateListMembershipForUser("testNumber", shoreline.UserData{}, &clinic.ClinicianClinicRelationships{})
+	manager.CreateListMembershipForUser(context.Background(), "testNumber", shoreline.UserData{}, &clinic.ClinicianClinicRelationships{})
 	time.Sleep(time.Second)
 }
 
@@ -175,7 +177,7 @@ func Test_CreateListMembershipForUser_User_Email_Missing(t *testing.T) {
 	manager := NewTestManagerWithClientMock(t)
 	newUserMock := NewUserMock()
 	newUserMock.Username = ""
-	manager.CreateListMembershipForUser("testNumber", newUserMock, &clinic.ClinicianClinicRelationships{})
+	manager.CreateListMembershipForUser(context.Background(), "testNumber", newUserMock, &clinic.ClinicianClinicRelationships{})
 	time.Sleep(time.Second)
 }
 
@@ -183,7 +185,7 @@ func Test_CreateListMembershipForUser_User_Email_Tidepool_Io(t *testing.T) {
 	manager := NewTestManagerWithClientMock(t)
 	newUserMock := NewUserMock()
 	newUserMock.Username = "test@tidepool.io"
-	manager.CreateListMembershipForUser("testNumber", newUserMock, &clinic.ClinicianClinicRelationships{})
+	manager.CreateListMembershipForUser(context.Background(), "testNumber", newUserMock, &clinic.ClinicianClinicRelationships{})
 	time.Sleep(time.Second)
 }
 
@@ -191,7 +193,7 @@ func Test_CreateListMembershipForUser_User_Email_Tidepool_Org(t *testing.T) {
 	manager := NewTestManagerWithClientMock(t)
 	newUserMock := NewUserMock()
 	newUserMock.Username = "test@tidepool.org"
-	manager.CreateListMembershipForUser("testNumber", newUserMock, &clinic.ClinicianClinicRelationships{})
+	manager.CreateListMembershipForUser(context.Background(), "testNumber", newUserMock, &clinic.ClinicianClinicRelationships{})
 	time.Sleep(time.Second)
 }
 
@@ -242,7 +244,7 @@ func Test_CreateListMembershipForUser_NewUser_Match_Personal(t *testing.T) {
 	newUserMock := NewUserMock()
 	newUserMock.Username = "tester@example.com"
 	newUserMock.Roles = nil
-	s.CreateListMembershipForUser("testNumber", newUserMock, &clinic.ClinicianClinicRelationships{})
+	s.CreateListMembershipForUser(context.Background(), "testNumber", newUserMock, &clinic.ClinicianClinicRelationships{})
 	user := s.TypeForUser(newUserMock, &clinic.ClinicianClinicRelationships{})
 	if user != "user" {
 		t.Errorf("Expected '%v', got 'clinic'", user)
@@ -296,7 +298,7 @@ func Test_CreateListMembershipForUser_NewUser_Match_Clinic(t *testing.T) {
 	newUserMock := NewUserMock()
 	newUserMock.Username = "tester@example.com"
 	newUserMock.Roles = []string{"clinic"}
-	s.CreateListMembershipForUser("testNumber", newUserMock, &clinic.ClinicianClinicRelationships{})
+	s.CreateListMembershipForUser(context.Background(), "testNumber", newUserMock, &clinic.ClinicianClinicRelationships{})
 	user := s.TypeForUser(newUserMock, &clinic.ClinicianClinicRelationships{})
 	if user != "clinic" {
 		t.Errorf("Expected '%v', got 'user'", user)
@@ -308,7 +310,7 @@ func Test_UpdateListMembershipForUser_NewUser_Missing(t *testing.T) {
 	oldUserMock := NewUserMock()
 	oldUserMock.Username = "ten@sample.com"
 	manager := NewTestManagerWithClientMock(t)
-	manager.UpdateListMembershipForUser("testNumber", oldUserMock, shoreline.UserData{}, false, &clinic.ClinicianClinicRelationships{})
+	manager.UpdateListMembershipForUser(context.Background(), "testNumber", oldUserMock, shoreline.UserData{}, false, &clinic.ClinicianClinicRelationships{})
 	time.Sleep(time.Second)
 }
 
@@ -316,7 +318,7 @@ func Test_UpdateListMembershipForUser_OldUser_Missing(t *testing.T) {
 	newUserMock := NewUserMock()
 	newUserMock.Username = "ten@sample.com"
 	manager := NewTestManagerWithClientMock(t)
-	manager.UpdateListMembershipForUser("testNumber", shoreline.UserData{}, newUserMock, false, &clinic.ClinicianClinicRelationships{})
+	manager.UpdateListMembershipForUser(context.Background(), "testNumber", shoreline.UserData{}, newUserMock, false, &clinic.ClinicianClinicRelationships{})
 	time.Sleep(time.Second)
 }
 
@@ -329,7 +331,7 @@ func Test_UpdateListMembershipForUser_NewUser_Match_Personal(t *testing.T) {
 	newUserMock := NewUserMock()
 	newUserMock.Username = "ten@sample.com"
 	newUserMock.Roles = nil
-	s.UpdateListMembershipForUser("testNumber", oldUserMock, newUserMock, false, &clinic.ClinicianClinicRelationships{})
+	s.UpdateListMembershipForUser(context.Background(), "testNumber", oldUserMock, newUserMock, false, &clinic.ClinicianClinicRelationships{})
 	user := s.TypeForUser(newUserMock, &clinic.ClinicianClinicRelationships{})
 	if user != "user" {
 		t.Errorf("Expected '%v', got 'clinic'", user)
@@ -346,7 +348,7 @@ func Test_UpdateListMembershipForUser_NewUser_Match_Clinic(t *testing.T) {
 	newUserMock := NewUserMock()
 	newUserMock.Username = "eleven@sample.com"
 	newUserMock.Roles = []string{"clinic"}
-	s.UpdateListMembershipForUser("testNumber", oldUserMock, newUserMock, false, &clinic.ClinicianClinicRelationships{})
+	s.UpdateListMembershipForUser(context.Background(), "testNumber", oldUserMock, newUserMock, false, &clinic.ClinicianClinicRelationships{})
 	user := s.TypeForUser(newUserMock, &clinic.ClinicianClinicRelationships{})
 	if user != "clinic" {
 		t.Errorf("Expected '%v', got 'user'", user)
@@ -360,7 +362,7 @@ func Test_UpdateListMembershipForUser_NewUser_Email_Missing(t *testing.T) {
 	oldUserMock.Username = "twelve@sample.com"
 	newUserMock := NewUserMock()
 	newUserMock.Username = ""
-	manager.UpdateListMembershipForUser("testNumber", oldUserMock, newUserMock, false, &clinic.ClinicianClinicRelationships{})
+	manager.UpdateListMembershipForUser(context.Background(), "testNumber", oldUserMock, newUserMock, false, &clinic.ClinicianClinicRelationships{})
 	time.Sleep(time.Second)
 }
 
@@ -370,7 +372,7 @@ func Test_UpdateListMembershipForUser_NewUser_Email_Tidepool_Io(t *testing.T) {
 	oldUserMock.Username = "twelve@sample.com"
 	newUserMock := NewUserMock()
 	newUserMock.Username = "test@tidepool.io"
-	manager.UpdateListMembershipForUser("testNumber", oldUserMock, newUserMock, false, &clinic.ClinicianClinicRelationships{})
+	manager.UpdateListMembershipForUser(context.Background(), "testNumber", oldUserMock, newUserMock, false, &clinic.ClinicianClinicRelationships{})
 	time.Sleep(time.Second)
 }
 
@@ -380,7 +382,7 @@ func Test_UpdateListMembershipForUser_NewUser_Email_Tidepool_Org(t *testing.T) {
 	oldUserMock.Username = "twelve@sample.com"
 	newUserMock := NewUserMock()
 	newUserMock.Username = "test@tidepool.org"
-	manager.UpdateListMembershipForUser("testNumber", oldUserMock, newUserMock, false, &clinic.ClinicianClinicRelationships{})
+	manager.UpdateListMembershipForUser(context.Background(), "testNumber", oldUserMock, newUserMock, false, &clinic.ClinicianClinicRelationships{})
 	time.Sleep(time.Second)
 }
 
@@ -509,7 +511,7 @@ func Test_UpdateListMember(t *testing.T) {
 		Email:      newEmail,
 		UserType:   userType,
 	}
-	var addOrUpdateMember = s.UpsertListMember("testNumber", oldEmail, input)
+	var addOrUpdateMember = s.UpsertListMember(context.Background(), "testNumber", oldEmail, input)
 	if addOrUpdateMember != nil {
 		t.Error("Expected nil, returned not nil")
 	}
@@ -623,11 +625,222 @@ func Test_CreateListMember(t *testing.T) {
 		Email:      newEmail,
 		UserType:   userType,
 	}
-	var addOrUpdateMember = s.UpsertListMember("testNumber", oldEmail, input)
+	var addOrUpdateMember = s.UpsertListMember(context.Background(), "testNumber", oldEmail, input)
 	if addOrUpdateMember != nil {
 		t.Error("Expected nil, returned not nil")
 	}
 }
+func Test_UpdateListMembershipForUser_Uses_Last_Synced_Email(t *testing.T) {
+	emptyResponse := `{
+		"requestId":"1000",
+		"result":[],
+		"success":true
+	}`
+	getResponseSuccess := `{
+		"requestId":"1000",
+		"result":[{"id":23,"email":"synced@example.com"}],
+		"success":true
+	}`
+	syncedEmail := "synced@example.com"
+	newEmail := "changed@example.com"
+	called := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Type", "application/json")
+		called++
+		if called == 1 {
+			w.Write([]byte(fmt.Sprintf(authResponseSuccess, token)))
+		}
+		if called == 2 {
+			w.Write([]byte(emptyResponse))
+		}
+		if called == 3 {
+			params, err := url.ParseQuery(r.URL.RawQuery)
+			if err != nil {
+				t.Errorf("Error parsing query params: %v", err)
+			}
+			checkParam(t, params, "filterType", "email")
+			checkParam(t, params, "filterValues", syncedEmail)
+			w.Write([]byte(getResponseSuccess))
+		}
+		if called == 4 {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			var requestBody CreateLeadRequest
+			if err := json.Unmarshal(body, &requestBody); err != nil {
+				t.Error(err)
+			}
+			if requestBody.Action != "updateOnly" {
+				t.Errorf("Expected 'updateOnly', got %s", requestBody.Action)
+			}
+			if requestBody.Input[0].Email != newEmail {
+				t.Errorf("Expected %s, got %s", newEmail, requestBody.Input[0].Email)
+			}
+			w.Write([]byte(updateLeadResponseSuccess))
+		}
+	}))
+	defer ts.Close()
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+	config := NewTestConfig(t, ts)
+	syncStates := &SyncStateRepositoryMock{
+		States: map[string]*store.SyncState{
+			"testNumber": {UserID: "testNumber", Email: syncedEmail},
+		},
+	}
+	manager, _ := marketo.NewManager(logger, config, marketo.WithSyncStates(syncStates))
+	newUserMock := NewUserMock()
+	newUserMock.Username = newEmail
+	// The previous email is not known, e.g. a CDC snapshot row
+	manager.UpdateListMembershipForUser(context.Background(), "testNumber", shoreline.UserData{UserID: "testNumber"}, newUserMock, false, &clinic.ClinicianClinicRelationships{})
+	if called != 4 {
+		t.Errorf("Expected 4 requests, got %d", called)
+	}
+	state := syncStates.States["testNumber"]
+	if state.Email != newEmail {
+		t.Errorf("Expected synced email %s, got %s", newEmail, state.Email)
+	}
+	if state.LeadID != 23 {
+		t.Errorf("Expected lead id 23, got %d", state.LeadID)
+	}
+	if state.InputHash == "" {
+		t.Error("Expected input hash to be set")
+	}
+}
+
+func Test_UpsertListMember_Uses_Synced_Lead_Id(t *testing.T) {
+	skippedResponse := `{
+		"requestId":"1000",
+		"result":[{"status":"skipped","reasons":[{"code":"1004","message":"Lead not found"}]}],
+		"success":true
+	}`
+	emptyResponse := `{
+		"requestId":"1000",
+		"result":[],
+		"success":true
+	}`
+	tests := []struct {
+		name           string
+		leadExists     bool
+		expectedCalls  int
+		expectedLeadID int
+	}{
+		{name: "lead exists", leadExists: true, expectedCalls: 2, expectedLeadID: 23},
+		{name: "lead was deleted", leadExists: false, expectedCalls: 5, expectedLeadID: 12345},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			called := 0
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				w.Header().Set("Content-Type", "application/json")
+				called++
+				switch called {
+				case 1:
+					w.Write([]byte(fmt.Sprintf(authResponseSuccess, token)))
+				case 2:
+					if r.Method != "POST" {
+						t.Errorf("Expected 'POST' request, got '%s'", r.Method)
+					}
+					body, err := ioutil.ReadAll(r.Body)
+					if err != nil {
+						t.Error(err)
+					}
+					var requestBody CreateLeadRequest
+					if err := json.Unmarshal(body, &requestBody); err != nil {
+						t.Error(err)
+					}
+					if requestBody.Action != "updateOnly" || requestBody.Input[0].ID != 23 {
+						t.Errorf("Expected update of lead 23, got %s of lead %d", requestBody.Action, requestBody.Input[0].ID)
+					}
+					if test.leadExists {
+						w.Write([]byte(updateLeadResponseSuccess))
+					} else {
+						w.Write([]byte(skippedResponse))
+					}
+				case 3, 4:
+					w.Write([]byte(emptyResponse))
+				case 5:
+					w.Write([]byte(createLeadResponseSuccess))
+				}
+			}))
+			defer ts.Close()
+			logger := log.New(ioutil.Discard, "", log.LstdFlags)
+			config := NewTestConfig(t, ts)
+			syncStates := &SyncStateRepositoryMock{
+				States: map[string]*store.SyncState{
+					"testNumber": {UserID: "testNumber", Email: "tester@example.com", LeadID: 23},
+				},
+			}
+			manager, _ := marketo.NewManager(logger, config, marketo.WithSyncStates(syncStates))
+			newUserMock := NewUserMock()
+			newUserMock.Username = "tester@example.com"
+			manager.UpdateListMembershipForUser(context.Background(), "testNumber", newUserMock, newUserMock, false, &clinic.ClinicianClinicRelationships{})
+			if called != test.expectedCalls {
+				t.Errorf("Expected %d requests, got %d", test.expectedCalls, called)
+			}
+			state := syncStates.States["testNumber"]
+			if state.LeadID != test.expectedLeadID {
+				t.Errorf("Expected lead id %d, got %d", test.expectedLeadID, state.LeadID)
+			}
+			if state.Status != store.SyncStatusSynced {
+				t.Errorf("Expected status %s, got %s", store.SyncStatusSynced, state.Status)
+			}
+		})
+	}
+}
+
+func Test_RefreshListMembershipForUser_Skips_Unchanged_Lead(t *testing.T) {
+	tests := []struct {
+		name          string
+		force         bool
+		expectedCalls int
+	}{
+		{name: "unchanged", force: false, expectedCalls: 1},
+		{name: "forced", force: true, expectedCalls: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			called := 0
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				w.Header().Set("Content-Type", "application/json")
+				called++
+				if called == 1 {
+					w.Write([]byte(fmt.Sprintf(authResponseSuccess, token)))
+				}
+				if called == 2 {
+					if r.Method != "POST" {
+						t.Errorf("Expected 'POST' request, got '%s'", r.Method)
+					}
+					w.Write([]byte(updateLeadResponseSuccess))
+				}
+			}))
+			defer ts.Close()
+			logger := log.New(ioutil.Discard, "", log.LstdFlags)
+			config := NewTestConfig(t, ts)
+			synced := marketo.Input{
+				TidepoolID: "testNumber",
+				Email:      "tester@example.com",
+				UserType:   "user",
+			}
+			syncStates := &SyncStateRepositoryMock{
+				States: map[string]*store.SyncState{
+					"testNumber": {UserID: "testNumber", Email: synced.Email, LeadID: 23, InputHash: synced.Hash()},
+				},
+			}
+			manager, _ := marketo.NewManager(logger, config, marketo.WithSyncStates(syncStates))
+			userMock := NewUserMock()
+			userMock.Username = "tester@example.com"
+			manager.RefreshListMembershipForUser(context.Background(), "testNumber", userMock, test.force, &clinic.ClinicianClinicRelationships{})
+			if called != test.expectedCalls {
+				t.Errorf("Expected %d requests, got %d", test.expectedCalls, called)
+			}
+		})
+	}
+}
+
 func Test_FindLead(t *testing.T) {
 	getResponseSuccess := `{
 		"requestId":"1000",
@@ -864,3 +1077,35 @@ func (u *UserMock) AllOutputsConsumed() bool {
 	return len(u.EmailOutputs) == 0 &&
 		len(u.IsClinicOutputs) == 0
 }
+
+type SyncStateRepositoryMock struct {
+	States map[string]*store.SyncState
+}
+
+func (s *SyncStateRepositoryMock) FindSyncState(ctx context.Context, userID string) (*store.SyncState, error) {
+	return s.States[userID], nil
+}
+
+func (s *SyncStateRepositoryMock) UpsertSyncState(ctx context.Context, state *store.SyncState) error {
+	s.States[state.UserID] = state
+	return nil
+}
+
+func (s *SyncStateRepositoryMock) UpdateSyncStateMemberships(ctx context.Context, userID string, clinicIDs []string, hash string) error {
+	if state, ok := s.States[userID]; ok {
+		state.Memberships = clinicIDs
+		state.MembershipsHash = hash
+	}
+	return nil
+}
+
+func (s *SyncStateRepositoryMock) UpdateSyncStatus(ctx context.Context, userID string, status string, syncErr string) error {
+	state, ok := s.States[userID]
+	if !ok {
+		state = &store.SyncState{UserID: userID}
+		s.States[userID] = state
+	}
+	state.Status = status
+	state.Error = syncErr
+	return nil
+}
@@ -0,0 +1,283 @@
+package marketo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/SpeakData/minimarketo"
+	clinic "github.com/tidepool-org/clinic/client"
+
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+const customObjectsPath = "/rest/v1/customobjects/"
+
+// Membership is the custom object of a clinician-clinic membership. The object is linked
+// to the lead by the tidepool id and is deduplicated by the tidepool id and the clinic id.
+type Membership struct {
+	TidepoolID string `json:"tidepoolID"`
+	ClinicID   string `json:"clinicId"`
+	ClinicName string `json:"clinicName"`
+	// Roles is the comma separated list of the roles of the clinician in the clinic
+	Roles      string `json:"roles"`
+	JoinedDate string `json:"joinedDate"`
+}
+
+// membershipKey is used to delete memberships
+type membershipKey struct {
+	TidepoolID string `json:"tidepoolID"`
+	ClinicID   string `json:"clinicId"`
+}
+
+// SyncCustomObjectsData is the marketo request format of the custom object upserts
+type SyncCustomObjectsData struct {
+	Action   string       `json:"action"`
+	DedupeBy string       `json:"dedupeBy"`
+	Input    []Membership `json:"input"`
+}
+
+// DeleteCustomObjectsData is the marketo request format of the custom object deletes
+type DeleteCustomObjectsData struct {
+	DeleteBy string          `json:"deleteBy"`
+	Input    []membershipKey `json:"input"`
+}
+
+// MembershipsForUser returns the memberships of the clinician sorted by clinic id
+func MembershipsForUser(tidepoolID string, clinics *clinic.ClinicianClinicRelationships) []Membership {
+	memberships := make([]Membership, 0)
+	if clinics == nil {
+		return memberships
+	}
+	for _, relationship := range *clinics {
+		id := clinicId(relationship)
+		if id == "" {
+			continue
+		}
+		membership := Membership{
+			TidepoolID: tidepoolID,
+			ClinicID:   id,
+			ClinicName: relationship.Clinic.Name,
+			Roles:      strings.Join(relationship.Clinician.Roles, ","),
+		}
+		if relationship.Clinician.CreatedTime != nil {
+			membership.JoinedDate = relationship.Clinician.CreatedTime.UTC().Format(joinedDateLayout)
+		}
+		memberships = append(memberships, membership)
+	}
+	sort.Slice(memberships, func(i, j int) bool { return memberships[i].ClinicID < memberships[j].ClinicID })
+	return memberships
+}
+
+// membershipsForSync returns the memberships which have to be synced with the lead or nil if the
+// memberships of the user are not managed. Memberships are synced for users who are members of a
+// clinic or had memberships when they were last synced, so removed memberships are deleted. Users
+// whose memberships were never synced are synced once to find memberships which were synced before
+// the memberships were recorded.
+func (m *Connector) membershipsForSync(ctx context.Context, tidepoolID string, input Input, clinics *clinic.ClinicianClinicRelationships) []Membership {
+	if m.config.MembershipObject == "" {
+		return nil
+	}
+	memberships := MembershipsForUser(tidepoolID, clinics)
+	if input.DeletedAccount {
+		memberships = make([]Membership, 0)
+	}
+	if len(memberships) > 0 {
+		return memberships
+	}
+	if state := m.findSyncState(ctx, tidepoolID); state != nil && (state.Memberships == nil || len(state.Memberships) > 0) {
+		return memberships
+	}
+	return nil
+}
+
+// SyncMemberships upserts the custom objects of the memberships of the user and deletes the
+// objects of the memberships which no longer exist. Memberships which are unchanged since they
+// were last synced are not sent again, unless force is set.
+func (m *Connector) SyncMemberships(ctx context.Context, tidepoolID string, memberships []Membership, force bool) error {
+	if m.config.MembershipObject == "" {
+		return nil
+	}
+	hash := membershipsHash(memberships)
+	if !force {
+		if state := m.findSyncState(ctx, tidepoolID); state != nil && state.Memberships != nil && state.MembershipsHash == hash {
+			return nil
+		}
+	}
+
+	existing, err := m.findMemberships(tidepoolID)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]bool)
+	for _, membership := range memberships {
+		current[membership.ClinicID] = true
+	}
+	removed := make([]membershipKey, 0)
+	for _, membership := range existing {
+		if !current[membership.ClinicID] {
+			removed = append(removed, membershipKey{TidepoolID: tidepoolID, ClinicID: membership.ClinicID})
+		}
+	}
+
+	upserted := make([]map[string]interface{}, 0, len(memberships))
+	for _, membership := range memberships {
+		payload := payloadMap(membership)
+		if err := m.checkPayload(MembershipPolicy, "createOrUpdate", "membership of user", tidepoolID, payload); err != nil {
+			m.recordObjectAudit(ctx, store.AuditObjectMembership, tidepoolID, "createOrUpdate", nil, payload, minimarketo.RecordResult{}, err)
+			return err
+		}
+		upserted = append(upserted, payload)
+	}
+	deleted := make([]map[string]interface{}, 0, len(removed))
+	for _, key := range removed {
+		payload := payloadMap(key)
+		if err := m.checkPayload(MembershipPolicy, "delete", "membership of user", tidepoolID, payload); err != nil {
+			m.recordObjectAudit(ctx, store.AuditObjectMembership, tidepoolID, "delete", payload, nil, minimarketo.RecordResult{}, err)
+			return err
+		}
+		deleted = append(deleted, payload)
+	}
+
+	if len(memberships) > 0 {
+		results, err := m.postCustomObjects(m.config.MembershipObject+".json", SyncCustomObjectsData{
+			Action:   "createOrUpdate",
+			DedupeBy: "dedupeFields",
+			Input:    memberships,
+		})
+		if err := m.auditMemberships(ctx, tidepoolID, "createOrUpdate", upserted, results, err); err != nil {
+			return err
+		}
+	}
+	if len(removed) > 0 {
+		results, err := m.postCustomObjects(m.config.MembershipObject+"/delete.json", DeleteCustomObjectsData{
+			DeleteBy: "dedupeFields",
+			Input:    removed,
+		})
+		if err := m.auditMemberships(ctx, tidepoolID, "delete", deleted, results, err); err != nil {
+			return err
+		}
+	}
+
+	m.saveSyncStateMemberships(ctx, tidepoolID, memberships, hash)
+	return nil
+}
+
+// saveSyncStateMemberships records the clinic ids and the hash of the synced memberships in the sync state
+func (m *Connector) saveSyncStateMemberships(ctx context.Context, tidepoolID string, memberships []Membership, hash string) {
+	if m.syncStates == nil {
+		return
+	}
+	clinicIDs := make([]string, 0, len(memberships))
+	for _, membership := range memberships {
+		clinicIDs = append(clinicIDs, membership.ClinicID)
+	}
+	if err := m.syncStates.UpdateSyncStateMemberships(ctx, tidepoolID, clinicIDs, hash); err != nil {
+		m.logger.Printf("unable to save memberships of user %v: %v", tidepoolID, err)
+	}
+}
+
+// findMemberships returns the membership objects of the user, following the pages of the results
+func (m *Connector) findMemberships(tidepoolID string) ([]Membership, error) {
+	v := url.Values{
+		"filterType":   {"tidepoolID"},
+		"filterValues": {tidepoolID},
+		"fields":       {"tidepoolID,clinicId"},
+	}
+	var memberships []Membership
+	for {
+		response, err := m.client.Get(customObjectsPath + m.config.MembershipObject + ".json?" + v.Encode())
+		if err != nil {
+			m.logger.Println(err)
+			return nil, err
+		}
+		if !response.Success {
+			m.logger.Println(response.Errors)
+			return nil, fmt.Errorf("marketo: issue with request %v", response.Errors)
+		}
+		var page []Membership
+		if err = json.Unmarshal(response.Result, &page); err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, page...)
+		if response.NextPageToken == "" || len(page) == 0 {
+			return memberships, nil
+		}
+		v.Set("nextPageToken", response.NextPageToken)
+	}
+}
+
+// postCustomObjects sends the custom object request and returns the results in the order of the objects
+func (m *Connector) postCustomObjects(resource string, body interface{}) ([]minimarketo.RecordResult, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	customObjectWrites.Add(1)
+	response, err := m.client.Post(customObjectsPath+resource, data)
+	if err != nil {
+		m.logger.Println(err)
+		return nil, fmt.Errorf("marketo: could not get a response %v", err)
+	}
+	if !response.Success {
+		m.logger.Println(response.Errors)
+		return nil, fmt.Errorf("marketo: issue with request %v", response.Errors)
+	}
+	var results []minimarketo.RecordResult
+	if err = json.Unmarshal(response.Result, &results); err != nil {
+		return nil, fmt.Errorf("marketo: could not get a response %v", err)
+	}
+	return results, nil
+}
+
+// auditMemberships records the mutation of each membership object with its result. It returns the
+// error of the request or an error if marketo skipped an object.
+func (m *Connector) auditMemberships(ctx context.Context, tidepoolID string, action string, payloads []map[string]interface{}, results []minimarketo.RecordResult, err error) error {
+	var skipped error
+	for i, payload := range payloads {
+		var result minimarketo.RecordResult
+		if i < len(results) {
+			result = results[i]
+		}
+		previous, current := map[string]interface{}(nil), payload
+		if action == "delete" {
+			previous, current = payload, nil
+		}
+		m.recordObjectAudit(ctx, store.AuditObjectMembership, tidepoolID, action, previous, current, result, err)
+		if result.Status == skippedStatus && skipped == nil {
+			skipped = fmt.Errorf("marketo: custom object was skipped %v", result.Reasons)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return skipped
+}
+
+func membershipsHash(memberships []Membership) string {
+	data, _ := json.Marshal(memberships)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func membershipsToMaps(memberships []Membership) []map[string]interface{} {
+	var result []map[string]interface{}
+	data, _ := json.Marshal(memberships)
+	_ = json.Unmarshal(data, &result)
+	return result
+}
+
+func membershipsFromMaps(payload []map[string]interface{}) ([]Membership, error) {
+	memberships := make([]Membership, 0)
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &memberships)
+	return memberships, err
+}
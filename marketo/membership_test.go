@@ -0,0 +1,197 @@
+package marketo_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	clinic "github.com/tidepool-org/clinic/client"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+func Test_SyncMemberships_Deletes_Removed_Memberships(t *testing.T) {
+	emptyResponse := `{
+		"requestId":"1000",
+		"result":[],
+		"success":true
+	}`
+	existingResponse := `{
+		"requestId":"1000",
+		"result":[{"seq":0,"marketoGUID":"1","tidepoolID":"1234","clinicId":"a"},{"seq":1,"marketoGUID":"2","tidepoolID":"1234","clinicId":"removed"}],
+		"success":true
+	}`
+	objectsResponse := `{
+		"requestId":"1000",
+		"result":[{"seq":0,"marketoGUID":"1","status":"updated"}],
+		"success":true
+	}`
+	var mu sync.Mutex
+	var upserts []marketo.SyncCustomObjectsData
+	var deletes []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Type", "application/json")
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.EscapedPath() {
+		case "/identity/oauth/token":
+			w.Write([]byte(fmt.Sprintf(authResponseSuccess, token)))
+		case "/rest/v1/customobjects/clinicMembership_c.json":
+			if r.Method == "GET" {
+				w.Write([]byte(existingResponse))
+				return
+			}
+			data := marketo.SyncCustomObjectsData{}
+			_ = json.Unmarshal(body, &data)
+			upserts = append(upserts, data)
+			w.Write([]byte(objectsResponse))
+		case "/rest/v1/customobjects/clinicMembership_c/delete.json":
+			deletes = append(deletes, string(body))
+			w.Write([]byte(objectsResponse))
+		default:
+			if r.Method == "GET" {
+				w.Write([]byte(emptyResponse))
+			} else {
+				w.Write([]byte(createLeadResponseSuccess))
+			}
+		}
+	}))
+	defer ts.Close()
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	config := NewTestConfig(t, ts)
+	config.MembershipObject = "clinicMembership_c"
+	syncStates := store.NewMemoryStore()
+	manager, _ := marketo.NewManager(logger, config, marketo.WithSyncStates(syncStates))
+
+	clinicId, joined := "a", time.Date(2023, time.March, 4, 0, 0, 0, 0, time.UTC)
+	clinics := clinic.ClinicianClinicRelationships{{
+		Clinic:    clinic.Clinic{Id: &clinicId, Name: "Clinic A"},
+		Clinician: clinic.Clinician{CreatedTime: &joined, Roles: []string{"CLINIC_ADMIN", "PRESCRIBER"}},
+	}}
+	user := shoreline.UserData{UserID: "1234", Username: "clinician@example.com"}
+	if err := manager.RefreshListMembershipForUser(context.Background(), "1234", user, false, &clinics); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The memberships hash is persisted, so unchanged memberships are skipped after a restart
+	restarted, _ := marketo.NewManager(logger, config, marketo.WithSyncStates(syncStates))
+	if err := restarted.RefreshListMembershipForUser(context.Background(), "1234", user, false, &clinics); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := marketo.Membership{TidepoolID: "1234", ClinicID: "a", ClinicName: "Clinic A", Roles: "CLINIC_ADMIN,PRESCRIBER", JoinedDate: "2023-03-04"}
+	if len(upserts) != 1 || len(upserts[0].Input) != 1 || upserts[0].Input[0] != expected {
+		t.Fatalf("Expected unchanged memberships to be upserted once with %+v, got %+v", expected, upserts)
+	}
+	if len(deletes) != 1 || deletes[0] != `{"deleteBy":"dedupeFields","input":[{"tidepoolID":"1234","clinicId":"removed"}]}` {
+		t.Errorf("Expected the removed membership to be deleted, got %v", deletes)
+	}
+	if state, _ := syncStates.FindSyncState(context.Background(), "1234"); state == nil || state.MembershipsHash == "" {
+		t.Errorf("Expected the memberships hash to be recorded, got %+v", state)
+	}
+
+	// Forced refreshes repair the memberships which were changed in marketo
+	if err := restarted.RefreshListMembershipForUser(context.Background(), "1234", user, true, &clinics); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(upserts) != 2 || len(deletes) != 2 {
+		t.Fatalf("Expected the memberships to be synced again, got %v upserts and %v deletes", len(upserts), len(deletes))
+	}
+
+	// Memberships of users who were never clinicians are not synced
+	patient := shoreline.UserData{UserID: "5678", Username: "patient@example.com"}
+	if err := manager.RefreshListMembershipForUser(context.Background(), "5678", patient, true, &clinic.ClinicianClinicRelationships{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(upserts) != 2 || len(deletes) != 2 {
+		t.Errorf("Expected no membership requests for a patient, got %v upserts and %v deletes", len(upserts), len(deletes))
+	}
+
+	// All memberships are deleted when the clinician leaves the last clinic
+	if err := manager.RefreshListMembershipForUser(context.Background(), "1234", user, true, &clinic.ClinicianClinicRelationships{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(deletes) != 3 || deletes[2] != `{"deleteBy":"dedupeFields","input":[{"tidepoolID":"1234","clinicId":"a"},{"tidepoolID":"1234","clinicId":"removed"}]}` {
+		t.Errorf("Expected all memberships to be deleted, got %v", deletes)
+	}
+}
+
+func Test_SyncMemberships_Deletes_Memberships_Of_Unrecorded_States(t *testing.T) {
+	firstPage := `{
+		"requestId":"1000",
+		"result":[{"seq":0,"marketoGUID":"1","tidepoolID":"1234","clinicId":"a"}],
+		"nextPageToken":"page2",
+		"success":true
+	}`
+	secondPage := `{
+		"requestId":"1000",
+		"result":[{"seq":0,"marketoGUID":"2","tidepoolID":"1234","clinicId":"b"}],
+		"success":true
+	}`
+	objectsResponse := `{
+		"requestId":"1000",
+		"result":[{"seq":0,"marketoGUID":"1","status":"deleted"}],
+		"success":true
+	}`
+	var mu sync.Mutex
+	lookups := 0
+	var deletes []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.EscapedPath() {
+		case "/identity/oauth/token":
+			w.Write([]byte(fmt.Sprintf(authResponseSuccess, token)))
+		case "/rest/v1/customobjects/clinicMembership_c.json":
+			lookups++
+			if r.URL.Query().Get("nextPageToken") == "page2" {
+				w.Write([]byte(secondPage))
+			} else {
+				w.Write([]byte(firstPage))
+			}
+		case "/rest/v1/customobjects/clinicMembership_c/delete.json":
+			deletes = append(deletes, string(body))
+			w.Write([]byte(objectsResponse))
+		default:
+			w.Write([]byte(updateLeadResponseSuccess))
+		}
+	}))
+	defer ts.Close()
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	config := NewTestConfig(t, ts)
+	config.MembershipObject = "clinicMembership_c"
+	syncStates := store.NewMemoryStore()
+	// The state was synced before the memberships were recorded
+	_ = syncStates.UpsertSyncState(context.Background(), &store.SyncState{UserID: "1234", Email: "clinician@example.com", LeadID: 23, Payload: map[string]interface{}{"userType": "clinic"}})
+	manager, _ := marketo.NewManager(logger, config, marketo.WithSyncStates(syncStates))
+
+	user := shoreline.UserData{UserID: "1234", Username: "clinician@example.com"}
+	for i := 0; i < 2; i++ {
+		if err := manager.RefreshListMembershipForUser(context.Background(), "1234", user, true, &clinic.ClinicianClinicRelationships{}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if lookups != 2 {
+		t.Errorf("Expected both pages of memberships to be looked up once, got %d lookups", lookups)
+	}
+	if len(deletes) != 1 || deletes[0] != `{"deleteBy":"dedupeFields","input":[{"tidepoolID":"1234","clinicId":"a"},{"tidepoolID":"1234","clinicId":"b"}]}` {
+		t.Errorf("Expected the memberships of all pages to be deleted, got %v", deletes)
+	}
+	state, _ := syncStates.FindSyncState(context.Background(), "1234")
+	if state == nil || state.Memberships == nil || len(state.Memberships) != 0 {
+		t.Errorf("Expected no memberships to be recorded, got %+v", state)
+	}
+}
@@ -0,0 +1,24 @@
+package marketo
+
+import "expvar"
+
+var (
+	// writes is the number of create or update requests sent to marketo
+	writes = expvar.NewInt("marketo_lead_writes")
+	// skippedWrites is the number of writes which were skipped because the lead didn't change since the last sync
+	skippedWrites = expvar.NewInt("marketo_lead_skipped_writes")
+	// deliveredMutations is the number of outbox entries which were delivered to marketo
+	deliveredMutations = expvar.NewInt("marketo_outbox_delivered")
+	// failedDeliveries is the number of failed outbox delivery attempts
+	failedDeliveries = expvar.NewInt("marketo_outbox_failed_attempts")
+	// companyWrites is the number of company upserts sent to marketo
+	companyWrites = expvar.NewInt("marketo_company_writes")
+	// customObjectWrites is the number of custom object upserts and deletes sent to marketo
+	customObjectWrites = expvar.NewInt("marketo_custom_object_writes")
+	// parkedMutations is the number of outbox entries which exceeded the max number of attempts
+	parkedMutations = expvar.NewInt("marketo_outbox_parked")
+	// policyRejections is the number of payloads which were not sent because they violate the payload policy
+	policyRejections = expvar.NewInt("marketo_policy_rejections")
+	// leadRemovals is the number of leads which were deleted because the user has no marketing consent
+	leadRemovals = expvar.NewInt("marketo_lead_removals")
+)
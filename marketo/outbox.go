@@ -0,0 +1,178 @@
+package marketo
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+// outboxLease is the time an entry is locked for delivery by a single drainer
+const outboxLease = 5 * time.Minute
+
+// OutboxConfig is the env config of the outbox drainer
+type OutboxConfig struct {
+	// MaxAttempts is the number of delivery attempts before an entry is parked
+	MaxAttempts  int           `envconfig:"MARKETO_OUTBOX_MAX_ATTEMPTS" default:"10"`
+	BatchSize    int           `envconfig:"MARKETO_OUTBOX_BATCH_SIZE" default:"100"`
+	PollInterval time.Duration `envconfig:"MARKETO_OUTBOX_POLL_INTERVAL" default:"5s"`
+	// RetryDelay is multiplied by the number of attempts to compute the time of the next attempt
+	RetryDelay time.Duration `envconfig:"MARKETO_OUTBOX_RETRY_DELAY" default:"30s"`
+}
+
+// OutboxDrainer delivers the mutations persisted in the outbox to marketo. Mutations of a
+// single user are delivered in the order they were enqueued.
+type OutboxDrainer struct {
+	logger    *log.Logger
+	connector *Connector
+	outbox    store.OutboxRepository
+	config    OutboxConfig
+	stop      chan struct{}
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewOutboxDrainer creates a drainer which delivers the outbox entries with the connector
+func NewOutboxDrainer(logger *log.Logger, connector *Connector, outbox store.OutboxRepository, config OutboxConfig) *OutboxDrainer {
+	return &OutboxDrainer{
+		logger:    logger,
+		connector: connector,
+		outbox:    outbox,
+		config:    config,
+		stop:      make(chan struct{}),
+	}
+}
+
+// Start polls the outbox until the drainer is stopped
+func (d *OutboxDrainer) Start() error {
+	d.wg.Add(1)
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := d.Drain(context.Background()); err != nil {
+			d.logger.Printf("unable to drain outbox: %v", err)
+		}
+		select {
+		case <-d.stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop signals the drainer to stop and waits for the current delivery to complete
+func (d *OutboxDrainer) Stop() error {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+	d.wg.Wait()
+	return nil
+}
+
+// Drain delivers the pending entries which are due and returns the number of delivered entries. Each
+// batch holds the oldest pending entry of each user, the next entry of a user is delivered in a following
+// batch once the earlier one is delivered or parked.
+func (d *OutboxDrainer) Drain(ctx context.Context) (int, error) {
+	delivered := 0
+	for !d.isStopping() {
+		entries, err := d.outbox.FindPendingOutboxEntries(ctx, d.config.BatchSize)
+		if err != nil {
+			return delivered, err
+		}
+
+		// entries which are no longer pending, which unblock the next entries of their users
+		completed := 0
+		for _, entry := range entries {
+			if d.isStopping() {
+				break
+			}
+			claimed, err := d.outbox.ClaimOutboxEntry(ctx, entry.ID, time.Now().Add(outboxLease))
+			if err != nil {
+				return delivered, err
+			}
+			if !claimed {
+				// The entry is being delivered by another drainer
+				continue
+			}
+			if err := d.deliver(ctx, entry); err != nil {
+				continue
+			}
+			completed++
+			if entry.Status == store.OutboxStatusDelivered {
+				delivered++
+			}
+		}
+		if completed == 0 {
+			return delivered, nil
+		}
+	}
+	return delivered, nil
+}
+
+// deliver attempts the delivery of a single entry and returns an error if later
+// entries of the same user must wait for the entry to be retried
+func (d *OutboxDrainer) deliver(ctx context.Context, entry *store.OutboxEntry) error {
+	var err error
+	if entry.Source != nil {
+		ctx = ContextWithSource(ctx, *entry.Source)
+	}
+	if entry.RemoveLead {
+		err = d.connector.deliverRemoval(ctx, entry.UserID)
+	} else {
+		var input Input
+		input, err = inputFromMap(entry.Payload)
+		var company *Company
+		if err == nil && entry.Company != nil {
+			company, err = companyFromMap(entry.Company)
+		}
+		var memberships []Membership
+		if err == nil && entry.SyncMemberships {
+			memberships, err = membershipsFromMaps(entry.Memberships)
+		}
+		if err == nil {
+			err = d.connector.deliver(ctx, entry.UserID, entry.ListEmail, input, company, memberships, entry.Force)
+		}
+	}
+
+	entry.Attempts++
+	if err == nil {
+		entry.Status = store.OutboxStatusDelivered
+		entry.Error = ""
+		deliveredMutations.Add(1)
+	} else {
+		entry.Error = err.Error()
+		failedDeliveries.Add(1)
+		// Payloads which violate the policy are rejected again on each attempt
+		if entry.Attempts >= d.config.MaxAttempts || errors.Is(err, ErrPolicyViolation) {
+			d.logger.Printf(`ERROR: parking outbox entry %s of user "%s" after %d attempts; %s`, entry.ID.Hex(), entry.UserID, entry.Attempts, err)
+			entry.Status = store.OutboxStatusParked
+			parkedMutations.Add(1)
+		} else {
+			d.logger.Printf(`ERROR: marketo failure delivering outbox entry %s of user "%s"; %s`, entry.ID.Hex(), entry.UserID, err)
+			entry.NextAttemptTime = time.Now().Add(d.config.RetryDelay * time.Duration(entry.Attempts))
+		}
+	}
+
+	if updateErr := d.outbox.UpdateOutboxEntry(ctx, entry); updateErr != nil {
+		d.logger.Printf("unable to update outbox entry %s: %v", entry.ID.Hex(), updateErr)
+		return updateErr
+	}
+	if entry.Status == store.OutboxStatusPending {
+		return err
+	}
+	return nil
+}
+
+func (d *OutboxDrainer) isStopping() bool {
+	select {
+	case <-d.stop:
+		return true
+	default:
+		return false
+	}
+}
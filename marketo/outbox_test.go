@@ -0,0 +1,224 @@
+package marketo_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	clinic "github.com/tidepool-org/clinic/client"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+func Test_OutboxDrainer_Delivers_In_Order_And_Parks(t *testing.T) {
+	emptyResponse := `{
+		"requestId":"1000",
+		"result":[],
+		"success":true
+	}`
+	failedResponse := `{
+		"requestId":"1000",
+		"success":false,
+		"errors":[{"code":"611","message":"System error"}]
+	}`
+	posts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.EscapedPath() == "/identity/oauth/token" {
+			w.Write([]byte(fmt.Sprintf(authResponseSuccess, token)))
+			return
+		}
+		if r.Method == "GET" {
+			w.Write([]byte(emptyResponse))
+			return
+		}
+		posts++
+		if posts <= 2 {
+			w.Write([]byte(failedResponse))
+		} else {
+			w.Write([]byte(createLeadResponseSuccess))
+		}
+	}))
+	defer ts.Close()
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+	config := NewTestConfig(t, ts)
+	outbox := &OutboxRepositoryMock{}
+	manager, _ := marketo.NewManager(logger, config, marketo.WithOutbox(outbox))
+
+	first := NewUserMock()
+	first.Username = "first@example.com"
+	second := NewUserMock()
+	second.Username = "second@example.com"
+	if err := manager.UpdateListMembershipForUser(context.Background(), "testNumber", first, first, false, &clinic.ClinicianClinicRelationships{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.UpdateListMembershipForUser(context.Background(), "testNumber", first, second, false, &clinic.ClinicianClinicRelationships{}); err != nil {
+		t.Fatal(err)
+	}
+	if posts != 0 {
+		t.Fatalf("Expected mutations to be enqueued, got %d requests", posts)
+	}
+
+	drainer := marketo.NewOutboxDrainer(logger, manager.(*marketo.Connector), outbox, marketo.OutboxConfig{
+		MaxAttempts: 2,
+		BatchSize:   10,
+	})
+	if _, err := drainer.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if outbox.Entries[0].Attempts != 1 || outbox.Entries[0].Status != store.OutboxStatusPending {
+		t.Errorf("Expected first entry to be pending after 1 attempt, got %s after %d", outbox.Entries[0].Status, outbox.Entries[0].Attempts)
+	}
+	if outbox.Entries[1].Attempts != 0 {
+		t.Errorf("Expected second entry to wait for the first one, got %d attempts", outbox.Entries[1].Attempts)
+	}
+
+	time.Sleep(time.Millisecond)
+	if _, err := drainer.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if outbox.Entries[0].Status != store.OutboxStatusParked {
+		t.Errorf("Expected first entry to be parked, got %s", outbox.Entries[0].Status)
+	}
+	if outbox.Entries[1].Status != store.OutboxStatusDelivered {
+		t.Errorf("Expected second entry to be delivered, got %s", outbox.Entries[1].Status)
+	}
+}
+
+func Test_OutboxDrainer_Skips_Backed_Off_Entries(t *testing.T) {
+	ts := AuditServer(t)
+	defer ts.Close()
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+	outbox := store.NewMemoryStore()
+	manager, _ := marketo.NewManager(logger, NewTestConfig(t, ts), marketo.WithOutbox(outbox))
+	config := marketo.OutboxConfig{MaxAttempts: 10, BatchSize: 2}
+	ctx := context.Background()
+
+	// More entries than a batch are waiting to be retried
+	for i := 0; i <= config.BatchSize; i++ {
+		entry := &store.OutboxEntry{UserID: fmt.Sprintf("backedOff%d", i), Payload: map[string]interface{}{}}
+		_ = outbox.EnqueueOutboxEntry(ctx, entry)
+		entry.Attempts = 5
+		entry.NextAttemptTime = time.Now().Add(time.Hour)
+		_ = outbox.UpdateOutboxEntry(ctx, entry)
+	}
+	user := NewUserMock()
+	user.Username = "user@example.com"
+	if err := manager.UpdateListMembershipForUser(ctx, "testNumber", user, user, false, &clinic.ClinicianClinicRelationships{}); err != nil {
+		t.Fatal(err)
+	}
+
+	drainer := marketo.NewOutboxDrainer(logger, manager.(*marketo.Connector), outbox, config)
+	delivered, err := drainer.Drain(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered != 1 {
+		t.Errorf("Expected the entry of the user to be delivered, got %d deliveries", delivered)
+	}
+}
+
+func Test_OutboxDrainer_Upserts_Company_Before_Lead(t *testing.T) {
+	var posts []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.EscapedPath() == "/identity/oauth/token":
+			w.Write([]byte(fmt.Sprintf(authResponseSuccess, token)))
+		case r.Method == "GET":
+			w.Write([]byte(`{"requestId":"1000","result":[],"success":true}`))
+		default:
+			posts = append(posts, r.URL.EscapedPath())
+			if len(posts) == 1 {
+				w.Write([]byte(`{"requestId":"1000","success":false,"errors":[{"code":"611","message":"System error"}]}`))
+				return
+			}
+			w.Write([]byte(`{"requestId":"1000","result":[{"id":12,"status":"created"}],"success":true}`))
+		}
+	}))
+	defer ts.Close()
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+	outbox := &OutboxRepositoryMock{}
+	manager, _ := marketo.NewManager(logger, NewTestConfig(t, ts), marketo.WithOutbox(outbox))
+
+	clinicId := "6218b2ab3f4f1e5b2c3d4e60"
+	clinics := clinic.ClinicianClinicRelationships{{
+		Clinic:    clinic.Clinic{Id: &clinicId, Name: "Example Clinic"},
+		Clinician: clinic.Clinician{Roles: []string{"CLINIC_ADMIN"}},
+	}}
+	user := NewUserMock()
+	user.Username = "clinician@example.com"
+	if err := manager.RefreshListMembershipForUser(context.Background(), "testNumber", user, false, &clinics); err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 0 || outbox.Entries[0].Company == nil {
+		t.Fatalf("Expected the company to be enqueued with the lead, got %d requests and %+v", len(posts), outbox.Entries[0])
+	}
+
+	drainer := marketo.NewOutboxDrainer(logger, manager.(*marketo.Connector), outbox, marketo.OutboxConfig{MaxAttempts: 2, BatchSize: 10})
+	if _, err := drainer.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 1 || outbox.Entries[0].Status != store.OutboxStatusPending {
+		t.Fatalf("Expected the lead to wait for the company to be retried, got %v", posts)
+	}
+	outbox.Entries[0].NextAttemptTime = time.Now()
+	if _, err := drainer.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/rest/v1/companies/sync.json", "/rest/v1/companies/sync.json", "/rest/v1/leads.json"}
+	if fmt.Sprint(posts) != fmt.Sprint(expected) || outbox.Entries[0].Status != store.OutboxStatusDelivered {
+		t.Errorf("Expected the company to be upserted before the lead, got %v", posts)
+	}
+}
+
+type OutboxRepositoryMock struct {
+	Entries []*store.OutboxEntry
+}
+
+func (o *OutboxRepositoryMock) EnqueueOutboxEntry(ctx context.Context, entry *store.OutboxEntry) error {
+	entry.ID = primitive.NewObjectID()
+	entry.Status = store.OutboxStatusPending
+	entry.CreatedTime = time.Now()
+	entry.NextAttemptTime = entry.CreatedTime
+	o.Entries = append(o.Entries, entry)
+	return nil
+}
+
+func (o *OutboxRepositoryMock) FindPendingOutboxEntries(ctx context.Context, limit int) ([]*store.OutboxEntry, error) {
+	var results []*store.OutboxEntry
+	seen := make(map[string]bool)
+	for _, entry := range o.Entries {
+		if entry.Status != store.OutboxStatusPending || seen[entry.UserID] {
+			continue
+		}
+		seen[entry.UserID] = true
+		if !entry.NextAttemptTime.After(time.Now()) && len(results) < limit {
+			copied := *entry
+			results = append(results, &copied)
+		}
+	}
+	return results, nil
+}
+
+func (o *OutboxRepositoryMock) ClaimOutboxEntry(ctx context.Context, id primitive.ObjectID, lockedUntil time.Time) (bool, error) {
+	return true, nil
+}
+
+func (o *OutboxRepositoryMock) UpdateOutboxEntry(ctx context.Context, entry *store.OutboxEntry) error {
+	for i, e := range o.Entries {
+		if e.ID == entry.ID {
+			copied := *entry
+			o.Entries[i] = &copied
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package marketo
+
+import (
+	"context"
+
+	clinic "github.com/tidepool-org/clinic/client"
+)
+
+// PatientClinicsResolver returns the clinics a user is a patient of
+type PatientClinicsResolver interface {
+	GetClinicsForPatient(ctx context.Context, userId string) (*clinic.PatientClinicRelationships, error)
+}
+
+// PatientAttributes describe the clinics a user is a patient of
+type PatientAttributes struct {
+	ConnectedToClinic   bool   `json:"patientConnectedToClinic"`
+	ClinicCount         int    `json:"patientClinicCount"`
+	FirstConnectionDate string `json:"patientFirstClinicConnectionDate"`
+}
+
+// WithPatientClinics adds the attributes of the clinics the user is a patient of to the leads
+func WithPatientClinics(patientClinics PatientClinicsResolver) Option {
+	return func(m *Connector) {
+		m.patientClinics = patientClinics
+	}
+}
+
+// PatientAttributesForClinics returns the patient attributes of the user
+func PatientAttributesForClinics(clinics *clinic.PatientClinicRelationships) PatientAttributes {
+	if clinics == nil || len(*clinics) == 0 {
+		return PatientAttributes{}
+	}
+
+	attributes := PatientAttributes{
+		ConnectedToClinic: true,
+		ClinicCount:       len(*clinics),
+	}
+	first := unknownJoinedTime
+	for _, relationship := range *clinics {
+		if relationship.Patient.CreatedTime != nil && relationship.Patient.CreatedTime.Before(first) {
+			first = *relationship.Patient.CreatedTime
+		}
+	}
+	if first != unknownJoinedTime {
+		attributes.FirstConnectionDate = first.UTC().Format(joinedDateLayout)
+	}
+	return attributes
+}
+
+// patientAttributes returns the patient attributes of the user or empty attributes if the resolver is not configured
+func (m *Connector) patientAttributes(ctx context.Context, tidepoolID string) (PatientAttributes, error) {
+	if m.patientClinics == nil {
+		return PatientAttributes{}, nil
+	}
+	clinics, err := m.patientClinics.GetClinicsForPatient(ctx, tidepoolID)
+	if err != nil {
+		return PatientAttributes{}, err
+	}
+	return PatientAttributesForClinics(clinics), nil
+}
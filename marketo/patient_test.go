@@ -0,0 +1,47 @@
+package marketo_test
+
+import (
+	"testing"
+	"time"
+
+	clinic "github.com/tidepool-org/clinic/client"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+)
+
+func Test_PatientAttributesForClinics(t *testing.T) {
+	day := func(d int) *time.Time {
+		joined := time.Date(2024, time.January, d, 22, 0, 0, 0, time.UTC)
+		return &joined
+	}
+
+	tests := []struct {
+		name     string
+		clinics  *clinic.PatientClinicRelationships
+		expected marketo.PatientAttributes
+	}{
+		{name: "not a patient", clinics: nil, expected: marketo.PatientAttributes{}},
+		{name: "no clinics", clinics: &clinic.PatientClinicRelationships{}, expected: marketo.PatientAttributes{}},
+		{
+			name: "multiple clinics",
+			clinics: &clinic.PatientClinicRelationships{
+				{Patient: clinic.Patient{CreatedTime: day(3)}},
+				{Patient: clinic.Patient{CreatedTime: day(2)}},
+				{Patient: clinic.Patient{}},
+			},
+			expected: marketo.PatientAttributes{ConnectedToClinic: true, ClinicCount: 3, FirstConnectionDate: "2024-01-02"},
+		},
+		{
+			name:     "unknown connection date",
+			clinics:  &clinic.PatientClinicRelationships{{Patient: clinic.Patient{}}},
+			expected: marketo.PatientAttributes{ConnectedToClinic: true, ClinicCount: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if attributes := marketo.PatientAttributesForClinics(tt.clinics); attributes != tt.expected {
+				t.Errorf("Expected patient attributes %+v, got %+v", tt.expected, attributes)
+			}
+		})
+	}
+}
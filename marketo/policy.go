@@ -0,0 +1,199 @@
+package marketo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	clinic "github.com/tidepool-org/clinic/client"
+)
+
+// ErrPolicyViolation is returned for payloads which are rejected by the payload policy
+var ErrPolicyViolation = errors.New("marketo: payload violates the policy")
+
+// Value types of the payload fields
+const (
+	fieldTypeString  = "string"
+	fieldTypeBoolean = "boolean"
+	fieldTypeInteger = "integer"
+)
+
+// FieldRule declares the type of a field, the pattern string values must match and the
+// pattern they must not match
+type FieldRule struct {
+	Type    string
+	Pattern *regexp.Regexp
+	Reject  *regexp.Regexp
+}
+
+// PayloadPolicy is the schema of the payloads sent to marketo. Fields which are not declared
+// are rejected, so new fields must be reviewed for PHI before they can be synced.
+type PayloadPolicy map[string]FieldRule
+
+var (
+	idPattern       = regexp.MustCompile(`^[0-9A-Za-z_-]{1,64}$`)
+	emailPattern    = regexp.MustCompile(`^[^@\s]+@[^@\s]+$`)
+	datePattern     = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+	namePattern     = regexp.MustCompile(`^[\p{L}\p{M}\p{N}\p{Zs}.,'’&()+#-]{0,255}$`)
+	urlPattern      = regexp.MustCompile(`(?i)www\.|[\p{L}\p{N}-]+\.[a-z]{2,}(\s|$)`)
+	localePattern   = regexp.MustCompile(`^[A-Za-z]{2,3}([-_][A-Za-z0-9]{2,8})*$`)
+	countryPattern  = regexp.MustCompile(`^[\p{L} .'()-]{0,64}$`)
+	regionPattern   = regexp.MustCompile(`^[\p{L}\p{N} .'()-]{0,64}$`)
+	userTypePattern = regexp.MustCompile(`^[a-z_]{1,64}$`)
+	tierPattern     = regexp.MustCompile(`^tier\d{4}$`)
+	rolesPattern    = regexp.MustCompile(`^[A-Z_]+(,[A-Z_]+)*$`)
+	addressPattern  = regexp.MustCompile(`^[^@<>]{0,255}$`)
+	postalPattern   = regexp.MustCompile(`^[0-9A-Za-z -]{0,16}$`)
+	phonePattern    = regexp.MustCompile(`^[0-9A-Za-z+() .#/-]{0,32}$`)
+	websitePattern  = regexp.MustCompile(`^[^\s@<>]{0,255}$`)
+
+	clinicTypePattern = enumPattern(clinic.HealthcareSystem, clinic.Other, clinic.ProviderPractice, clinic.Researcher, clinic.VeterinaryClinic)
+	clinicSizePattern = enumPattern(clinic.N0249, clinic.N250499, clinic.N500999, clinic.N1000)
+)
+
+// enumPattern returns a pattern which only matches the values
+func enumPattern[T ~string](values ...T) *regexp.Regexp {
+	quoted := make([]string, 0, len(values))
+	for _, value := range values {
+		quoted = append(quoted, regexp.QuoteMeta(string(value)))
+	}
+	return regexp.MustCompile(`^(` + strings.Join(quoted, "|") + `)$`)
+}
+
+// LeadPolicy is the schema of the leads. It lists every field of Input and the subscription categories.
+var LeadPolicy = PayloadPolicy{
+	"id":                                     {Type: fieldTypeInteger},
+	"tidepoolID":                             {Type: fieldTypeString, Pattern: idPattern},
+	"email":                                  {Type: fieldTypeString, Pattern: emailPattern},
+	"userType":                               {Type: fieldTypeString, Pattern: userTypePattern},
+	"unsubscribed":                           {Type: fieldTypeBoolean},
+	"deletedAccount":                         {Type: fieldTypeBoolean},
+	"clinicWorkspaceMemberofMultipleClinics": {Type: fieldTypeBoolean},
+	"clinicWorkspacePrescriber":              {Type: fieldTypeBoolean},
+	"externalCompanyId":                      {Type: fieldTypeString, Pattern: idPattern},
+	"clinicWorkspaceClinicName":              {Type: fieldTypeString, Pattern: namePattern, Reject: urlPattern},
+	"clinicWorkspaceClinicType":              {Type: fieldTypeString, Pattern: clinicTypePattern},
+	"clinicWorkspaceClinicCountry":           {Type: fieldTypeString, Pattern: countryPattern},
+	"clinicWorkspaceClinicState":             {Type: fieldTypeString, Pattern: regionPattern},
+	"clinicWorkspaceClinicTier":              {Type: fieldTypeString, Pattern: tierPattern},
+	"clinicWorkspaceClinicSize":              {Type: fieldTypeString, Pattern: clinicSizePattern},
+	"clinicWorkspaceJoinedDate":              {Type: fieldTypeString, Pattern: datePattern},
+	"patientConnectedToClinic":               {Type: fieldTypeBoolean},
+	"patientClinicCount":                     {Type: fieldTypeInteger},
+	"patientFirstClinicConnectionDate":       {Type: fieldTypeString, Pattern: datePattern},
+	ProfileFieldFirstName:                    {Type: fieldTypeString, Pattern: namePattern, Reject: urlPattern},
+	ProfileFieldLastName:                     {Type: fieldTypeString, Pattern: namePattern, Reject: urlPattern},
+	ProfileFieldLocale:                       {Type: fieldTypeString, Pattern: localePattern},
+	ProfileFieldCountry:                      {Type: fieldTypeString, Pattern: countryPattern},
+	ProfileFieldCaregiver:                    {Type: fieldTypeBoolean},
+	productUpdatesField:                      {Type: fieldTypeBoolean},
+	researchOpportunitiesField:               {Type: fieldTypeBoolean},
+	clinicNewslettersField:                   {Type: fieldTypeBoolean},
+}
+
+// CompanyPolicy is the schema of the companies of the clinics
+var CompanyPolicy = PayloadPolicy{
+	"externalCompanyId": {Type: fieldTypeString, Pattern: idPattern},
+	"company":           {Type: fieldTypeString, Pattern: namePattern, Reject: urlPattern},
+	"website":           {Type: fieldTypeString, Pattern: websitePattern},
+	"mainPhone":         {Type: fieldTypeString, Pattern: phonePattern},
+	"billingStreet":     {Type: fieldTypeString, Pattern: addressPattern},
+	"billingCity":       {Type: fieldTypeString, Pattern: regionPattern},
+	"billingState":      {Type: fieldTypeString, Pattern: regionPattern},
+	"billingCountry":    {Type: fieldTypeString, Pattern: countryPattern},
+	"billingPostalCode": {Type: fieldTypeString, Pattern: postalPattern},
+}
+
+// MembershipPolicy is the schema of the clinician-clinic membership custom objects
+var MembershipPolicy = PayloadPolicy{
+	"tidepoolID": {Type: fieldTypeString, Pattern: idPattern},
+	"clinicId":   {Type: fieldTypeString, Pattern: idPattern},
+	"clinicName": {Type: fieldTypeString, Pattern: namePattern, Reject: urlPattern},
+	"roles":      {Type: fieldTypeString, Pattern: rolesPattern},
+	"joinedDate": {Type: fieldTypeString, Pattern: datePattern},
+}
+
+// Check returns the violations of the payload. The violations name the fields and the rules,
+// but never the values, so they can be logged and persisted safely.
+func (p PayloadPolicy) Check(payload map[string]interface{}) []string {
+	var violations []string
+	for field, value := range payload {
+		rule, ok := p[field]
+		if !ok {
+			violations = append(violations, fmt.Sprintf("field %s is not allowed", field))
+			continue
+		}
+		if value == nil {
+			continue
+		}
+		if !rule.matchesType(value) {
+			violations = append(violations, fmt.Sprintf("field %s is not a %s", field, rule.Type))
+			continue
+		}
+		s, ok := value.(string)
+		if !ok || s == "" {
+			continue
+		}
+		if rule.Pattern != nil && !rule.Pattern.MatchString(s) {
+			violations = append(violations, fmt.Sprintf("field %s doesn't match the pattern %s", field, rule.Pattern))
+		} else if rule.Reject != nil && rule.Reject.MatchString(s) {
+			violations = append(violations, fmt.Sprintf("field %s matches the rejected pattern %s", field, rule.Reject))
+		}
+	}
+	sort.Strings(violations)
+	return violations
+}
+
+func (r FieldRule) matchesType(value interface{}) bool {
+	switch r.Type {
+	case fieldTypeString:
+		_, ok := value.(string)
+		return ok
+	case fieldTypeBoolean:
+		_, ok := value.(bool)
+		return ok
+	case fieldTypeInteger:
+		switch n := value.(type) {
+		case int:
+			return true
+		case float64:
+			return n == math.Trunc(n)
+		default:
+			return false
+		}
+	default:
+		return false
+	}
+}
+
+// checkLead rejects leads which violate the lead policy. Rejections are counted and audited.
+func (m *Connector) checkLead(action string, input Input) error {
+	return m.checkLeadPayload(action, input.TidepoolID, input.toMap())
+}
+
+func (m *Connector) checkLeadPayload(action string, tidepoolID string, payload map[string]interface{}) error {
+	return m.checkPayload(LeadPolicy, action, "lead of user", tidepoolID, payload)
+}
+
+// checkPayload rejects payloads which violate the policy. The object describes the payload in the audit log.
+func (m *Connector) checkPayload(policy PayloadPolicy, action string, object string, id string, payload map[string]interface{}) error {
+	violations := policy.Check(payload)
+	if len(violations) == 0 {
+		return nil
+	}
+	policyRejections.Add(1)
+	m.logger.Printf(`AUDIT: rejected %s of %s "%s"; %s`, action, object, id, strings.Join(violations, "; "))
+	return fmt.Errorf("%w: %s", ErrPolicyViolation, strings.Join(violations, "; "))
+}
+
+// payloadMap returns the json representation of the payload which is checked by the policies
+func payloadMap(payload interface{}) map[string]interface{} {
+	var result map[string]interface{}
+	data, _ := json.Marshal(payload)
+	_ = json.Unmarshal(data, &result)
+	return result
+}
@@ -0,0 +1,187 @@
+package marketo_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	clinic "github.com/tidepool-org/clinic/client"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+)
+
+func Test_PayloadPolicy_Check(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  map[string]interface{}
+		expected []string
+	}{
+		{
+			name:    "valid payload",
+			payload: map[string]interface{}{"tidepoolID": "1234567890", "email": "user@example.com", "patientClinicCount": float64(2), "firstName": "Jane", "caregiverForDependent": nil},
+		},
+		{
+			name:     "field not in the schema",
+			payload:  map[string]interface{}{"email": "user@example.com", "diagnosisType": "type1"},
+			expected: []string{"field diagnosisType is not allowed"},
+		},
+		{
+			name:     "wrong type",
+			payload:  map[string]interface{}{"unsubscribed": "true", "patientClinicCount": 1.5},
+			expected: []string{"field patientClinicCount is not a integer", "field unsubscribed is not a boolean"},
+		},
+		{
+			name:     "pattern mismatch",
+			payload:  map[string]interface{}{"email": "not an email", "preferredLocale": "English"},
+			expected: []string{"field email doesn't match the pattern ^[^@\\s]+@[^@\\s]+$", "field preferredLocale doesn't match the pattern ^[A-Za-z]{2,3}([-_][A-Za-z0-9]{2,8})*$"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if violations := marketo.LeadPolicy.Check(tt.payload); !reflect.DeepEqual(violations, tt.expected) {
+				t.Errorf("Expected violations %v, got %v", tt.expected, violations)
+			}
+		})
+	}
+}
+
+func Test_PayloadPolicy_Names(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		valid bool
+	}{
+		{name: "simple name", value: "Jane", valid: true},
+		{name: "accents and punctuation", value: "Zoë O'Brien-Núñez Jr.", valid: true},
+		{name: "non latin script", value: "山田 太郎", valid: true},
+		{name: "clinic name", value: "St. Mary's Diabetes & Endocrinology (Main #2)", valid: true},
+		{name: "newline", value: "Jane\nDoe"},
+		{name: "tab", value: "Jane\tDoe"},
+		{name: "control character", value: "Jane\x00Doe"},
+		{name: "bidi override", value: "Jane\u202eDoe"},
+		{name: "markup", value: "<b>Jane</b>"},
+		{name: "email", value: "jane@example.com"},
+		{name: "url", value: "https://example.com/offer"},
+		{name: "www", value: "visit www.example"},
+		{name: "domain", value: "Jane from example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, payload := range []map[string]interface{}{{"firstName": tt.value}, {"clinicWorkspaceClinicName": tt.value}} {
+				if violations := marketo.LeadPolicy.Check(payload); (len(violations) == 0) != tt.valid {
+					t.Errorf("Expected %q to be valid: %v, got violations %v", tt.value, tt.valid, violations)
+				}
+			}
+			violations := marketo.CompanyPolicy.Check(map[string]interface{}{"company": tt.value})
+			if (len(violations) == 0) != tt.valid {
+				t.Errorf("Expected company %q to be valid: %v, got violations %v", tt.value, tt.valid, violations)
+			}
+		})
+	}
+}
+
+func Test_PayloadPolicy_Clinic_Attributes(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   marketo.PayloadPolicy
+		payload  map[string]interface{}
+		expected int
+	}{
+		{
+			name:    "valid clinic attributes",
+			policy:  marketo.LeadPolicy,
+			payload: map[string]interface{}{"clinicWorkspaceClinicType": "provider_practice", "clinicWorkspaceClinicSize": "250-499", "clinicWorkspaceClinicTier": "tier0300", "clinicWorkspaceJoinedDate": "2023-03-04", "patientFirstClinicConnectionDate": "2023-03-04"},
+		},
+		{
+			name:     "invalid clinic attributes",
+			policy:   marketo.LeadPolicy,
+			payload:  map[string]interface{}{"clinicWorkspaceClinicType": "diabetes clinic", "clinicWorkspaceClinicSize": "12", "clinicWorkspaceClinicTier": "gold", "clinicWorkspaceJoinedDate": "March 4", "patientFirstClinicConnectionDate": "2023-03-04T00:00:00Z"},
+			expected: 5,
+		},
+		{
+			name:    "valid company",
+			policy:  marketo.CompanyPolicy,
+			payload: map[string]interface{}{"externalCompanyId": "6218b2ab3f4f1e5b2c3d4e60", "company": "Example Clinic", "website": "https://example.com", "mainPhone": "+1 (555) 010-0100", "billingPostalCode": "94110"},
+		},
+		{
+			name:     "invalid company",
+			policy:   marketo.CompanyPolicy,
+			payload:  map[string]interface{}{"company": "<b>Clinic</b>", "mainPhone": "call jane@example.com", "diagnosisType": "type1"},
+			expected: 3,
+		},
+		{
+			name:     "invalid membership",
+			policy:   marketo.MembershipPolicy,
+			payload:  map[string]interface{}{"tidepoolID": "1234", "clinicId": "a", "roles": "admin; prescriber", "joinedDate": "yesterday"},
+			expected: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if violations := tt.policy.Check(tt.payload); len(violations) != tt.expected {
+				t.Errorf("Expected %d violations, got %v", tt.expected, violations)
+			}
+		})
+	}
+}
+
+func Test_UpsertListMember_Rejects_Policy_Violations(t *testing.T) {
+	posts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.EscapedPath() == "/identity/oauth/token" {
+			w.Write([]byte(fmt.Sprintf(authResponseSuccess, token)))
+			return
+		}
+		if r.Method == "POST" {
+			posts++
+		}
+		w.Write([]byte(`{"requestId":"1000","result":[],"success":true}`))
+	}))
+	defer ts.Close()
+	manager, _ := marketo.NewManager(log.New(io.Discard, "", log.LstdFlags), NewTestConfig(t, ts))
+	connector := manager.(*marketo.Connector)
+
+	input := marketo.Input{TidepoolID: "1234567890", Email: "user@example.com", UserType: "patient"}
+	input.FirstName = "<script>@"
+	err := connector.UpsertListMember(context.Background(), input.TidepoolID, input.Email, input)
+	if !errors.Is(err, marketo.ErrPolicyViolation) {
+		t.Errorf("Expected a policy violation, got %v", err)
+	}
+	if posts != 0 {
+		t.Errorf("Expected the lead not to be sent, got %d requests", posts)
+	}
+}
+
+func Test_UpsertCompany_Rejects_Policy_Violations(t *testing.T) {
+	posts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.EscapedPath() == "/identity/oauth/token" {
+			w.Write([]byte(fmt.Sprintf(authResponseSuccess, token)))
+			return
+		}
+		if r.Method == "POST" {
+			posts++
+		}
+		w.Write([]byte(`{"requestId":"1000","result":[],"success":true}`))
+	}))
+	defer ts.Close()
+	manager, _ := marketo.NewManager(log.New(io.Discard, "", log.LstdFlags), NewTestConfig(t, ts))
+	connector := manager.(*marketo.Connector)
+
+	clinicId, phoneNumbers := "6218b2ab3f4f1e5b2c3d4e60", []clinic.PhoneNumber{{Number: "ask for jane@example.com"}}
+	err := connector.UpsertCompany(context.Background(), clinic.Clinic{Id: &clinicId, Name: "Example Clinic", PhoneNumbers: &phoneNumbers})
+	if !errors.Is(err, marketo.ErrPolicyViolation) {
+		t.Errorf("Expected a policy violation, got %v", err)
+	}
+	if posts != 0 {
+		t.Errorf("Expected the company not to be sent, got %d requests", posts)
+	}
+}
@@ -0,0 +1,153 @@
+package marketo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/SpeakData/minimarketo"
+
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+// ErrLeadNotFound is returned if the user doesn't have a lead
+var ErrLeadNotFound = errors.New("marketo: lead not found")
+
+// Marketo fields of the subscription categories
+const (
+	productUpdatesField        = "subscriptionProductUpdates"
+	researchOpportunitiesField = "subscriptionResearchOpportunities"
+	clinicNewslettersField     = "subscriptionClinicNewsletters"
+)
+
+// preferencesFields are the fields returned when the marketing preferences of a lead are requested
+const preferencesFields = "id,tidepoolID,unsubscribed," + productUpdatesField + "," + researchOpportunitiesField + "," + clinicNewslettersField
+
+// SubscriptionCategories are the categories of marketing emails a user subscribed to
+type SubscriptionCategories struct {
+	ProductUpdates        bool `json:"productUpdates"`
+	ResearchOpportunities bool `json:"researchOpportunities"`
+	ClinicNewsletters     bool `json:"clinicNewsletters"`
+}
+
+// MarketingPreferences are the marketing preferences of a user. Unsubscribed is managed by the
+// sync and reflects the marketing consent of the user, it can't be updated with the categories.
+type MarketingPreferences struct {
+	Unsubscribed bool                   `json:"unsubscribed"`
+	Categories   SubscriptionCategories `json:"categories"`
+}
+
+// preferencesLead is the format of the marketing preferences of a lead in marketo
+type preferencesLead struct {
+	ID                    int    `json:"id"`
+	TidepoolID            string `json:"tidepoolID"`
+	Unsubscribed          bool   `json:"unsubscribed"`
+	ProductUpdates        bool   `json:"subscriptionProductUpdates"`
+	ResearchOpportunities bool   `json:"subscriptionResearchOpportunities"`
+	ClinicNewsletters     bool   `json:"subscriptionClinicNewsletters"`
+}
+
+// GetMarketingPreferences returns the marketing preferences of the lead of the user or nil if the user doesn't have a lead
+func (m *Connector) GetMarketingPreferences(userId string) (*MarketingPreferences, error) {
+	v := url.Values{
+		"filterType":   {"tidepoolID"},
+		"filterValues": {userId},
+		"fields":       {preferencesFields},
+	}
+	response, err := m.client.Get(path + v.Encode())
+	if err != nil {
+		m.logger.Println(err)
+		return nil, err
+	}
+	if !response.Success {
+		m.logger.Println(response.Errors)
+		return nil, fmt.Errorf("marketo: issue with request %v", response.Errors)
+	}
+	var leads []preferencesLead
+	if err = json.Unmarshal(response.Result, &leads); err != nil {
+		return nil, err
+	}
+	if len(leads) != 1 {
+		return nil, nil
+	}
+	return &MarketingPreferences{
+		Unsubscribed: leads[0].Unsubscribed,
+		Categories: SubscriptionCategories{
+			ProductUpdates:        leads[0].ProductUpdates,
+			ResearchOpportunities: leads[0].ResearchOpportunities,
+			ClinicNewsletters:     leads[0].ClinicNewsletters,
+		},
+	}, nil
+}
+
+// UpdateSubscriptionCategories updates the subscription categories of the lead of the user.
+// Returns ErrLeadNotFound if the user doesn't have a lead.
+func (m *Connector) UpdateSubscriptionCategories(ctx context.Context, userId string, categories SubscriptionCategories) error {
+	leadID := 0
+	if state := m.findSyncState(ctx, userId); state != nil && state.Status != store.SyncStatusRemoved {
+		leadID = state.LeadID
+	}
+	if leadID <= 0 {
+		id, exists, err := m.FindLeadByUserId(userId)
+		if err != nil {
+			return fmt.Errorf("marketo: could not find a lead %v", err)
+		}
+		if !exists {
+			return ErrLeadNotFound
+		}
+		leadID = id
+	}
+
+	payload := map[string]interface{}{
+		"id":                       leadID,
+		productUpdatesField:        categories.ProductUpdates,
+		researchOpportunitiesField: categories.ResearchOpportunities,
+		clinicNewslettersField:     categories.ClinicNewsletters,
+	}
+	if err := m.checkLeadPayload("updateOnly", userId, payload); err != nil {
+		m.recordAudit(ctx, userId, leadID, "updateOnly", nil, payload, minimarketo.RecordResult{}, err)
+		return err
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"action":      "updateOnly",
+		"lookupField": "id",
+		"input":       []map[string]interface{}{payload},
+	})
+	if err != nil {
+		return err
+	}
+	result, err := m.postCategories(data)
+	m.recordAudit(ctx, userId, leadID, "updateOnly", nil, payload, result, err)
+	if err != nil {
+		return err
+	}
+	if result.Status == skippedStatus {
+		// The lead was deleted or merged in marketo
+		return ErrLeadNotFound
+	}
+	return nil
+}
+
+func (m *Connector) postCategories(data []byte) (minimarketo.RecordResult, error) {
+	var result minimarketo.RecordResult
+	writes.Add(1)
+	response, err := m.client.Post(path, data)
+	if err != nil {
+		m.logger.Println(err)
+		return result, fmt.Errorf("marketo: could not get a response %v", err)
+	}
+	if !response.Success {
+		m.logger.Println(response.Errors)
+		return result, fmt.Errorf("marketo: issue with request %v", response.Errors)
+	}
+	var results []minimarketo.RecordResult
+	if err = json.Unmarshal(response.Result, &results); err != nil {
+		return result, fmt.Errorf("marketo: could not get a response %v", err)
+	}
+	if len(results) == 1 {
+		result = results[0]
+	}
+	return result, nil
+}
@@ -0,0 +1,65 @@
+package marketo_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+)
+
+func Test_MarketingPreferences(t *testing.T) {
+	var posted map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.EscapedPath() == "/identity/oauth/token" {
+			w.Write([]byte(fmt.Sprintf(authResponseSuccess, token)))
+			return
+		}
+		if r.Method == "POST" {
+			_ = json.NewDecoder(r.Body).Decode(&posted)
+			w.Write([]byte(`{"requestId":"1000","result":[{"id":23,"status":"updated"}],"success":true}`))
+			return
+		}
+		if r.URL.Query().Get("filterValues") == "1234" {
+			w.Write([]byte(`{"requestId":"1000","result":[{"id":23,"tidepoolID":"1234","unsubscribed":true,"subscriptionClinicNewsletters":true}],"success":true}`))
+			return
+		}
+		w.Write([]byte(`{"requestId":"1000","result":[],"success":true}`))
+	}))
+	defer ts.Close()
+	manager, _ := marketo.NewManager(log.New(io.Discard, "", log.LstdFlags), NewTestConfig(t, ts))
+	connector := manager.(*marketo.Connector)
+
+	preferences, err := connector.GetMarketingPreferences("1234")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := marketo.MarketingPreferences{Unsubscribed: true, Categories: marketo.SubscriptionCategories{ClinicNewsletters: true}}
+	if preferences == nil || *preferences != expected {
+		t.Errorf("Expected preferences %+v, got %+v", expected, preferences)
+	}
+	if preferences, err := connector.GetMarketingPreferences("5678"); err != nil || preferences != nil {
+		t.Errorf("Expected no preferences, got %+v, %v", preferences, err)
+	}
+
+	if err := connector.UpdateSubscriptionCategories(context.Background(), "1234", marketo.SubscriptionCategories{ProductUpdates: true}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	input := posted["input"].([]interface{})[0].(map[string]interface{})
+	if input["id"] != float64(23) || input["subscriptionProductUpdates"] != true || input["subscriptionClinicNewsletters"] != false {
+		t.Errorf("Expected the categories of lead 23 to be updated, got %v", input)
+	}
+	if _, ok := input["unsubscribed"]; ok {
+		t.Errorf("Expected unsubscribed not to be updated, got %v", input)
+	}
+	if err := connector.UpdateSubscriptionCategories(context.Background(), "5678", marketo.SubscriptionCategories{}); !errors.Is(err, marketo.ErrLeadNotFound) {
+		t.Errorf("Expected lead not found, got %v", err)
+	}
+}
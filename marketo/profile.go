@@ -0,0 +1,96 @@
+package marketo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tidepool-org/marketo-service/profile"
+)
+
+// Profile fields which can be synced to marketo. The list is an allowlist of non-PHI fields,
+// only the fields enabled in the config are mapped onto the leads. Health data of the profile
+// is never sent.
+const (
+	ProfileFieldFirstName = "firstName"
+	ProfileFieldLastName  = "lastName"
+	ProfileFieldLocale    = "preferredLocale"
+	ProfileFieldCountry   = "country"
+	ProfileFieldCaregiver = "caregiverForDependent"
+)
+
+var allowedProfileFields = map[string]bool{
+	ProfileFieldFirstName: true,
+	ProfileFieldLastName:  true,
+	ProfileFieldLocale:    true,
+	ProfileFieldCountry:   true,
+	ProfileFieldCaregiver: true,
+}
+
+// ProfileResolver returns the profile of a user
+type ProfileResolver interface {
+	GetProfile(ctx context.Context, userId string) (*profile.Profile, error)
+}
+
+// ProfileAttributes are the allowlisted profile fields of a user. Fields which are not enabled
+// are omitted from the payload, so they are not modified in marketo.
+type ProfileAttributes struct {
+	FirstName string `json:"firstName,omitempty"`
+	LastName  string `json:"lastName,omitempty"`
+	Locale    string `json:"preferredLocale,omitempty"`
+	Country   string `json:"country,omitempty"`
+	Caregiver *bool  `json:"caregiverForDependent,omitempty"`
+}
+
+// WithProfiles adds the profile fields enabled in the config to the leads
+func WithProfiles(profiles ProfileResolver) Option {
+	return func(m *Connector) {
+		m.profiles = profiles
+	}
+}
+
+func validateProfileFields(fields []string) error {
+	for _, field := range fields {
+		if !allowedProfileFields[field] {
+			return fmt.Errorf("marketo: profile field %s is not allowed", field)
+		}
+	}
+	return nil
+}
+
+// ProfileAttributesForProfile returns the profile attributes of the user restricted to the enabled fields
+func ProfileAttributesForProfile(fields []string, p *profile.Profile) ProfileAttributes {
+	attributes := ProfileAttributes{}
+	if p == nil {
+		return attributes
+	}
+
+	firstName, lastName := p.Names()
+	for _, field := range fields {
+		switch field {
+		case ProfileFieldFirstName:
+			attributes.FirstName = firstName
+		case ProfileFieldLastName:
+			attributes.LastName = lastName
+		case ProfileFieldLocale:
+			attributes.Locale = p.Locale
+		case ProfileFieldCountry:
+			attributes.Country = p.Country
+		case ProfileFieldCaregiver:
+			caregiver := p.IsCaregiver()
+			attributes.Caregiver = &caregiver
+		}
+	}
+	return attributes
+}
+
+// profileAttributes returns the profile attributes of the user or empty attributes if no fields are enabled
+func (m *Connector) profileAttributes(ctx context.Context, tidepoolID string) (ProfileAttributes, error) {
+	if m.profiles == nil || len(m.config.ProfileFields) == 0 {
+		return ProfileAttributes{}, nil
+	}
+	p, err := m.profiles.GetProfile(ctx, tidepoolID)
+	if err != nil {
+		return ProfileAttributes{}, err
+	}
+	return ProfileAttributesForProfile(m.config.ProfileFields, p), nil
+}
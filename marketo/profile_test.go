@@ -0,0 +1,62 @@
+package marketo_test
+
+import (
+	"testing"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/profile"
+)
+
+func Test_ProfileAttributesForProfile(t *testing.T) {
+	caregiver := &profile.Profile{
+		FullName: "Jane Doe",
+		Locale:   "en-US",
+		Country:  "US",
+		Patient:  &profile.Patient{IsOtherPerson: true},
+	}
+	yes := true
+
+	tests := []struct {
+		name     string
+		fields   []string
+		profile  *profile.Profile
+		expected marketo.ProfileAttributes
+	}{
+		{name: "no fields enabled", fields: nil, profile: caregiver, expected: marketo.ProfileAttributes{}},
+		{name: "no profile", fields: []string{marketo.ProfileFieldFirstName}, profile: nil, expected: marketo.ProfileAttributes{}},
+		{
+			name:     "names only",
+			fields:   []string{marketo.ProfileFieldFirstName, marketo.ProfileFieldLastName},
+			profile:  caregiver,
+			expected: marketo.ProfileAttributes{FirstName: "Jane", LastName: "Doe"},
+		},
+		{
+			name:     "all fields",
+			fields:   []string{marketo.ProfileFieldFirstName, marketo.ProfileFieldLastName, marketo.ProfileFieldLocale, marketo.ProfileFieldCountry, marketo.ProfileFieldCaregiver},
+			profile:  caregiver,
+			expected: marketo.ProfileAttributes{FirstName: "Jane", LastName: "Doe", Locale: "en-US", Country: "US", Caregiver: &yes},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attributes := marketo.ProfileAttributesForProfile(tt.fields, tt.profile)
+			if attributes.FirstName != tt.expected.FirstName || attributes.LastName != tt.expected.LastName ||
+				attributes.Locale != tt.expected.Locale || attributes.Country != tt.expected.Country ||
+				(attributes.Caregiver == nil) != (tt.expected.Caregiver == nil) {
+				t.Errorf("Expected profile attributes %+v, got %+v", tt.expected, attributes)
+			}
+		})
+	}
+}
+
+func Test_Config_Validate_ProfileFields(t *testing.T) {
+	config := marketo.Config{ID: "1", URL: "https://example.com", Secret: "s", ClinicRole: "clinic", PatientRole: "patient", Timeout: 1}
+	config.ProfileFields = []string{marketo.ProfileFieldFirstName, marketo.ProfileFieldCountry}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	config.ProfileFields = []string{marketo.ProfileFieldFirstName, "diagnosisType"}
+	if err := config.Validate(); err == nil {
+		t.Error("Expected profile fields outside of the allowlist to be rejected")
+	}
+}
@@ -0,0 +1,92 @@
+package profile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// TokenProvider returns the server token used to authenticate the requests
+type TokenProvider interface {
+	TokenProvide() string
+}
+
+// Profile is the subset of the metadata profile of a user which can be synced to marketo.
+// Health data of the profile, e.g. the diagnosis and the birthday, is intentionally not decoded.
+type Profile struct {
+	FullName  string `json:"fullName"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Locale    string `json:"locale"`
+	Country   string `json:"country"`
+	// MarketingConsent is set if the user opted into or out of marketing emails
+	MarketingConsent *bool `json:"marketingConsent"`
+	// Patient describes the person whose data is managed by the account
+	Patient *Patient `json:"patient"`
+}
+
+// Patient is the subset of the patient details of a profile which can be synced to marketo
+type Patient struct {
+	// IsOtherPerson is set if the account is managed by a caregiver on behalf of a dependent
+	IsOtherPerson bool `json:"isOtherPerson"`
+}
+
+// IsCaregiver returns whether the account is managed on behalf of a dependent
+func (p *Profile) IsCaregiver() bool {
+	return p.Patient != nil && p.Patient.IsOtherPerson
+}
+
+// Names returns the first and last name of the account owner. The full name is split
+// at the first space if the profile doesn't have separate names.
+func (p *Profile) Names() (string, string) {
+	if p.FirstName != "" || p.LastName != "" {
+		return strings.TrimSpace(p.FirstName), strings.TrimSpace(p.LastName)
+	}
+	first, last, _ := strings.Cut(strings.TrimSpace(p.FullName), " ")
+	return first, strings.TrimSpace(last)
+}
+
+// Client fetches the profiles of users from the metadata service
+type Client struct {
+	host       string
+	httpClient *http.Client
+	tokens     TokenProvider
+}
+
+func NewClient(host string, httpClient *http.Client, tokens TokenProvider) *Client {
+	return &Client{
+		host:       strings.TrimSuffix(host, "/"),
+		httpClient: httpClient,
+		tokens:     tokens,
+	}
+}
+
+// GetProfile returns the profile of the user or nil if the user doesn't have a profile
+func (c *Client) GetProfile(ctx context.Context, userId string) (*Profile, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.host+"/"+url.PathEscape(userId)+"/profile", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("x-tidepool-session-token", c.tokens.TokenProvide())
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %v when fetching profile of user %v", res.StatusCode, userId)
+	}
+
+	profile := &Profile{}
+	if err := json.NewDecoder(res.Body).Decode(profile); err != nil {
+		return nil, fmt.Errorf("unable to decode profile of user %v: %w", userId, err)
+	}
+	return profile, nil
+}
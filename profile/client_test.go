@@ -0,0 +1,55 @@
+package profile_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tidepool-org/marketo-service/profile"
+)
+
+type TokenProviderMock struct{}
+
+func (t TokenProviderMock) TokenProvide() string {
+	return "server-token"
+}
+
+func Test_Client_GetProfile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-tidepool-session-token") != "server-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/1234/profile":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"fullName": "Jane van Doe", "country": "US", "patient": {"isOtherPerson": true, "fullName": "Johnny Doe", "diagnosisType": "type1", "birthday": "2015-01-01"}}`))
+		case "/5678/profile":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	client := profile.NewClient(server.URL, server.Client(), TokenProviderMock{})
+	ctx := context.Background()
+
+	result, err := client.GetProfile(ctx, "1234")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if first, last := result.Names(); first != "Jane" || last != "van Doe" {
+		t.Errorf("Expected the names of the account owner, got %q %q", first, last)
+	}
+	if !result.IsCaregiver() || result.Country != "US" {
+		t.Errorf("Expected a caregiver in the US, got %+v", result)
+	}
+
+	if result, err := client.GetProfile(ctx, "5678"); err != nil || result != nil {
+		t.Errorf("Expected no profile, got %+v, %v", result, err)
+	}
+	if _, err := client.GetProfile(ctx, "9999"); err == nil {
+		t.Error("Expected an error for an unexpected status code")
+	}
+}
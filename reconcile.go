@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/reconcile"
+)
+
+// reconcileLeads compares all Tidepool users with their marketo leads and writes
+// the drift report to stdout. Fixes are persisted in the outbox and are delivered
+// to marketo by the running service.
+func reconcileLeads(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	fix := flags.Bool("fix", false, "refresh the leads which drifted and mark orphaned leads as deleted")
+	batchSize := flags.Int("batch-size", 100, "number of users which are looked up in marketo at once")
+	if err := flags.Parse(args); err != nil {
+		log.Fatalln(err)
+	}
+
+	deps := buildDependencies()
+	defer deps.mongoStore.Disconnect(context.Background())
+
+	connector, ok := deps.marketoManager.(*marketo.Connector)
+	if !ok {
+		log.Fatalln("marketo config is invalid")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	reconciler := reconcile.NewReconciler(deps.logger, deps.mongoStore, connector, deps.clinicRelationships.GetClinicsForClinician, connector, *batchSize)
+	report, err := reconciler.Reconcile(ctx, *fix)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if encodeErr := encoder.Encode(report); encodeErr != nil {
+		log.Println(encodeErr)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,304 @@
+package reconcile
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	clinic "github.com/tidepool-org/clinic/client"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+// Drift categories
+const (
+	MissingLead     = "missingLead"
+	WrongType       = "wrongType"
+	StaleEmail      = "staleEmail"
+	OrphanedLead    = "orphanedLead"
+	UnconsentedLead = "unconsentedLead"
+)
+
+const defaultBatchSize = 100
+
+// Store provides the Tidepool users and the users which were synced to marketo
+type Store interface {
+	StreamUsers(ctx context.Context, filter *store.UsersFilter, after string, batchSize int) (store.UsersIterator, error)
+	FindUsersWithIds(ctx context.Context, ids []string) ([]*store.User, error)
+	ListSyncStates(ctx context.Context, afterUserID string, limit int) ([]*store.SyncState, error)
+}
+
+// Leads computes the expected lead attributes of users and looks up the actual leads in marketo
+type Leads interface {
+	InputForUser(ctx context.Context, tidepoolID string, user shoreline.UserData, delete bool, clinics *clinic.ClinicianClinicRelationships) (marketo.Input, error)
+	FindLeadsByUserIds(userIds []string) ([]marketo.LeadResult, error)
+}
+
+// ClinicsResolver returns the clinics of a clinician
+type ClinicsResolver func(ctx context.Context, userId string) (*clinic.ClinicianClinicRelationships, error)
+
+// Drift is a difference between a Tidepool user and their marketo lead
+type Drift struct {
+	Category string `json:"category"`
+	UserID   string `json:"userId"`
+	LeadID   int    `json:"leadId,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Fixed    bool   `json:"fixed,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Report is the result of a reconciliation
+type Report struct {
+	UsersChecked int                `json:"usersChecked"`
+	LeadsChecked int                `json:"leadsChecked"`
+	Counts       map[string]int     `json:"counts"`
+	Drifts       map[string][]Drift `json:"drifts"`
+	Fixed        int                `json:"fixed"`
+	Errors       []string           `json:"errors,omitempty"`
+}
+
+func newReport() *Report {
+	return &Report{
+		Counts: map[string]int{MissingLead: 0, WrongType: 0, StaleEmail: 0, OrphanedLead: 0, UnconsentedLead: 0},
+		Drifts: make(map[string][]Drift),
+	}
+}
+
+func (r *Report) add(drift Drift) {
+	r.Counts[drift.Category]++
+	r.Drifts[drift.Category] = append(r.Drifts[drift.Category], drift)
+	if drift.Fixed {
+		r.Fixed++
+	}
+}
+
+// Reconciler compares the Tidepool users with their marketo leads. Users which are expected to
+// have a lead are the users with a verified email who have accepted the terms, unless their
+// consent level is marketo.ConsentNone. Orphaned leads
+// are leads of synced users which no longer exist in Tidepool and are not marked as deleted.
+type Reconciler struct {
+	logger    *log.Logger
+	store     Store
+	leads     Leads
+	clinics   ClinicsResolver
+	manager   marketo.Manager
+	batchSize int
+}
+
+// NewReconciler creates a reconciler. If manager is not nil, drift can be fixed with it.
+func NewReconciler(logger *log.Logger, store Store, leads Leads, clinics ClinicsResolver, manager marketo.Manager, batchSize int) *Reconciler {
+	if batchSize <= 0 || batchSize > marketo.MaxFilterValues {
+		batchSize = defaultBatchSize
+	}
+	return &Reconciler{
+		logger:    logger,
+		store:     store,
+		leads:     leads,
+		clinics:   clinics,
+		manager:   manager,
+		batchSize: batchSize,
+	}
+}
+
+// Reconcile pages through all users and sync states and reports the drift. If fix is set,
+// the leads which drifted are refreshed and the orphaned leads are marked as deleted.
+func (r *Reconciler) Reconcile(ctx context.Context, fix bool) (*Report, error) {
+	report := newReport()
+	if err := r.reconcileUsers(ctx, fix, report); err != nil {
+		return report, err
+	}
+	if err := r.reconcileOrphans(ctx, fix, report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+func (r *Reconciler) reconcileUsers(ctx context.Context, fix bool, report *Report) error {
+	verified := true
+	filter := &store.UsersFilter{EmailVerified: &verified, TermsAccepted: &verified}
+	users, err := r.store.StreamUsers(ctx, filter, "", r.batchSize)
+	if err != nil {
+		return err
+	}
+	defer users.Close(context.Background())
+
+	batch := make([]shoreline.UserData, 0, r.batchSize)
+	for users.Next(ctx) {
+		user := users.User().UserData()
+		if !isEligible(user) {
+			continue
+		}
+		batch = append(batch, user)
+		if len(batch) == r.batchSize {
+			if err := r.reconcileBatch(ctx, batch, fix, report); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := users.Err(); err != nil {
+		return err
+	}
+	return r.reconcileBatch(ctx, batch, fix, report)
+}
+
+func (r *Reconciler) reconcileBatch(ctx context.Context, users []shoreline.UserData, fix bool, report *Report) error {
+	if len(users) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.UserID)
+	}
+	report.UsersChecked += len(ids)
+
+	leads, err := r.leads.FindLeadsByUserIds(ids)
+	if err != nil {
+		return err
+	}
+	report.LeadsChecked += len(leads)
+	leadsByUserID := make(map[string]marketo.LeadResult, len(leads))
+	for _, lead := range leads {
+		leadsByUserID[lead.TidepoolID] = lead
+	}
+
+	for _, user := range users {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r.reconcileUser(ctx, user, leadsByUserID, fix, report)
+	}
+	return nil
+}
+
+func (r *Reconciler) reconcileUser(ctx context.Context, user shoreline.UserData, leads map[string]marketo.LeadResult, fix bool, report *Report) {
+	clinics, err := r.clinics(ctx, user.UserID)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return
+	}
+	expected, err := r.leads.InputForUser(ctx, user.UserID, user, false, clinics)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return
+	}
+
+	var drifts []Drift
+	lead, ok := leads[user.UserID]
+	if expected.Consent == marketo.ConsentNone {
+		// The lead of users without consent is removed when they are synced
+		if ok {
+			drifts = append(drifts, Drift{Category: UnconsentedLead, UserID: user.UserID, LeadID: lead.ID, Actual: lead.Email})
+		}
+	} else if !ok {
+		drifts = append(drifts, Drift{Category: MissingLead, UserID: user.UserID, Expected: expected.Email})
+	} else {
+		if !strings.EqualFold(lead.UserType, expected.UserType) {
+			drifts = append(drifts, Drift{Category: WrongType, UserID: user.UserID, LeadID: lead.ID, Expected: expected.UserType, Actual: lead.UserType})
+		}
+		if !strings.EqualFold(lead.Email, expected.Email) {
+			drifts = append(drifts, Drift{Category: StaleEmail, UserID: user.UserID, LeadID: lead.ID, Expected: expected.Email, Actual: lead.Email})
+		}
+	}
+	if len(drifts) == 0 {
+		return
+	}
+
+	if fix && r.manager != nil {
+		err = r.manager.RefreshListMembershipForUser(ctx, user.UserID, user, true, clinics)
+	}
+	for _, drift := range drifts {
+		if fix && r.manager != nil {
+			if err != nil {
+				drift.Error = err.Error()
+			} else {
+				drift.Fixed = true
+			}
+		}
+		report.add(drift)
+	}
+}
+
+func (r *Reconciler) reconcileOrphans(ctx context.Context, fix bool, report *Report) error {
+	afterUserID := ""
+	for {
+		states, err := r.store.ListSyncStates(ctx, afterUserID, r.batchSize)
+		if err != nil {
+			return err
+		}
+		if len(states) == 0 {
+			return nil
+		}
+		afterUserID = states[len(states)-1].UserID
+
+		ids := make([]string, 0, len(states))
+		for _, state := range states {
+			ids = append(ids, state.UserID)
+		}
+		users, err := r.store.FindUsersWithIds(ctx, ids)
+		if err != nil {
+			return err
+		}
+		existing := make(map[string]bool, len(users))
+		for _, u := range users {
+			existing[u.Id] = true
+		}
+
+		orphans := make(map[string]*store.SyncState)
+		orphanIds := make([]string, 0)
+		for _, state := range states {
+			if !existing[state.UserID] {
+				orphans[state.UserID] = state
+				orphanIds = append(orphanIds, state.UserID)
+			}
+		}
+		leads, err := r.leads.FindLeadsByUserIds(orphanIds)
+		if err != nil {
+			return err
+		}
+		for _, lead := range leads {
+			if lead.DeletedAccount {
+				continue
+			}
+			state, ok := orphans[lead.TidepoolID]
+			if !ok {
+				continue
+			}
+			drift := Drift{Category: OrphanedLead, UserID: lead.TidepoolID, LeadID: lead.ID, Actual: lead.Email}
+			if fix && r.manager != nil {
+				if err := r.deleteLead(ctx, state, lead); err != nil {
+					drift.Error = err.Error()
+				} else {
+					drift.Fixed = true
+				}
+			}
+			report.add(drift)
+		}
+	}
+}
+
+// deleteLead marks the lead of a user which no longer exists as deleted
+func (r *Reconciler) deleteLead(ctx context.Context, state *store.SyncState, lead marketo.LeadResult) error {
+	email := state.Email
+	if email == "" {
+		email = lead.Email
+	}
+	user := shoreline.UserData{
+		UserID:   state.UserID,
+		Username: email,
+		Emails:   []string{email},
+	}
+	return r.manager.UpdateListMembershipForUser(ctx, state.UserID, user, user, true, nil)
+}
+
+// isEligible returns true if the user is expected to have a lead in marketo
+func isEligible(user shoreline.UserData) bool {
+	email := strings.ToLower(user.Username)
+	if email == "" || strings.HasSuffix(email, "@tidepool.io") || strings.HasSuffix(email, "@tidepool.org") {
+		return false
+	}
+	return user.EmailVerified && user.TermsAccepted != ""
+}
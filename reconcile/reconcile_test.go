@@ -0,0 +1,159 @@
+package reconcile_test
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+
+	clinic "github.com/tidepool-org/clinic/client"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/reconcile"
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+type LeadsMock struct {
+	Leads   []marketo.LeadResult
+	Consent map[string]marketo.ConsentLevel
+}
+
+func (l *LeadsMock) InputForUser(ctx context.Context, tidepoolID string, user shoreline.UserData, delete bool, clinics *clinic.ClinicianClinicRelationships) (marketo.Input, error) {
+	consent, ok := l.Consent[tidepoolID]
+	if !ok {
+		consent = marketo.ConsentFull
+	}
+	return marketo.Input{TidepoolID: tidepoolID, Email: user.Username, UserType: "patient", Consent: consent}, nil
+}
+
+func (l *LeadsMock) FindLeadsByUserIds(userIds []string) ([]marketo.LeadResult, error) {
+	var results []marketo.LeadResult
+	for _, lead := range l.Leads {
+		for _, id := range userIds {
+			if lead.TidepoolID == id {
+				results = append(results, lead)
+			}
+		}
+	}
+	return results, nil
+}
+
+type ManagerMock struct {
+	marketo.Manager
+	Refreshed []string
+	Deleted   []string
+}
+
+func (m *ManagerMock) RefreshListMembershipForUser(ctx context.Context, tidepoolID string, user shoreline.UserData, force bool, clinics *clinic.ClinicianClinicRelationships) error {
+	m.Refreshed = append(m.Refreshed, tidepoolID)
+	return nil
+}
+
+func (m *ManagerMock) UpdateListMembershipForUser(ctx context.Context, tidepoolID string, oldUser shoreline.UserData, newUser shoreline.UserData, delete bool, clinics *clinic.ClinicianClinicRelationships) error {
+	if delete {
+		m.Deleted = append(m.Deleted, tidepoolID)
+	}
+	return nil
+}
+
+func noClinics(ctx context.Context, userId string) (*clinic.ClinicianClinicRelationships, error) {
+	return &clinic.ClinicianClinicRelationships{}, nil
+}
+
+func Test_Reconcile(t *testing.T) {
+	ctx := context.Background()
+	users := store.NewMemoryStore()
+	for _, user := range []*store.User{
+		{Id: "1", Username: "in-sync@example.com", EmailVerified: true, TermsAccepted: "2020-01-01"},
+		{Id: "2", Username: "missing@example.com", EmailVerified: true, TermsAccepted: "2020-01-01"},
+		{Id: "3", Username: "wrong-type@example.com", EmailVerified: true, TermsAccepted: "2020-01-01"},
+		{Id: "4", Username: "new-email@example.com", EmailVerified: true, TermsAccepted: "2020-01-01"},
+		{Id: "5", Username: "unverified@example.com", TermsAccepted: "2020-01-01"},
+	} {
+		_ = users.UpsertUser(ctx, user)
+	}
+	for _, state := range []*store.SyncState{
+		{UserID: "1", Email: "in-sync@example.com"},
+		{UserID: "6", Email: "orphan@example.com"},
+		{UserID: "7", Email: "deleted@example.com"},
+	} {
+		_ = users.UpsertSyncState(ctx, state)
+	}
+	leads := &LeadsMock{
+		Leads: []marketo.LeadResult{
+			{ID: 11, TidepoolID: "1", Email: "in-sync@example.com", UserType: "patient"},
+			{ID: 13, TidepoolID: "3", Email: "wrong-type@example.com", UserType: "clinic"},
+			{ID: 14, TidepoolID: "4", Email: "old-email@example.com", UserType: "patient"},
+			{ID: 16, TidepoolID: "6", Email: "orphan@example.com", UserType: "patient"},
+			{ID: 17, TidepoolID: "7", Email: "deleted@example.com", UserType: "patient", DeletedAccount: true},
+		},
+	}
+	manager := &ManagerMock{}
+	logger := log.New(os.Stdout, "reconcile-test", log.LstdFlags)
+	reconciler := reconcile.NewReconciler(logger, users, leads, noClinics, manager, 2)
+
+	report, err := reconciler.Reconcile(ctx, true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if report.UsersChecked != 4 {
+		t.Errorf("Expected 4 checked users, got %d", report.UsersChecked)
+	}
+	expected := map[string]string{
+		reconcile.MissingLead:  "2",
+		reconcile.WrongType:    "3",
+		reconcile.StaleEmail:   "4",
+		reconcile.OrphanedLead: "6",
+	}
+	for category, userId := range expected {
+		drifts := report.Drifts[category]
+		if len(drifts) != 1 || drifts[0].UserID != userId || !drifts[0].Fixed {
+			t.Errorf("Expected fixed %s drift of user %s, got %v", category, userId, drifts)
+		}
+	}
+	if report.Fixed != 4 {
+		t.Errorf("Expected 4 fixes, got %d", report.Fixed)
+	}
+	if len(manager.Refreshed) != 3 {
+		t.Errorf("Expected 3 refreshed users, got %v", manager.Refreshed)
+	}
+	if len(manager.Deleted) != 1 || manager.Deleted[0] != "6" {
+		t.Errorf("Expected orphaned lead of user 6 to be deleted, got %v", manager.Deleted)
+	}
+}
+
+func Test_Reconcile_Users_Without_Consent(t *testing.T) {
+	ctx := context.Background()
+	users := store.NewMemoryStore()
+	for _, user := range []*store.User{
+		{Id: "1", Username: "removed@example.com", EmailVerified: true, TermsAccepted: "2020-01-01"},
+		{Id: "2", Username: "remaining@example.com", EmailVerified: true, TermsAccepted: "2020-01-01"},
+	} {
+		_ = users.UpsertUser(ctx, user)
+	}
+	leads := &LeadsMock{
+		Leads: []marketo.LeadResult{
+			{ID: 12, TidepoolID: "2", Email: "remaining@example.com", UserType: "patient"},
+		},
+		Consent: map[string]marketo.ConsentLevel{"1": marketo.ConsentNone, "2": marketo.ConsentNone},
+	}
+	manager := &ManagerMock{}
+	logger := log.New(os.Stdout, "reconcile-test", log.LstdFlags)
+	reconciler := reconcile.NewReconciler(logger, users, leads, noClinics, manager, 2)
+
+	report, err := reconciler.Reconcile(ctx, true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if report.Counts[reconcile.MissingLead] != 0 {
+		t.Errorf("Expected no missing leads, got %v", report.Drifts[reconcile.MissingLead])
+	}
+	drifts := report.Drifts[reconcile.UnconsentedLead]
+	if len(drifts) != 1 || drifts[0].UserID != "2" || drifts[0].LeadID != 12 || !drifts[0].Fixed {
+		t.Errorf("Expected fixed unconsented lead of user 2, got %v", drifts)
+	}
+	if len(manager.Refreshed) != 1 || manager.Refreshed[0] != "2" {
+		t.Errorf("Expected user 2 to be refreshed, got %v", manager.Refreshed)
+	}
+}
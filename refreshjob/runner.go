@@ -0,0 +1,250 @@
+package refreshjob
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidepool-org/marketo-service/backfill"
+	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+const (
+	defaultLease    = time.Minute
+	defaultAttempts = 3
+)
+
+// Config is the env config of the refresh jobs runner
+type Config struct {
+	PollInterval time.Duration `envconfig:"MARKETO_REFRESH_JOBS_POLL_INTERVAL" default:"10s"`
+	BatchSize    int           `envconfig:"MARKETO_REFRESH_JOBS_BATCH_SIZE" default:"100"`
+	Concurrency  int           `envconfig:"MARKETO_REFRESH_JOBS_CONCURRENCY" default:"4"`
+	// Rate is the max number of users refreshed per second by each job
+	Rate float64 `envconfig:"MARKETO_REFRESH_JOBS_RATE" default:"10"`
+	// Attempts is the number of times a job which fails partway is run before it's marked as failed
+	Attempts int `envconfig:"MARKETO_REFRESH_JOBS_ATTEMPTS" default:"3"`
+	// Lease is the time a job is locked by a runner, the lease is renewed while the job is running
+	Lease time.Duration `envconfig:"MARKETO_REFRESH_JOBS_LEASE" default:"1m"`
+}
+
+// Store persists the jobs, their results and the progress of the users iteration
+type Store interface {
+	backfill.Store
+	store.RefreshJobRepository
+}
+
+// CheckpointName returns the name of the checkpoint which tracks the progress of the job
+func CheckpointName(job *store.RefreshJob) string {
+	return "refresh-job-" + job.ID.Hex()
+}
+
+// Runner processes the pending refresh jobs one at a time. Jobs which were interrupted by a
+// restart or which failed partway are resumed from their checkpoint by any runner once their
+// lease expires.
+type Runner struct {
+	logger    *log.Logger
+	store     Store
+	refresher backfill.Refresher
+	config    Config
+	owner     string
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+func NewRunner(logger *log.Logger, store Store, refresher backfill.Refresher, config Config) *Runner {
+	owner := make([]byte, 8)
+	_, _ = rand.Read(owner)
+	if config.Attempts <= 0 {
+		config.Attempts = defaultAttempts
+	}
+	if config.Lease <= 0 {
+		config.Lease = defaultLease
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Runner{
+		logger:    logger,
+		store:     store,
+		refresher: refresher,
+		config:    config,
+		owner:     hex.EncodeToString(owner),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Start polls for unfinished jobs until the runner is stopped
+func (r *Runner) Start() error {
+	r.wg.Add(1)
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := r.RunUnfinished(r.ctx); err != nil && r.ctx.Err() == nil {
+			r.logger.Printf("unable to run refresh jobs: %v", err)
+		}
+		select {
+		case <-r.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop interrupts the running job and waits for its state to be saved
+func (r *Runner) Stop() error {
+	r.cancel()
+	r.wg.Wait()
+	return nil
+}
+
+// RunUnfinished runs the pending and interrupted jobs which are not locked by other runners
+func (r *Runner) RunUnfinished(ctx context.Context) error {
+	jobs, err := r.store.FindUnfinishedRefreshJobs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			return nil
+		}
+		claimed, err := r.store.ClaimRefreshJob(ctx, job.ID, r.owner, time.Now().Add(r.config.Lease))
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+		if err := r.run(ctx, job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Runner) run(ctx context.Context, job *store.RefreshJob) error {
+	now := time.Now()
+	job.Status = store.RefreshJobStatusRunning
+	job.Owner = r.owner
+	job.LockedUntil = now.Add(r.config.Lease)
+	if job.StartedTime == nil {
+		job.StartedTime = &now
+	}
+	if err := r.store.UpdateRefreshJob(ctx, job); err != nil {
+		return err
+	}
+
+	// The job is interrupted if its lease is lost, so it's never run by two runners at the same time
+	jobCtx, cancel := context.WithCancel(marketo.ContextWithSource(ctx, store.AuditSource{
+		Type: store.AuditSourceRefreshJob,
+		Name: job.ID.Hex(),
+	}))
+	defer cancel()
+	done := make(chan struct{})
+	lost := &atomic.Bool{}
+	go r.renewLease(jobCtx, job, done, lost, cancel)
+
+	r.logger.Printf("running refresh job %s", job.ID.Hex())
+	recorder := &resultRecorder{logger: r.logger, store: r.store, refresher: r.refresher, job: job}
+	_, err := backfill.NewBackfill(r.logger, r.store, recorder, backfill.Config{
+		Name:        CheckpointName(job),
+		Filter:      job.Filter,
+		BatchSize:   r.config.BatchSize,
+		Concurrency: r.config.Concurrency,
+		Rate:        r.config.Rate,
+		Force:       job.Force,
+	}).Run(jobCtx)
+	close(done)
+
+	if lost.Load() {
+		// The job is owned by another runner, which resumes it from the checkpoint
+		r.logger.Printf("refresh job %s was interrupted after its lease was lost", job.ID.Hex())
+		return nil
+	}
+
+	// Release the job, so it can be resumed as soon as the service is restarted
+	job.Owner = ""
+	job.LockedUntil = time.Time{}
+	switch {
+	case err != nil && ctx.Err() != nil:
+		r.logger.Printf("refresh job %s was interrupted, it will be resumed from its checkpoint", job.ID.Hex())
+		job.Status = store.RefreshJobStatusPending
+	case err != nil:
+		job.Attempts++
+		job.Error = err.Error()
+		if job.Attempts < r.config.Attempts {
+			r.logger.Printf("refresh job %s failed, it will be resumed from its checkpoint: %v", job.ID.Hex(), err)
+			job.Status = store.RefreshJobStatusPending
+			break
+		}
+		r.logger.Printf("refresh job %s failed after %d attempts: %v", job.ID.Hex(), job.Attempts, err)
+		completed := time.Now()
+		job.CompletedTime = &completed
+		job.Status = store.RefreshJobStatusFailed
+	default:
+		r.logger.Printf("refresh job %s completed", job.ID.Hex())
+		completed := time.Now()
+		job.CompletedTime = &completed
+		job.Status = store.RefreshJobStatusCompleted
+		job.Error = ""
+	}
+	return r.store.UpdateRefreshJob(context.Background(), job)
+}
+
+// renewLease extends the lease of the job while it's running. If the job was claimed by another
+// runner in the meantime, the job is interrupted.
+func (r *Runner) renewLease(ctx context.Context, job *store.RefreshJob, done chan struct{}, lost *atomic.Bool, interrupt context.CancelFunc) {
+	ticker := time.NewTicker(r.config.Lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-ticker.C:
+			claimed, err := r.store.ClaimRefreshJob(ctx, job.ID, r.owner, time.Now().Add(r.config.Lease))
+			if err != nil {
+				r.logger.Printf("unable to renew the lease of refresh job %s: %v", job.ID.Hex(), err)
+				continue
+			}
+			if !claimed {
+				r.logger.Printf("ERROR: lost the lease of refresh job %s", job.ID.Hex())
+				lost.Store(true)
+				interrupt()
+				return
+			}
+		}
+	}
+}
+
+// resultRecorder records the result of each refreshed user
+type resultRecorder struct {
+	logger    *log.Logger
+	store     store.RefreshJobRepository
+	refresher backfill.Refresher
+	job       *store.RefreshJob
+}
+
+func (r *resultRecorder) RefreshUser(ctx context.Context, userId string, force bool) error {
+	err := r.refresher.RefreshUser(ctx, userId, force)
+	result := &store.RefreshJobResult{
+		JobID:  r.job.ID,
+		UserID: userId,
+		Status: store.RefreshResultStatusRefreshed,
+	}
+	if err != nil {
+		result.Status = store.RefreshResultStatusFailed
+		result.Error = err.Error()
+	}
+	if upsertErr := r.store.UpsertRefreshJobResult(ctx, result); upsertErr != nil {
+		r.logger.Printf("unable to save the result of user %v in refresh job %s: %v", userId, r.job.ID.Hex(), upsertErr)
+	}
+	return err
+}
@@ -0,0 +1,230 @@
+package refreshjob_test
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidepool-org/marketo-service/marketo"
+	"github.com/tidepool-org/marketo-service/refreshjob"
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+type RefresherMock struct {
+	mu        sync.Mutex
+	Refreshed []string
+	Failing   map[string]bool
+	Sources   []store.AuditSource
+	// OnRefresh is called before a user is refreshed
+	OnRefresh func(ctx context.Context, userId string)
+}
+
+func (r *RefresherMock) RefreshUser(ctx context.Context, userId string, force bool) error {
+	if r.OnRefresh != nil {
+		r.OnRefresh(ctx, userId)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Refreshed = append(r.Refreshed, userId)
+	r.Sources = append(r.Sources, marketo.SourceFromContext(ctx))
+	if r.Failing[userId] {
+		return errors.New("refresh failed")
+	}
+	return nil
+}
+
+// StoreMock fails the given number of checkpoint updates
+type StoreMock struct {
+	*store.MemoryStore
+	mu                sync.Mutex
+	FailedCheckpoints int
+}
+
+func (s *StoreMock) UpsertCheckpoint(ctx context.Context, checkpoint *store.Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.FailedCheckpoints > 0 {
+		s.FailedCheckpoints--
+		return errors.New("checkpoint failed")
+	}
+	return s.MemoryStore.UpsertCheckpoint(ctx, checkpoint)
+}
+
+func createJob(t *testing.T, memoryStore *store.MemoryStore, userIds ...string) *store.RefreshJob {
+	ctx := context.Background()
+	for _, id := range userIds {
+		_ = memoryStore.UpsertUser(ctx, &store.User{Id: id})
+	}
+	job := &store.RefreshJob{Filter: store.UsersFilter{UserIDs: userIds}}
+	if err := memoryStore.CreateRefreshJob(ctx, job); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return job
+}
+
+func Test_Runner_Completes_Jobs(t *testing.T) {
+	logger := log.New(os.Stdout, "refresh-job-test", log.LstdFlags)
+	ctx := context.Background()
+	memoryStore := store.NewMemoryStore()
+	for _, id := range []string{"1", "2", "3", "4"} {
+		_ = memoryStore.UpsertUser(ctx, &store.User{Id: id})
+	}
+	job := &store.RefreshJob{Filter: store.UsersFilter{UserIDs: []string{"1", "2", "3"}}}
+	if err := memoryStore.CreateRefreshJob(ctx, job); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	refresher := &RefresherMock{Failing: map[string]bool{"2": true}}
+	config := refreshjob.Config{BatchSize: 2, Concurrency: 2}
+	if err := refreshjob.NewRunner(logger, memoryStore, refresher, config).RunUnfinished(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(refresher.Refreshed) != 3 {
+		t.Errorf("Expected users 1 to 3 to be refreshed, got %v", refresher.Refreshed)
+	}
+
+	for _, source := range refresher.Sources {
+		if source.Type != store.AuditSourceRefreshJob || source.Name != job.ID.Hex() {
+			t.Errorf("Expected the refreshes to be attributed to job %s, got %+v", job.ID.Hex(), source)
+		}
+	}
+
+	job, _ = memoryStore.FindRefreshJob(ctx, job.ID)
+	if job.Status != store.RefreshJobStatusCompleted || job.CompletedTime == nil {
+		t.Errorf("Expected the job to be completed, got %+v", job)
+	}
+	failed, _ := memoryStore.FindRefreshJobResults(ctx, job.ID, store.RefreshResultStatusFailed, 0, 10)
+	if len(failed) != 1 || failed[0].UserID != "2" || failed[0].Error == "" {
+		t.Errorf("Expected user 2 to have failed, got %+v", failed)
+	}
+	if refreshed, _ := memoryStore.CountRefreshJobResults(ctx, job.ID, store.RefreshResultStatusRefreshed); refreshed != 2 {
+		t.Errorf("Expected 2 refreshed users, got %v", refreshed)
+	}
+
+	// Finished jobs are not run again
+	refresher = &RefresherMock{}
+	if err := refreshjob.NewRunner(logger, memoryStore, refresher, config).RunUnfinished(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(refresher.Refreshed) != 0 {
+		t.Errorf("Expected no refreshed users, got %v", refresher.Refreshed)
+	}
+}
+
+func Test_Runner_Resumes_Interrupted_Jobs(t *testing.T) {
+	logger := log.New(os.Stdout, "refresh-job-test", log.LstdFlags)
+	memoryStore := store.NewMemoryStore()
+	job := createJob(t, memoryStore, "1", "2", "3", "4")
+	config := refreshjob.Config{BatchSize: 2, Concurrency: 1}
+
+	// The service is stopped while the second batch is refreshed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	refresher := &RefresherMock{OnRefresh: func(_ context.Context, userId string) {
+		if userId == "3" {
+			cancel()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}}
+	if err := refreshjob.NewRunner(logger, memoryStore, refresher, config).RunUnfinished(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	interrupted, _ := memoryStore.FindRefreshJob(context.Background(), job.ID)
+	if interrupted.Status != store.RefreshJobStatusPending || interrupted.Owner != "" || interrupted.CompletedTime != nil {
+		t.Errorf("Expected the interrupted job to be pending and released, got %+v", interrupted)
+	}
+
+	// The job is resumed from the checkpoint of the first batch
+	refresher = &RefresherMock{}
+	if err := refreshjob.NewRunner(logger, memoryStore, refresher, config).RunUnfinished(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sort.Strings(refresher.Refreshed)
+	if len(refresher.Refreshed) != 2 || refresher.Refreshed[0] != "3" || refresher.Refreshed[1] != "4" {
+		t.Errorf("Expected users 3 and 4 to be refreshed, got %v", refresher.Refreshed)
+	}
+	resumed, _ := memoryStore.FindRefreshJob(context.Background(), job.ID)
+	if resumed.Status != store.RefreshJobStatusCompleted {
+		t.Errorf("Expected the resumed job to be completed, got %+v", resumed)
+	}
+}
+
+func Test_Runner_Stops_Jobs_After_Losing_The_Lease(t *testing.T) {
+	logger := log.New(os.Stdout, "refresh-job-test", log.LstdFlags)
+	ctx := context.Background()
+	memoryStore := store.NewMemoryStore()
+	job := createJob(t, memoryStore, "1", "2", "3", "4")
+
+	// The job is claimed by another runner while the first user is refreshed
+	refresher := &RefresherMock{OnRefresh: func(ctx context.Context, userId string) {
+		if userId != "1" {
+			return
+		}
+		claimed, _ := memoryStore.FindRefreshJob(context.Background(), job.ID)
+		claimed.Owner = "other"
+		claimed.LockedUntil = time.Now().Add(time.Hour)
+		_ = memoryStore.UpdateRefreshJob(context.Background(), claimed)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Errorf("Expected the job to be interrupted")
+		}
+	}}
+	config := refreshjob.Config{BatchSize: 1, Concurrency: 1, Lease: 30 * time.Millisecond}
+	if err := refreshjob.NewRunner(logger, memoryStore, refresher, config).RunUnfinished(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(refresher.Refreshed) != 1 {
+		t.Errorf("Expected only user 1 to be refreshed, got %v", refresher.Refreshed)
+	}
+	claimed, _ := memoryStore.FindRefreshJob(ctx, job.ID)
+	if claimed.Status != store.RefreshJobStatusRunning || claimed.Owner != "other" {
+		t.Errorf("Expected the job to be left to the other runner, got %+v", claimed)
+	}
+}
+
+func Test_Runner_Resumes_Failed_Jobs(t *testing.T) {
+	logger := log.New(os.Stdout, "refresh-job-test", log.LstdFlags)
+	ctx := context.Background()
+	memoryStore := store.NewMemoryStore()
+	job := createJob(t, memoryStore, "1", "2", "3", "4")
+	failingStore := &StoreMock{MemoryStore: memoryStore, FailedCheckpoints: 1}
+	config := refreshjob.Config{BatchSize: 2, Concurrency: 1, Attempts: 2}
+
+	// The first attempt fails after the first batch
+	refresher := &RefresherMock{}
+	if err := refreshjob.NewRunner(logger, failingStore, refresher, config).RunUnfinished(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	failed, _ := memoryStore.FindRefreshJob(ctx, job.ID)
+	if failed.Status != store.RefreshJobStatusPending || failed.Attempts != 1 || failed.Error == "" {
+		t.Errorf("Expected the job to be pending after the first attempt, got %+v", failed)
+	}
+
+	// The second attempt completes the job
+	if err := refreshjob.NewRunner(logger, failingStore, refresher, config).RunUnfinished(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	completed, _ := memoryStore.FindRefreshJob(ctx, job.ID)
+	if completed.Status != store.RefreshJobStatusCompleted || completed.Error != "" {
+		t.Errorf("Expected the job to be completed after the second attempt, got %+v", completed)
+	}
+
+	// The job is failed when each attempt fails
+	job = createJob(t, memoryStore, "5")
+	failingStore.FailedCheckpoints = 2
+	for i := 0; i < 2; i++ {
+		if err := refreshjob.NewRunner(logger, failingStore, &RefresherMock{}, config).RunUnfinished(ctx); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	failed, _ = memoryStore.FindRefreshJob(ctx, job.ID)
+	if failed.Status != store.RefreshJobStatusFailed || failed.Attempts != 2 || failed.CompletedTime == nil {
+		t.Errorf("Expected the job to be failed after 2 attempts, got %+v", failed)
+	}
+}
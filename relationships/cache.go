@@ -0,0 +1,70 @@
+package relationships
+
+import (
+	"sync"
+	"time"
+)
+
+// maxCacheEntries bounds the size of a cache, expired entries are evicted when it's reached
+const maxCacheEntries = 10000
+
+type cacheEntry[T any] struct {
+	value     T
+	expiresAt time.Time
+}
+
+// ttlCache is a size bounded cache whose entries expire after the TTL. Nothing is cached if the TTL is zero.
+type ttlCache[T any] struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry[T]
+}
+
+func newTTLCache[T any](ttl time.Duration) *ttlCache[T] {
+	return &ttlCache[T]{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]cacheEntry[T]),
+	}
+}
+
+func (c *ttlCache[T]) get(key string) (T, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || !c.now().Before(entry.expiresAt) {
+		delete(c.entries, key)
+		var zero T
+		return zero, false
+	}
+	return entry.value, true
+}
+
+func (c *ttlCache[T]) set(key string, value T) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if len(c.entries) >= maxCacheEntries {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCacheEntries {
+			c.entries = make(map[string]cacheEntry[T])
+		}
+	}
+	c.entries[key] = cacheEntry[T]{value: value, expiresAt: now.Add(c.ttl)}
+}
+
+func (c *ttlCache[T]) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
@@ -0,0 +1,154 @@
+package relationships
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	clinic "github.com/tidepool-org/clinic/client"
+)
+
+// PageSize is the number of relationships fetched with each request
+const PageSize = 1000
+
+// Config is the env config of the resolver
+type Config struct {
+	// CacheTTL is the time the relationships of a user are cached, caching is disabled if it's zero
+	CacheTTL time.Duration `envconfig:"MARKETO_CLINICS_CACHE_TTL" default:"1m"`
+}
+
+// Resolver returns the clinics a user is a member or a patient of. The relationships are fetched
+// from the clinic service and cached for the configured TTL. The cache is local to the process,
+// entries are invalidated when clinician, patient and clinic change events are received.
+type Resolver struct {
+	clinics clinic.ClientWithResponsesInterface
+
+	clinicians *ttlCache[*clinic.ClinicianClinicRelationships]
+	patients   *ttlCache[*clinic.PatientClinicRelationships]
+	details    *ttlCache[clinic.Clinic]
+}
+
+func NewResolver(clinics clinic.ClientWithResponsesInterface, config Config) *Resolver {
+	return &Resolver{
+		clinics:    clinics,
+		clinicians: newTTLCache[*clinic.ClinicianClinicRelationships](config.CacheTTL),
+		patients:   newTTLCache[*clinic.PatientClinicRelationships](config.CacheTTL),
+		details:    newTTLCache[clinic.Clinic](config.CacheTTL),
+	}
+}
+
+// GetClinicsForClinician returns all clinics the user is a member of with the details of each clinic.
+// Users who aren't clinicians don't have any clinics.
+func (r *Resolver) GetClinicsForClinician(ctx context.Context, userId string) (*clinic.ClinicianClinicRelationships, error) {
+	if clinics, ok := r.clinicians.get(userId); ok {
+		return clinics, nil
+	}
+
+	clinics := make(clinic.ClinicianClinicRelationships, 0)
+	limit := clinic.Limit(PageSize)
+	for offset := 0; ; offset += PageSize {
+		params := &clinic.ListClinicsForClinicianParams{
+			Offset: &offset,
+			Limit:  &limit,
+		}
+		response, err := r.clinics.ListClinicsForClinicianWithResponse(ctx, clinic.UserId(userId), params)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode() == http.StatusNotFound {
+			break
+		}
+		if response.StatusCode() != http.StatusOK || response.JSON200 == nil {
+			return nil, fmt.Errorf("unexpected status code %v when fetching clinics for user %v", response.StatusCode(), userId)
+		}
+		clinics = append(clinics, *response.JSON200...)
+		if len(*response.JSON200) < PageSize {
+			break
+		}
+	}
+
+	for i := range clinics {
+		details, err := r.getClinic(ctx, clinics[i].Clinic)
+		if err != nil {
+			return nil, err
+		}
+		clinics[i].Clinic = details
+	}
+
+	r.clinicians.set(userId, &clinics)
+	return &clinics, nil
+}
+
+// GetClinicsForPatient returns all clinics the user is a patient of. Users who aren't patients of a clinic don't have any clinics.
+func (r *Resolver) GetClinicsForPatient(ctx context.Context, userId string) (*clinic.PatientClinicRelationships, error) {
+	if clinics, ok := r.patients.get(userId); ok {
+		return clinics, nil
+	}
+
+	clinics := make(clinic.PatientClinicRelationships, 0)
+	limit := clinic.Limit(PageSize)
+	for offset := 0; ; offset += PageSize {
+		params := &clinic.ListClinicsForPatientParams{
+			Offset: &offset,
+			Limit:  &limit,
+		}
+		response, err := r.clinics.ListClinicsForPatientWithResponse(ctx, clinic.UserId(userId), params)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode() == http.StatusNotFound {
+			break
+		}
+		if response.StatusCode() != http.StatusOK || response.JSON200 == nil {
+			return nil, fmt.Errorf("unexpected status code %v when fetching clinics of patient %v", response.StatusCode(), userId)
+		}
+		clinics = append(clinics, *response.JSON200...)
+		if len(*response.JSON200) < PageSize {
+			break
+		}
+	}
+
+	r.patients.set(userId, &clinics)
+	return &clinics, nil
+}
+
+// getClinic returns the details of the clinic. The clinic of the relationship is returned if it no longer exists.
+func (r *Resolver) getClinic(ctx context.Context, summary clinic.Clinic) (clinic.Clinic, error) {
+	if summary.Id == nil || *summary.Id == "" {
+		return summary, nil
+	}
+	clinicId := *summary.Id
+	if details, ok := r.details.get(clinicId); ok {
+		return details, nil
+	}
+
+	response, err := r.clinics.GetClinicWithResponse(ctx, clinic.ClinicId(clinicId))
+	if err != nil {
+		return summary, err
+	}
+	if response.StatusCode() == http.StatusNotFound {
+		return summary, nil
+	}
+	if response.StatusCode() != http.StatusOK || response.JSON200 == nil {
+		return summary, fmt.Errorf("unexpected status code %v when fetching clinic %v", response.StatusCode(), clinicId)
+	}
+
+	r.details.set(clinicId, *response.JSON200)
+	return *response.JSON200, nil
+}
+
+// Invalidate removes the cached clinician relationships of the user
+func (r *Resolver) Invalidate(userId string) {
+	r.clinicians.remove(userId)
+}
+
+// InvalidatePatient removes the cached patient relationships of the user
+func (r *Resolver) InvalidatePatient(userId string) {
+	r.patients.remove(userId)
+}
+
+// InvalidateClinic removes the cached details of the clinic
+func (r *Resolver) InvalidateClinic(clinicId string) {
+	r.details.remove(clinicId)
+}
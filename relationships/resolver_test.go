@@ -0,0 +1,117 @@
+package relationships_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clinic "github.com/tidepool-org/clinic/client"
+
+	"github.com/tidepool-org/marketo-service/relationships"
+)
+
+// ClinicsServer returns 1500 clinics for user 1234 and 404 for all other users. Only the
+// requests of the relationships are counted.
+func ClinicsServer(t *testing.T, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v1/clinics/") {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":               strings.TrimPrefix(r.URL.Path, "/v1/clinics/"),
+				"name":             "Clinic",
+				"tier":             "tier0200",
+				"preferredBgUnits": "mg/dL",
+			})
+			return
+		}
+		atomic.AddInt32(requests, 1)
+		if r.URL.Path != "/v1/clinicians/1234/clinics" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		page := make([]map[string]interface{}, 0)
+		for i := offset; i < offset+limit && i < 1500; i++ {
+			page = append(page, map[string]interface{}{
+				"clinic":    map[string]interface{}{"id": fmt.Sprintf("%024d", i), "name": fmt.Sprintf("Clinic %d", i)},
+				"clinician": map[string]interface{}{"id": "1234", "email": "clinician@example.com", "roles": []string{"CLINIC_MEMBER"}},
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(page)
+	}))
+}
+
+func Test_Resolver_GetClinicsForClinician(t *testing.T) {
+	var requests int32
+	server := ClinicsServer(t, &requests)
+	defer server.Close()
+	clinics, _ := clinic.NewClientWithResponses(server.URL)
+	ctx := context.Background()
+
+	tests := []struct {
+		name             string
+		userId           string
+		expectedClinics  int
+		expectedRequests int32
+	}{
+		{name: "clinician with multiple pages", userId: "1234", expectedClinics: 1500, expectedRequests: 2},
+		{name: "user who isn't a clinician", userId: "5678", expectedClinics: 0, expectedRequests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+			resolver := relationships.NewResolver(clinics, relationships.Config{CacheTTL: time.Hour})
+			for i := 0; i < 2; i++ {
+				result, err := resolver.GetClinicsForClinician(ctx, tt.userId)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if len(*result) != tt.expectedClinics {
+					t.Errorf("Expected %v clinics, got %v", tt.expectedClinics, len(*result))
+				}
+				for _, relationship := range *result {
+					if relationship.Clinic.Tier == nil || *relationship.Clinic.Tier != "tier0200" {
+						t.Fatalf("Expected the details of clinic %v, got %+v", *relationship.Clinic.Id, relationship.Clinic)
+					}
+				}
+			}
+			if atomic.LoadInt32(&requests) != tt.expectedRequests {
+				t.Errorf("Expected the second lookup to be cached with %v requests, got %v", tt.expectedRequests, requests)
+			}
+
+			resolver.Invalidate(tt.userId)
+			if _, err := resolver.GetClinicsForClinician(ctx, tt.userId); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if atomic.LoadInt32(&requests) != 2*tt.expectedRequests {
+				t.Errorf("Expected the relationships to be fetched again after invalidation, got %v requests", requests)
+			}
+		})
+	}
+}
+
+func Test_Resolver_Without_Cache(t *testing.T) {
+	var requests int32
+	server := ClinicsServer(t, &requests)
+	defer server.Close()
+	clinics, _ := clinic.NewClientWithResponses(server.URL)
+
+	resolver := relationships.NewResolver(clinics, relationships.Config{})
+	for i := 0; i < 2; i++ {
+		if _, err := resolver.GetClinicsForClinician(context.Background(), "5678"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("Expected 2 requests, got %v", requests)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/tidepool-org/go-common/events"
+	"github.com/tidepool-org/marketo-service/deadletter"
+	"github.com/tidepool-org/marketo-service/handler"
+	"github.com/tidepool-org/marketo-service/marketo"
+)
+
+const (
+	keycloakUsersConsumerName = "keycloak-users"
+	keycloakRolesConsumerName = "keycloak-roles"
+	userEventsConsumerName    = "user-events"
+	cliniciansConsumerName    = "clinicians"
+	clinicsConsumerName       = "clinics"
+	patientsConsumerName      = "patients"
+)
+
+// replayDeadLetters reads the dead-letter topic of a consumer and hands the matching
+// messages back to the consumer. Mutations are persisted in the outbox and are delivered
+// to marketo by the running service.
+func replayDeadLetters(args []string) {
+	flags := flag.NewFlagSet("replay-dlq", flag.ExitOnError)
+	consumerName := flags.String("consumer", keycloakUsersConsumerName, fmt.Sprintf("consumer of the replayed messages: %s, %s, %s, %s, %s or %s", keycloakUsersConsumerName, keycloakRolesConsumerName, userEventsConsumerName, cliniciansConsumerName, clinicsConsumerName, patientsConsumerName))
+	topic := flags.String("topic", "", "dead-letter topic, defaults to the dead-letter topic of the consumer")
+	startOffset := flags.Int64("start-offset", -1, "first offset to replay in each partition")
+	endOffset := flags.Int64("end-offset", -1, "last offset to replay in each partition")
+	startTime := flags.String("start-time", "", "replay messages dead-lettered at or after this RFC3339 time")
+	endTime := flags.String("end-time", "", "replay messages dead-lettered before this RFC3339 time")
+	userId := flags.String("user-id", "", "replay only the messages of this user")
+	errorPattern := flags.String("error-pattern", "", "replay only the messages with an error matching this regular expression")
+	dryRun := flags.Bool("dry-run", false, "print the matching messages without replaying them")
+	if err := flags.Parse(args); err != nil {
+		log.Fatalln(err)
+	}
+
+	opts := deadletter.ReplayOptions{
+		StartOffset: *startOffset,
+		EndOffset:   *endOffset,
+		UserID:      *userId,
+		DryRun:      *dryRun,
+	}
+	var err error
+	if *startTime != "" {
+		if opts.StartTime, err = time.Parse(time.RFC3339, *startTime); err != nil {
+			log.Fatalf("start-time is invalid: %v", err)
+		}
+	}
+	if *endTime != "" {
+		if opts.EndTime, err = time.Parse(time.RFC3339, *endTime); err != nil {
+			log.Fatalf("end-time is invalid: %v", err)
+		}
+	}
+	if *errorPattern != "" {
+		if opts.ErrorPattern, err = regexp.Compile(*errorPattern); err != nil {
+			log.Fatalf("error-pattern is invalid: %v", err)
+		}
+	}
+
+	deps := buildDependencies()
+	defer deps.mongoStore.Disconnect(context.Background())
+	if deps.cloudEventsConfig == nil {
+		log.Fatalln("kafka is not enabled")
+	}
+
+	var config *events.CloudEventsConfig
+	var consumer events.MessageConsumer
+	switch *consumerName {
+	case keycloakUsersConsumerName:
+		config = cdcConfig(deps.cloudEventsConfig, keycloakUsersTopic, keycloakUsersDeadLettersTopic)
+		consumer, err = handler.NewKeycloakUserEventsConsumer(deps.keycloakEventsHandler)
+	case keycloakRolesConsumerName:
+		config = cdcConfig(deps.cloudEventsConfig, keycloakRolesTopic, keycloakRolesDeadLettersTopic)
+		consumer, err = handler.NewKeycloakRoleEventsConsumer(deps.keycloakEventsHandler)
+	case cliniciansConsumerName:
+		config = cliniciansCdcConfig(deps.cloudEventsConfig)
+		consumer, err = handler.NewClinicianEventsConsumer(deps.userEventsHandler, deps.clinicRelationships)
+	case clinicsConsumerName:
+		connector, ok := deps.marketoManager.(*marketo.Connector)
+		if !ok {
+			log.Fatalln("marketo config is invalid")
+		}
+		config = clinicsCdcConfig(deps.cloudEventsConfig)
+		consumer, err = handler.NewClinicEventsConsumer(connector, deps.userEventsHandler, deps.mongoStore, deps.clinicRelationships)
+	case patientsConsumerName:
+		config = patientsCdcConfig(deps.cloudEventsConfig)
+		consumer, err = handler.NewPatientEventsConsumer(deps.userEventsHandler, deps.clinicRelationships)
+	case userEventsConsumerName:
+		// Failures are sent back to the dead-letter topic by the cloud events consumer
+		config = deps.cloudEventsConfig
+		consumer, err = handler.NewUserEventsConsumer(deps.userEventsHandler)
+	default:
+		log.Fatalf("unknown consumer %s", *consumerName)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := consumer.Initialize(config); err != nil {
+		log.Fatalln(err)
+	}
+
+	opts.Topic = config.GetDeadLettersTopic()
+	if *topic != "" {
+		opts.Topic = *topic
+	}
+	if opts.Topic == "" {
+		log.Fatalln("dead-letter topic is not configured")
+	}
+
+	client, err := sarama.NewClient(config.KafkaBrokers, config.SaramaConfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	log.Printf("replaying dead letters from %s", opts.Topic)
+	replayer := deadletter.NewReplayer(client, consumer, os.Stdout)
+	stats, err := replayer.Replay(ctx, opts)
+	log.Printf("read %d, matched %d, replayed %d, failed %d", stats.Read, stats.Matched, stats.Replayed, stats.Failed)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,143 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const auditCollectionName = "marketoAudit"
+
+// Types of the sources of mutations
+const (
+	AuditSourceKafka        = "kafka"
+	AuditSourceAPI          = "api"
+	AuditSourceChangeStream = "changeStream"
+	AuditSourceRefreshJob   = "refreshJob"
+	AuditSourceBackfill     = "backfill"
+	AuditSourceInternal     = "internal"
+)
+
+// Results of the mutations
+const (
+	AuditStatusFailed   = "failed"
+	AuditStatusRejected = "rejected"
+)
+
+// Marketo objects of the mutations other than leads
+const (
+	AuditObjectCompany    = "company"
+	AuditObjectMembership = "membership"
+)
+
+// AuditSource - the event or the request which triggered a mutation
+type AuditSource struct {
+	Type      string `json:"type" bson:"type"`
+	Topic     string `json:"topic,omitempty" bson:"topic,omitempty"`
+	Partition int32  `json:"partition,omitempty" bson:"partition,omitempty"`
+	Offset    int64  `json:"offset,omitempty" bson:"offset,omitempty"`
+	// Caller is the user id of the token of API requests
+	Caller string `json:"caller,omitempty" bson:"caller,omitempty"`
+	// ResumeToken is the resume token of the change of the users collection
+	ResumeToken string `json:"resumeToken,omitempty" bson:"resumeToken,omitempty"`
+	// Name is the id of the refresh job or the checkpoint name of the backfill
+	Name string `json:"name,omitempty" bson:"name,omitempty"`
+}
+
+// AuditChange - the previous and the current value of a field of a mutation
+type AuditChange struct {
+	Field    string      `json:"field" bson:"field"`
+	Previous interface{} `json:"previous" bson:"previous"`
+	Current  interface{} `json:"current" bson:"current"`
+}
+
+// AuditEntry - a mutation which was sent to Marketo, or rejected before it was sent, and its result
+type AuditEntry struct {
+	ID primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	// UserID is the user of lead and membership mutations and the clinic of company mutations
+	UserID string `json:"userId" bson:"userId"`
+	LeadID int    `json:"leadId,omitempty" bson:"leadId,omitempty"`
+	// Object is the marketo object of the mutation, the lead if empty
+	Object string `json:"object,omitempty" bson:"object,omitempty"`
+	// Action is the marketo action, e.g. createOnly, updateOnly, delete or merge
+	Action  string        `json:"action" bson:"action"`
+	Source  AuditSource   `json:"source" bson:"source"`
+	Changes []AuditChange `json:"changes,omitempty" bson:"changes,omitempty"`
+	// Status is the status of the record returned by marketo, failed or rejected
+	Status      string    `json:"status" bson:"status"`
+	Reasons     []string  `json:"reasons,omitempty" bson:"reasons,omitempty"`
+	Error       string    `json:"error,omitempty" bson:"error,omitempty"`
+	CreatedTime time.Time `json:"createdTime" bson:"createdTime"`
+	ExpiresAt   time.Time `json:"expiresAt" bson:"expiresAt"`
+}
+
+// AuditFilter - selects the audit entries of a user created in the time range. Zero times are not bounded.
+type AuditFilter struct {
+	UserID string
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+// AuditRepository - an append-only log of the mutations sent to Marketo
+type AuditRepository interface {
+	InsertAuditEntry(ctx context.Context, entry *AuditEntry) error
+	FindAuditEntries(ctx context.Context, filter AuditFilter) ([]*AuditEntry, error)
+}
+
+var _ AuditRepository = &MongoStoreClient{}
+
+func auditCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(auditCollectionName)
+}
+
+// InsertAuditEntry - append an entry to the audit log
+func (msc *MongoStoreClient) InsertAuditEntry(ctx context.Context, entry *AuditEntry) error {
+	entry.ID = primitive.NewObjectID()
+	if entry.CreatedTime.IsZero() {
+		entry.CreatedTime = time.Now()
+	}
+	_, err := auditCollection(msc).InsertOne(ctx, entry)
+	return err
+}
+
+// FindAuditEntries - find the audit entries which match the filter, the most recent first
+func (msc *MongoStoreClient) FindAuditEntries(ctx context.Context, filter AuditFilter) (results []*AuditEntry, err error) {
+	selector := bson.M{"userId": filter.UserID}
+	createdTime := bson.M{}
+	if !filter.From.IsZero() {
+		createdTime["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		createdTime["$lt"] = filter.To
+	}
+	if len(createdTime) > 0 {
+		selector["createdTime"] = createdTime
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdTime", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(int64(filter.Limit))
+	cursor, err := auditCollection(msc).Find(ctx, selector, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &results); err != nil {
+		return results, err
+	}
+	return results, nil
+}
+
+// matches returns whether the entry matches the filter
+func (f AuditFilter) matches(entry *AuditEntry) bool {
+	if entry.UserID != f.UserID {
+		return false
+	}
+	if !f.From.IsZero() && entry.CreatedTime.Before(f.From) {
+		return false
+	}
+	return f.To.IsZero() || entry.CreatedTime.Before(f.To)
+}
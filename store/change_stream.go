@@ -0,0 +1,111 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Change stream operation types
+const (
+	OperationInsert  = "insert"
+	OperationUpdate  = "update"
+	OperationReplace = "replace"
+	OperationDelete  = "delete"
+)
+
+// UserChange - a change of a document in the users collection. Before is only available
+// if pre-images are enabled on the collection. After is the current state of the user when
+// the change is read, it's nil if the user was deleted in the meantime.
+type UserChange struct {
+	OperationType string   `bson:"operationType"`
+	DocumentKey   UserKey  `bson:"documentKey"`
+	Before        *User    `bson:"fullDocumentBeforeChange,omitempty"`
+	After         *User    `bson:"fullDocument,omitempty"`
+	ResumeToken   bson.Raw `bson:"-"`
+}
+
+// UserKey - the key of a changed document. The user id is only part of the key if the users
+// collection is sharded by the user id.
+type UserKey struct {
+	ObjectID primitive.ObjectID `bson:"_id"`
+	Id       string             `bson:"userid,omitempty"`
+}
+
+// UserChangeStream - iterates over the changes of the users collection
+type UserChangeStream interface {
+	Next(ctx context.Context) bool
+	Change() *UserChange
+	Err() error
+	Close(ctx context.Context) error
+}
+
+type userChangeStream struct {
+	stream *mongo.ChangeStream
+	change *UserChange
+	err    error
+}
+
+func (s *userChangeStream) Next(ctx context.Context) bool {
+	if s.err != nil || !s.stream.Next(ctx) {
+		return false
+	}
+	change := &UserChange{}
+	if s.err = s.stream.Decode(change); s.err != nil {
+		return false
+	}
+	change.ResumeToken = s.stream.ResumeToken()
+	s.change = change
+	return true
+}
+
+func (s *userChangeStream) Change() *UserChange {
+	return s.change
+}
+
+func (s *userChangeStream) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.stream.Err()
+}
+
+func (s *userChangeStream) Close(ctx context.Context) error {
+	return s.stream.Close(ctx)
+}
+
+// UsersPreImagesEnabled - whether pre-images are recorded for the changes of the users collection. The
+// users collection is only keyed by its object id, deleted users can't be identified without pre-images.
+func (msc *MongoStoreClient) UsersPreImagesEnabled(ctx context.Context) (bool, error) {
+	specs, err := msc.client.Database(msc.database).ListCollectionSpecifications(ctx, bson.M{"name": usersCollectionName})
+	if err != nil {
+		return false, err
+	}
+	if len(specs) != 1 {
+		return false, fmt.Errorf("users collection %s not found", usersCollectionName)
+	}
+	enabled, ok := specs[0].Options.Lookup("changeStreamPreAndPostImages", "enabled").BooleanOK()
+	return ok && enabled, nil
+}
+
+// WatchUsers - open a change stream on the users collection, resuming after the given token if it's set
+func (msc *MongoStoreClient) WatchUsers(ctx context.Context, resumeToken bson.Raw) (UserChangeStream, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"operationType": bson.M{"$in": bson.A{OperationInsert, OperationUpdate, OperationReplace, OperationDelete}}}}},
+	}
+	opts := options.ChangeStream().
+		SetFullDocument(options.UpdateLookup).
+		SetFullDocumentBeforeChange(options.WhenAvailable)
+	if len(resumeToken) > 0 {
+		opts.SetStartAfter(resumeToken)
+	}
+	stream, err := usersCollection(msc).Watch(ctx, pipeline, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &userChangeStream{stream: stream}, nil
+}
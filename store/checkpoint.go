@@ -0,0 +1,56 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const checkpointsCollectionName = "marketoCheckpoints"
+
+// Checkpoint - the progress of a resumable job
+type Checkpoint struct {
+	Name string `json:"name" bson:"_id"`
+	// Params describe the parameters of the job, a checkpoint can only be resumed with the same parameters
+	Params   string `json:"params,omitempty" bson:"params,omitempty"`
+	Position string `json:"position" bson:"position"`
+	// ResumeToken is the position of a change stream
+	ResumeToken bson.Raw  `json:"-" bson:"resumeToken,omitempty"`
+	Processed   int       `json:"processed" bson:"processed"`
+	Failed      int       `json:"failed" bson:"failed"`
+	Completed   bool      `json:"completed" bson:"completed"`
+	UpdatedTime time.Time `json:"updatedTime" bson:"updatedTime"`
+}
+
+// CheckpointRepository - persists the progress of resumable jobs
+type CheckpointRepository interface {
+	FindCheckpoint(ctx context.Context, name string) (*Checkpoint, error)
+	UpsertCheckpoint(ctx context.Context, checkpoint *Checkpoint) error
+}
+
+var _ CheckpointRepository = &MongoStoreClient{}
+
+func checkpointsCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(checkpointsCollectionName)
+}
+
+// FindCheckpoint - find the checkpoint of a job, returns nil if the job has no checkpoint
+func (msc *MongoStoreClient) FindCheckpoint(ctx context.Context, name string) (*Checkpoint, error) {
+	var result *Checkpoint
+	err := checkpointsCollection(msc).FindOne(ctx, bson.M{"_id": name}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return result, err
+}
+
+// UpsertCheckpoint - replace the checkpoint of a job
+func (msc *MongoStoreClient) UpsertCheckpoint(ctx context.Context, checkpoint *Checkpoint) error {
+	checkpoint.UpdatedTime = time.Now()
+	opts := options.Replace().SetUpsert(true)
+	_, err := checkpointsCollection(msc).ReplaceOne(ctx, bson.M{"_id": checkpoint.Name}, checkpoint, opts)
+	return err
+}
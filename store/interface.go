@@ -0,0 +1,36 @@
+package store
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// UsersRepository - the users collection, which is shared with shoreline
+type UsersRepository interface {
+	UpsertUser(ctx context.Context, user *User) error
+	FindUser(ctx context.Context, id string) (*User, error)
+	FindUsersWithIds(ctx context.Context, ids []string) ([]*User, error)
+	FindUsers(ctx context.Context, user *User) ([]*User, error)
+	StreamUsers(ctx context.Context, filter *UsersFilter, after string, batchSize int) (UsersIterator, error)
+	WatchUsers(ctx context.Context, resumeToken bson.Raw) (UserChangeStream, error)
+}
+
+// Store - all collections used by the service
+type Store interface {
+	Ping(ctx context.Context) error
+	Disconnect(ctx context.Context) error
+	// EnsureMarketoIndexes of the collections owned by the service
+	EnsureMarketoIndexes(ctx context.Context) error
+
+	UsersRepository
+	SyncStateRepository
+	ListSyncStates(ctx context.Context, afterUserID string, limit int) ([]*SyncState, error)
+	OutboxRepository
+	CheckpointRepository
+	RefreshJobRepository
+	AuditRepository
+	ParkedUserChangeRepository
+}
+
+var _ Store = &MongoStoreClient{}
@@ -0,0 +1,797 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/text/unicode/norm"
+)
+
+var _ Store = &MemoryStore{}
+
+// MemoryStore - an in-memory store for tests. Users are matched with the semantics of
+// usersCollation, i.e. case and diacritics are ignored when comparing strings. Changes of
+// the users are recorded with their pre-images and can be watched like a change stream.
+type MemoryStore struct {
+	mu          sync.Mutex
+	users       []*User
+	syncStates  map[string]*SyncState
+	outbox      []*OutboxEntry
+	checkpoints map[string]*Checkpoint
+	jobs        []*RefreshJob
+	jobResults  []*RefreshJobResult
+	audit       []*AuditEntry
+	changes     []*UserChange
+	parked      []*ParkedUserChange
+	// changed is closed and replaced when a change is recorded
+	changed chan struct{}
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		syncStates:  make(map[string]*SyncState),
+		checkpoints: make(map[string]*Checkpoint),
+		changed:     make(chan struct{}),
+	}
+}
+
+// collationKey returns the value used to compare strings with the en locale at strength 1
+func collationKey(value string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(value) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+func collationEqual(a string, b string) bool {
+	return collationKey(a) == collationKey(b)
+}
+
+func collationContains(values []string, value string) bool {
+	for _, v := range values {
+		if collationEqual(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func copyUser(user *User) *User {
+	copied := *user
+	copied.Emails = append([]string(nil), user.Emails...)
+	copied.Roles = append([]string(nil), user.Roles...)
+	return &copied
+}
+
+func (m *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryStore) Disconnect(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryStore) EnsureMarketoIndexes(ctx context.Context) error {
+	return nil
+}
+
+// findUser returns the index of the user with the id or -1 if the user doesn't exist
+func (m *MemoryStore) findUser(id string) int {
+	for i, u := range m.users {
+		if collationEqual(u.Id, id) {
+			return i
+		}
+	}
+	return -1
+}
+
+// UpsertUser - sets the non-empty attributes of the user like the `$set` of the mongo store
+func (m *MemoryStore) UpsertUser(ctx context.Context, user *User) error {
+	if user.Roles != nil {
+		sort.Strings(user.Roles)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findUser(user.Id)
+	if i < 0 {
+		created := copyUser(user)
+		if created.ObjectID.IsZero() {
+			created.ObjectID = primitive.NewObjectID()
+		}
+		m.users = append(m.users, created)
+		m.recordChange(OperationInsert, nil, created)
+		return nil
+	}
+
+	before := copyUser(m.users[i])
+	updated := copyUser(m.users[i])
+	if user.Username != "" {
+		updated.Username = user.Username
+	}
+	if len(user.Emails) > 0 {
+		updated.Emails = append([]string(nil), user.Emails...)
+	}
+	if len(user.Roles) > 0 {
+		updated.Roles = append([]string(nil), user.Roles...)
+	}
+	if user.TermsAccepted != "" {
+		updated.TermsAccepted = user.TermsAccepted
+	}
+	updated.EmailVerified = user.EmailVerified
+	if user.PwHash != "" {
+		updated.PwHash = user.PwHash
+	}
+	if user.Hash != "" {
+		updated.Hash = user.Hash
+	}
+	if user.CreatedTime != "" {
+		updated.CreatedTime = user.CreatedTime
+	}
+	if user.CreatedUserID != "" {
+		updated.CreatedUserID = user.CreatedUserID
+	}
+	if user.ModifiedTime != "" {
+		updated.ModifiedTime = user.ModifiedTime
+	}
+	if user.ModifiedUserID != "" {
+		updated.ModifiedUserID = user.ModifiedUserID
+	}
+	m.users[i] = updated
+	m.recordChange(OperationUpdate, before, updated)
+	return nil
+}
+
+// DeleteUser - removes the user, users are only deleted by shoreline in the mongo store
+func (m *MemoryStore) DeleteUser(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findUser(id)
+	if i < 0 {
+		return nil
+	}
+	before := m.users[i]
+	m.users = append(m.users[:i], m.users[i+1:]...)
+	m.recordChange(OperationDelete, before, nil)
+	return nil
+}
+
+func (m *MemoryStore) FindUser(ctx context.Context, id string) (*User, error) {
+	if id == "" {
+		return nil, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.findUser(id); i >= 0 {
+		return copyUser(m.users[i]), nil
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (m *MemoryStore) FindUsersWithIds(ctx context.Context, ids []string) ([]*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := []*User{}
+	for _, u := range m.users {
+		if collationContains(ids, u.Id) {
+			results = append(results, copyUser(u))
+		}
+	}
+	return results, nil
+}
+
+func (m *MemoryStore) FindUsers(ctx context.Context, user *User) ([]*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := []*User{}
+	if user.Id == "" && user.Username == "" && len(user.Emails) == 0 {
+		return results, nil
+	}
+	for _, u := range m.users {
+		matches := (user.Id != "" && collationEqual(u.Id, user.Id)) ||
+			(user.Username != "" && collationEqual(u.Username, user.Username))
+		for _, email := range user.Emails {
+			matches = matches || collationContains(u.Emails, email)
+		}
+		if matches {
+			results = append(results, copyUser(u))
+		}
+	}
+	return results, nil
+}
+
+// matches returns true if the user is selected by the filter
+func (f *UsersFilter) matches(user *User) bool {
+	if f == nil {
+		return true
+	}
+	if f.ModifiedSince != "" || f.ModifiedUntil != "" {
+		modified := user.ModifiedTime
+		if modified == "" {
+			modified = user.CreatedTime
+		}
+		if modified == "" {
+			return false
+		}
+		if f.ModifiedSince != "" && collationKey(modified) < collationKey(f.ModifiedSince) {
+			return false
+		}
+		if f.ModifiedUntil != "" && collationKey(modified) >= collationKey(f.ModifiedUntil) {
+			return false
+		}
+	}
+	if len(f.Roles) > 0 {
+		found := false
+		for _, role := range f.Roles {
+			found = found || collationContains(user.Roles, role)
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.TermsAccepted != nil && *f.TermsAccepted != (user.TermsAccepted != "") {
+		return false
+	}
+	if f.EmailVerified != nil && *f.EmailVerified != user.EmailVerified {
+		return false
+	}
+	if len(f.UserIDs) > 0 && !collationContains(f.UserIDs, user.Id) {
+		return false
+	}
+	return true
+}
+
+func (m *MemoryStore) StreamUsers(ctx context.Context, filter *UsersFilter, after string, batchSize int) (UsersIterator, error) {
+	var afterID primitive.ObjectID
+	if after != "" {
+		var err error
+		if afterID, err = primitive.ObjectIDFromHex(after); err != nil {
+			return nil, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []*User
+	for _, u := range m.users {
+		if objectIDAfter(u.ObjectID, afterID) && filter.matches(u) {
+			results = append(results, copyUser(u))
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return objectIDAfter(results[j].ObjectID, results[i].ObjectID)
+	})
+	return &memoryUsersIterator{users: results}, nil
+}
+
+// objectIDAfter returns true if the id is ordered after the other id
+func objectIDAfter(id primitive.ObjectID, other primitive.ObjectID) bool {
+	return strings.Compare(id.Hex(), other.Hex()) > 0
+}
+
+type memoryUsersIterator struct {
+	users []*User
+	index int
+}
+
+func (i *memoryUsersIterator) Next(ctx context.Context) bool {
+	if i.index >= len(i.users) || ctx.Err() != nil {
+		return false
+	}
+	i.index++
+	return true
+}
+
+func (i *memoryUsersIterator) User() *User {
+	if i.index == 0 {
+		return nil
+	}
+	return i.users[i.index-1]
+}
+
+func (i *memoryUsersIterator) Position() string {
+	if i.index == 0 {
+		return ""
+	}
+	return i.users[i.index-1].ObjectID.Hex()
+}
+
+func (i *memoryUsersIterator) Err() error {
+	return nil
+}
+
+func (i *memoryUsersIterator) Close(ctx context.Context) error {
+	return nil
+}
+
+// recordChange must be called with the lock held
+func (m *MemoryStore) recordChange(operationType string, before *User, after *User) {
+	change := &UserChange{
+		OperationType: operationType,
+		ResumeToken:   changeToken(len(m.changes)),
+	}
+	if before != nil {
+		change.DocumentKey = UserKey{ObjectID: before.ObjectID, Id: before.Id}
+		change.Before = copyUser(before)
+	}
+	if after != nil {
+		change.DocumentKey = UserKey{ObjectID: after.ObjectID, Id: after.Id}
+		change.After = copyUser(after)
+	}
+	m.changes = append(m.changes, change)
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func changeToken(index int) bson.Raw {
+	token, _ := bson.Marshal(bson.M{"_data": strconv.Itoa(index)})
+	return token
+}
+
+// WatchUsers - watch the users changes recorded after the change of the resume token. Only the
+// changes recorded after the stream was opened are returned if the resume token is not set.
+func (m *MemoryStore) WatchUsers(ctx context.Context, resumeToken bson.Raw) (UserChangeStream, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	next := len(m.changes)
+	if len(resumeToken) > 0 {
+		data, ok := resumeToken.Lookup("_data").StringValueOK()
+		if !ok {
+			return nil, fmt.Errorf("invalid resume token %v", resumeToken)
+		}
+		index, err := strconv.Atoi(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid resume token %v", resumeToken)
+		}
+		next = index + 1
+	}
+	return &memoryChangeStream{store: m, next: next}, nil
+}
+
+type memoryChangeStream struct {
+	store  *MemoryStore
+	next   int
+	change *UserChange
+	err    error
+}
+
+// Next blocks until a change is recorded or the context is done
+func (s *memoryChangeStream) Next(ctx context.Context) bool {
+	for {
+		s.store.mu.Lock()
+		if s.next < len(s.store.changes) {
+			change := *s.store.changes[s.next]
+			s.change = &change
+			s.next++
+			s.store.mu.Unlock()
+			return true
+		}
+		changed := s.store.changed
+		s.store.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			s.err = ctx.Err()
+			return false
+		case <-changed:
+		}
+	}
+}
+
+func (s *memoryChangeStream) Change() *UserChange {
+	return s.change
+}
+
+func (s *memoryChangeStream) Err() error {
+	return s.err
+}
+
+func (s *memoryChangeStream) Close(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryStore) FindSyncState(ctx context.Context, userID string) (*SyncState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if state, ok := m.syncStates[userID]; ok {
+		copied := *state
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) UpsertSyncState(ctx context.Context, state *SyncState) error {
+	if state.UpdatedTime.IsZero() {
+		state.UpdatedTime = time.Now()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copied := *state
+	// The memberships are only updated with UpdateSyncStateMemberships
+	if previous, ok := m.syncStates[state.UserID]; ok && copied.Memberships == nil {
+		copied.Memberships = previous.Memberships
+		copied.MembershipsHash = previous.MembershipsHash
+	}
+	m.syncStates[state.UserID] = &copied
+	return nil
+}
+
+func (m *MemoryStore) UpdateSyncStateMemberships(ctx context.Context, userID string, clinicIDs []string, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if state, ok := m.syncStates[userID]; ok {
+		state.Memberships = append([]string{}, clinicIDs...)
+		state.MembershipsHash = hash
+		state.UpdatedTime = time.Now()
+	}
+	return nil
+}
+
+func (m *MemoryStore) UpdateSyncStatus(ctx context.Context, userID string, status string, syncErr string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.syncStates[userID]
+	if !ok {
+		state = &SyncState{UserID: userID}
+		m.syncStates[userID] = state
+	}
+	state.Status = status
+	state.Error = syncErr
+	state.UpdatedTime = time.Now()
+	return nil
+}
+
+func (m *MemoryStore) ListSyncStates(ctx context.Context, afterUserID string, limit int) ([]*SyncState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []*SyncState
+	for _, state := range m.syncStates {
+		if state.UserID > afterUserID {
+			copied := *state
+			results = append(results, &copied)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].UserID < results[j].UserID
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+func (m *MemoryStore) EnqueueOutboxEntry(ctx context.Context, entry *OutboxEntry) error {
+	now := time.Now()
+	entry.ID = primitive.NewObjectID()
+	entry.Status = OutboxStatusPending
+	entry.CreatedTime = now
+	entry.UpdatedTime = now
+	entry.NextAttemptTime = now
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copied := *entry
+	m.outbox = append(m.outbox, &copied)
+	return nil
+}
+
+func (m *MemoryStore) FindPendingOutboxEntries(ctx context.Context, limit int) ([]*OutboxEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var pending []*OutboxEntry
+	for _, entry := range m.outbox {
+		if entry.Status == OutboxStatusPending {
+			pending = append(pending, entry)
+		}
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		if !pending[i].CreatedTime.Equal(pending[j].CreatedTime) {
+			return pending[i].CreatedTime.Before(pending[j].CreatedTime)
+		}
+		return objectIDAfter(pending[j].ID, pending[i].ID)
+	})
+
+	// Only the oldest entry of each user is returned, if it's due and not locked
+	now := time.Now()
+	seen := make(map[string]bool)
+	var results []*OutboxEntry
+	for _, entry := range pending {
+		if seen[entry.UserID] {
+			continue
+		}
+		seen[entry.UserID] = true
+		if entry.NextAttemptTime.After(now) || entry.LockedUntil.After(now) {
+			continue
+		}
+		copied := *entry
+		results = append(results, &copied)
+	}
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+func (m *MemoryStore) ClaimOutboxEntry(ctx context.Context, id primitive.ObjectID, lockedUntil time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, entry := range m.outbox {
+		if entry.ID == id {
+			if entry.Status != OutboxStatusPending || entry.LockedUntil.After(time.Now()) {
+				return false, nil
+			}
+			entry.LockedUntil = lockedUntil
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MemoryStore) UpdateOutboxEntry(ctx context.Context, entry *OutboxEntry) error {
+	entry.UpdatedTime = time.Now()
+	entry.LockedUntil = time.Time{}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range m.outbox {
+		if e.ID == entry.ID {
+			e.Status = entry.Status
+			e.Attempts = entry.Attempts
+			e.Error = entry.Error
+			e.UpdatedTime = entry.UpdatedTime
+			e.NextAttemptTime = entry.NextAttemptTime
+			e.LockedUntil = entry.LockedUntil
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) FindCheckpoint(ctx context.Context, name string) (*Checkpoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if checkpoint, ok := m.checkpoints[name]; ok {
+		copied := *checkpoint
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) UpsertCheckpoint(ctx context.Context, checkpoint *Checkpoint) error {
+	checkpoint.UpdatedTime = time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copied := *checkpoint
+	m.checkpoints[checkpoint.Name] = &copied
+	return nil
+}
+
+func (m *MemoryStore) CreateRefreshJob(ctx context.Context, job *RefreshJob) error {
+	now := time.Now()
+	job.ID = primitive.NewObjectID()
+	job.Status = RefreshJobStatusPending
+	job.CreatedTime = now
+	job.UpdatedTime = now
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copied := *job
+	m.jobs = append(m.jobs, &copied)
+	return nil
+}
+
+func (m *MemoryStore) FindRefreshJob(ctx context.Context, id primitive.ObjectID) (*RefreshJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, job := range m.jobs {
+		if job.ID == id {
+			copied := *job
+			return &copied, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) FindUnfinishedRefreshJobs(ctx context.Context) ([]*RefreshJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []*RefreshJob
+	for _, job := range m.jobs {
+		if job.Status == RefreshJobStatusPending || job.Status == RefreshJobStatusRunning {
+			copied := *job
+			results = append(results, &copied)
+		}
+	}
+	return results, nil
+}
+
+func (m *MemoryStore) ClaimRefreshJob(ctx context.Context, id primitive.ObjectID, owner string, lockedUntil time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, job := range m.jobs {
+		if job.ID != id {
+			continue
+		}
+		if job.Status != RefreshJobStatusPending && job.Status != RefreshJobStatusRunning {
+			return false, nil
+		}
+		if job.LockedUntil.After(time.Now()) && job.Owner != owner {
+			return false, nil
+		}
+		job.Owner = owner
+		job.LockedUntil = lockedUntil
+		return true, nil
+	}
+	return false, nil
+}
+
+func (m *MemoryStore) UpdateRefreshJob(ctx context.Context, job *RefreshJob) error {
+	job.UpdatedTime = time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, j := range m.jobs {
+		if j.ID == job.ID {
+			j.Status = job.Status
+			j.Error = job.Error
+			j.Attempts = job.Attempts
+			j.UpdatedTime = job.UpdatedTime
+			j.StartedTime = job.StartedTime
+			j.CompletedTime = job.CompletedTime
+			j.Owner = job.Owner
+			j.LockedUntil = job.LockedUntil
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) UpsertRefreshJobResult(ctx context.Context, result *RefreshJobResult) error {
+	result.UpdatedTime = time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copied := *result
+	for i, r := range m.jobResults {
+		if r.JobID == result.JobID && r.UserID == result.UserID {
+			m.jobResults[i] = &copied
+			return nil
+		}
+	}
+	m.jobResults = append(m.jobResults, &copied)
+	return nil
+}
+
+func (m *MemoryStore) findRefreshJobResults(jobID primitive.ObjectID, status string) []*RefreshJobResult {
+	var results []*RefreshJobResult
+	for _, r := range m.jobResults {
+		if r.JobID == jobID && (status == "" || r.Status == status) {
+			copied := *r
+			results = append(results, &copied)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].UserID < results[j].UserID
+	})
+	return results
+}
+
+func (m *MemoryStore) FindRefreshJobResults(ctx context.Context, jobID primitive.ObjectID, status string, offset int, limit int) ([]*RefreshJobResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := m.findRefreshJobResults(jobID, status)
+	if offset >= len(results) {
+		return nil, nil
+	}
+	results = results[offset:]
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+func (m *MemoryStore) CountRefreshJobResults(ctx context.Context, jobID primitive.ObjectID, status string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.findRefreshJobResults(jobID, status)), nil
+}
+
+func (m *MemoryStore) InsertAuditEntry(ctx context.Context, entry *AuditEntry) error {
+	entry.ID = primitive.NewObjectID()
+	if entry.CreatedTime.IsZero() {
+		entry.CreatedTime = time.Now()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copied := *entry
+	m.audit = append(m.audit, &copied)
+	return nil
+}
+
+func (m *MemoryStore) FindAuditEntries(ctx context.Context, filter AuditFilter) ([]*AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []*AuditEntry
+	for i := len(m.audit) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(results) >= filter.Limit {
+			break
+		}
+		if filter.matches(m.audit[i]) {
+			copied := *m.audit[i]
+			results = append(results, &copied)
+		}
+	}
+	return results, nil
+}
+
+func (m *MemoryStore) InsertParkedUserChange(ctx context.Context, change *ParkedUserChange) error {
+	change.ID = primitive.NewObjectID()
+	if change.CreatedTime.IsZero() {
+		change.CreatedTime = time.Now()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copied := *change
+	m.parked = append(m.parked, &copied)
+	return nil
+}
+
+func (m *MemoryStore) FindParkedUserChanges(ctx context.Context, limit int) ([]*ParkedUserChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []*ParkedUserChange
+	for i := len(m.parked) - 1; i >= 0; i-- {
+		if limit > 0 && len(results) >= limit {
+			break
+		}
+		copied := *m.parked[i]
+		results = append(results, &copied)
+	}
+	return results, nil
+}
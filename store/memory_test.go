@@ -0,0 +1,111 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tidepool-org/marketo-service/store"
+)
+
+func Test_MemoryStore_Collation(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	_ = s.UpsertUser(ctx, &store.User{Id: "abc123", Username: "José@Example.com", Emails: []string{"José@Example.com"}, Roles: []string{"clinic"}})
+
+	if user, err := s.FindUser(ctx, "ABC123"); err != nil || user == nil {
+		t.Errorf("Expected user to be found by id ignoring case, got %v, %v", user, err)
+	}
+	users, _ := s.FindUsers(ctx, &store.User{Emails: []string{"jose@example.com"}})
+	if len(users) != 1 {
+		t.Errorf("Expected user to be found by email ignoring case and diacritics, got %d users", len(users))
+	}
+	users, _ = s.FindUsers(ctx, &store.User{Username: "josé@example.org"})
+	if len(users) != 0 {
+		t.Errorf("Expected no users, got %d users", len(users))
+	}
+
+	// Updates only set the non-empty attributes
+	_ = s.UpsertUser(ctx, &store.User{Id: "ABC123", TermsAccepted: "2020-01-01T00:00:00Z", EmailVerified: true})
+	user, _ := s.FindUser(ctx, "abc123")
+	if user.Username != "José@Example.com" || user.TermsAccepted == "" || !user.EmailVerified {
+		t.Errorf("Expected user to be updated, got %+v", user)
+	}
+}
+
+func Test_MemoryStore_StreamUsers(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	_ = s.UpsertUser(ctx, &store.User{Id: "1", Roles: []string{"clinic"}, EmailVerified: true, TermsAccepted: "2020-01-01T00:00:00Z", CreatedTime: "2020-01-01T00:00:00Z"})
+	_ = s.UpsertUser(ctx, &store.User{Id: "2", Roles: []string{"CLINIC"}, EmailVerified: true, CreatedTime: "2020-01-01T00:00:00Z", ModifiedTime: "2021-06-01T00:00:00Z"})
+	_ = s.UpsertUser(ctx, &store.User{Id: "3", EmailVerified: true, TermsAccepted: "2020-01-01T00:00:00Z", CreatedTime: "2021-01-01T00:00:00Z"})
+	_ = s.UpsertUser(ctx, &store.User{Id: "4", TermsAccepted: "2020-01-01T00:00:00Z", CreatedTime: "2021-01-01T00:00:00Z"})
+
+	yes := true
+	tests := []struct {
+		name     string
+		filter   *store.UsersFilter
+		expected []string
+	}{
+		{name: "all", filter: nil, expected: []string{"1", "2", "3", "4"}},
+		{name: "roles", filter: &store.UsersFilter{Roles: []string{"Clinic"}}, expected: []string{"1", "2"}},
+		{name: "modified", filter: &store.UsersFilter{ModifiedSince: "2021-01-01T00:00:00Z", ModifiedUntil: "2021-02-01T00:00:00Z"}, expected: []string{"3", "4"}},
+		{name: "verified with terms", filter: &store.UsersFilter{EmailVerified: &yes, TermsAccepted: &yes}, expected: []string{"1", "3"}},
+		{name: "user ids", filter: &store.UsersFilter{UserIDs: []string{"4", "2"}}, expected: []string{"2", "4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, _ := s.StreamUsers(ctx, tt.filter, "", 2)
+			var actual []string
+			for users.Next(ctx) {
+				actual = append(actual, users.User().Id)
+			}
+			if len(actual) != len(tt.expected) {
+				t.Fatalf("Expected users %v, got %v", tt.expected, actual)
+			}
+			for i := range actual {
+				if actual[i] != tt.expected[i] {
+					t.Fatalf("Expected users %v, got %v", tt.expected, actual)
+				}
+			}
+		})
+	}
+
+	// The stream can be resumed after the position of a user
+	users, _ := s.StreamUsers(ctx, nil, "", 2)
+	users.Next(ctx)
+	users.Next(ctx)
+	resumed, _ := s.StreamUsers(ctx, nil, users.Position(), 2)
+	if !resumed.Next(ctx) || resumed.User().Id != "3" {
+		t.Errorf("Expected the stream to resume at user 3")
+	}
+}
+
+func Test_MemoryStore_WatchUsers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s := store.NewMemoryStore()
+	stream, _ := s.WatchUsers(ctx, nil)
+
+	_ = s.UpsertUser(ctx, &store.User{Id: "1", Username: "old@example.com"})
+	_ = s.UpsertUser(ctx, &store.User{Id: "1", Username: "new@example.com"})
+	_ = s.DeleteUser(ctx, "1")
+
+	if !stream.Next(ctx) || stream.Change().OperationType != store.OperationInsert {
+		t.Fatalf("Expected insert change")
+	}
+	if !stream.Next(ctx) || stream.Change().Before.Username != "old@example.com" || stream.Change().After.Username != "new@example.com" {
+		t.Fatalf("Expected update change with pre-image")
+	}
+	token := stream.Change().ResumeToken
+
+	resumed, _ := s.WatchUsers(ctx, token)
+	if !resumed.Next(ctx) || resumed.Change().OperationType != store.OperationDelete {
+		t.Fatalf("Expected the resumed stream to start at the delete change")
+	}
+
+	cancel()
+	if resumed.Next(ctx) {
+		t.Errorf("Expected no more changes")
+	}
+}
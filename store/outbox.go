@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const outboxCollectionName = "marketoOutbox"
+
+// Delivered entries are kept for a week for troubleshooting
+const deliveredOutboxEntriesExpiration = int32(7 * 24 * 60 * 60)
+
+const (
+	OutboxStatusPending   = "pending"
+	OutboxStatusDelivered = "delivered"
+	OutboxStatusParked    = "parked"
+)
+
+// OutboxEntry - a mutation which has to be delivered to Marketo
+type OutboxEntry struct {
+	ID        primitive.ObjectID     `json:"id" bson:"_id,omitempty"`
+	UserID    string                 `json:"userId" bson:"userId"`
+	ListEmail string                 `json:"listEmail" bson:"listEmail"`
+	Payload   map[string]interface{} `json:"payload" bson:"payload"`
+	Force     bool                   `json:"force,omitempty" bson:"force,omitempty"`
+	// RemoveLead is set if the lead of the user has to be removed instead of upserted
+	RemoveLead bool `json:"removeLead,omitempty" bson:"removeLead,omitempty"`
+	// Company is the company of the primary clinic of the clinician, it's upserted before the lead
+	Company map[string]interface{} `json:"company,omitempty" bson:"company,omitempty"`
+	// SyncMemberships is set if the memberships of the clinician have to be synced after the lead
+	SyncMemberships bool                     `json:"syncMemberships,omitempty" bson:"syncMemberships,omitempty"`
+	Memberships     []map[string]interface{} `json:"memberships,omitempty" bson:"memberships,omitempty"`
+	Status          string                   `json:"status" bson:"status"`
+	Attempts        int                      `json:"attempts" bson:"attempts"`
+	Error           string                   `json:"error,omitempty" bson:"error,omitempty"`
+	CreatedTime     time.Time                `json:"createdTime" bson:"createdTime"`
+	UpdatedTime     time.Time                `json:"updatedTime" bson:"updatedTime"`
+	NextAttemptTime time.Time                `json:"nextAttemptTime" bson:"nextAttemptTime"`
+	LockedUntil     time.Time                `json:"-" bson:"lockedUntil"`
+	// Source is the source which triggered the mutation, it's recorded in the audit log on delivery
+	Source *AuditSource `json:"source,omitempty" bson:"source,omitempty"`
+}
+
+// OutboxRepository - persists mutations until they are delivered to Marketo
+type OutboxRepository interface {
+	EnqueueOutboxEntry(ctx context.Context, entry *OutboxEntry) error
+	// FindPendingOutboxEntries returns the oldest pending entry of each user which is due for delivery
+	FindPendingOutboxEntries(ctx context.Context, limit int) ([]*OutboxEntry, error)
+	ClaimOutboxEntry(ctx context.Context, id primitive.ObjectID, lockedUntil time.Time) (bool, error)
+	UpdateOutboxEntry(ctx context.Context, entry *OutboxEntry) error
+}
+
+var _ OutboxRepository = &MongoStoreClient{}
+
+func outboxCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(outboxCollectionName)
+}
+
+// EnqueueOutboxEntry - persist a new pending mutation
+func (msc *MongoStoreClient) EnqueueOutboxEntry(ctx context.Context, entry *OutboxEntry) error {
+	now := time.Now()
+	entry.ID = primitive.NewObjectID()
+	entry.Status = OutboxStatusPending
+	entry.CreatedTime = now
+	entry.UpdatedTime = now
+	entry.NextAttemptTime = now
+	_, err := outboxCollection(msc).InsertOne(ctx, entry)
+	return err
+}
+
+// FindPendingOutboxEntries - find the oldest pending mutation of each user, if it's due and not locked by
+// another process. The mutations are returned in the order they were enqueued.
+func (msc *MongoStoreClient) FindPendingOutboxEntries(ctx context.Context, limit int) (results []*OutboxEntry, err error) {
+	now := time.Now()
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": OutboxStatusPending}}},
+		{{Key: "$sort", Value: bson.D{{Key: "createdTime", Value: 1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$userId", "entry": bson.M{"$first": "$$ROOT"}}}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$entry"}}},
+		// Later entries of a user wait for the oldest one, even if it's not due
+		{{Key: "$match", Value: bson.M{"nextAttemptTime": bson.M{"$lte": now}, "lockedUntil": bson.M{"$lte": now}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "createdTime", Value: 1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+	}
+	cursor, err := outboxCollection(msc).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &results); err != nil {
+		return results, err
+	}
+	return results, nil
+}
+
+// ClaimOutboxEntry - lock a pending mutation for delivery, returns false if the entry is locked by another process
+func (msc *MongoStoreClient) ClaimOutboxEntry(ctx context.Context, id primitive.ObjectID, lockedUntil time.Time) (bool, error) {
+	selector := bson.M{
+		"_id":         id,
+		"status":      OutboxStatusPending,
+		"lockedUntil": bson.M{"$lte": time.Now()},
+	}
+	update := bson.M{"$set": bson.M{"lockedUntil": lockedUntil}}
+	result, err := outboxCollection(msc).UpdateOne(ctx, selector, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// UpdateOutboxEntry - update the delivery state of a mutation and release the lock
+func (msc *MongoStoreClient) UpdateOutboxEntry(ctx context.Context, entry *OutboxEntry) error {
+	entry.UpdatedTime = time.Now()
+	entry.LockedUntil = time.Time{}
+	update := bson.M{
+		"$set": bson.M{
+			"status":          entry.Status,
+			"attempts":        entry.Attempts,
+			"error":           entry.Error,
+			"updatedTime":     entry.UpdatedTime,
+			"nextAttemptTime": entry.NextAttemptTime,
+			"lockedUntil":     entry.LockedUntil,
+		},
+	}
+	_, err := outboxCollection(msc).UpdateOne(ctx, bson.M{"_id": entry.ID}, update)
+	return err
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const parkedUserChangesCollectionName = "marketoParkedUserChanges"
+
+// ParkedUserChange - a change of the users collection which couldn't be handled and was skipped
+type ParkedUserChange struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	OperationType string             `json:"operationType" bson:"operationType"`
+	DocumentKey   UserKey            `json:"documentKey" bson:"documentKey"`
+	// UserID is the id of the changed user if it's known
+	UserID      string    `json:"userId,omitempty" bson:"userId,omitempty"`
+	ResumeToken bson.Raw  `json:"-" bson:"resumeToken"`
+	Error       string    `json:"error" bson:"error"`
+	CreatedTime time.Time `json:"createdTime" bson:"createdTime"`
+}
+
+// ParkedUserChangeRepository - persists the changes of the users collection which were skipped
+type ParkedUserChangeRepository interface {
+	InsertParkedUserChange(ctx context.Context, change *ParkedUserChange) error
+	// FindParkedUserChanges returns the parked changes, most recent first
+	FindParkedUserChanges(ctx context.Context, limit int) ([]*ParkedUserChange, error)
+}
+
+var _ ParkedUserChangeRepository = &MongoStoreClient{}
+
+func parkedUserChangesCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(parkedUserChangesCollectionName)
+}
+
+// InsertParkedUserChange - persist a skipped change
+func (msc *MongoStoreClient) InsertParkedUserChange(ctx context.Context, change *ParkedUserChange) error {
+	change.ID = primitive.NewObjectID()
+	if change.CreatedTime.IsZero() {
+		change.CreatedTime = time.Now()
+	}
+	_, err := parkedUserChangesCollection(msc).InsertOne(ctx, change)
+	return err
+}
+
+// FindParkedUserChanges - find the most recent skipped changes
+func (msc *MongoStoreClient) FindParkedUserChanges(ctx context.Context, limit int) ([]*ParkedUserChange, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdTime", Value: -1}})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := parkedUserChangesCollection(msc).Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var changes []*ParkedUserChange
+	err = cursor.All(ctx, &changes)
+	return changes, err
+}
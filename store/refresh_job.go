@@ -0,0 +1,191 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	refreshJobsCollectionName       = "marketoRefreshJobs"
+	refreshJobResultsCollectionName = "marketoRefreshJobResults"
+)
+
+const (
+	// RefreshJobStatusPending - the job is waiting to be run, or to be resumed from its checkpoint
+	// after it was interrupted or failed partway
+	RefreshJobStatusPending   = "pending"
+	RefreshJobStatusRunning   = "running"
+	RefreshJobStatusCompleted = "completed"
+	// RefreshJobStatusFailed - the job failed on each attempt and is not resumed. The users after
+	// its checkpoint were not refreshed, a new job has to be created to refresh them.
+	RefreshJobStatusFailed = "failed"
+)
+
+const (
+	RefreshResultStatusRefreshed = "refreshed"
+	RefreshResultStatusFailed    = "failed"
+)
+
+// RefreshJob - a batch refresh of the users matching the filter
+type RefreshJob struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Status        string             `json:"status" bson:"status"`
+	Filter        UsersFilter        `json:"filter" bson:"filter"`
+	Force         bool               `json:"force" bson:"force"`
+	CreatedBy     string             `json:"createdBy,omitempty" bson:"createdBy,omitempty"`
+	Error         string             `json:"error,omitempty" bson:"error,omitempty"`
+	Attempts      int                `json:"attempts,omitempty" bson:"attempts,omitempty"`
+	CreatedTime   time.Time          `json:"createdTime" bson:"createdTime"`
+	UpdatedTime   time.Time          `json:"updatedTime" bson:"updatedTime"`
+	StartedTime   *time.Time         `json:"startedTime,omitempty" bson:"startedTime,omitempty"`
+	CompletedTime *time.Time         `json:"completedTime,omitempty" bson:"completedTime,omitempty"`
+	Owner         string             `json:"-" bson:"owner,omitempty"`
+	LockedUntil   time.Time          `json:"-" bson:"lockedUntil"`
+}
+
+// RefreshJobResult - the result of the refresh of a single user
+type RefreshJobResult struct {
+	JobID       primitive.ObjectID `json:"-" bson:"jobId"`
+	UserID      string             `json:"userId" bson:"userId"`
+	Status      string             `json:"status" bson:"status"`
+	Error       string             `json:"error,omitempty" bson:"error,omitempty"`
+	UpdatedTime time.Time          `json:"updatedTime" bson:"updatedTime"`
+}
+
+// RefreshJobRepository - persists the refresh jobs and their results, so jobs survive restarts
+type RefreshJobRepository interface {
+	CreateRefreshJob(ctx context.Context, job *RefreshJob) error
+	FindRefreshJob(ctx context.Context, id primitive.ObjectID) (*RefreshJob, error)
+	FindUnfinishedRefreshJobs(ctx context.Context) ([]*RefreshJob, error)
+	ClaimRefreshJob(ctx context.Context, id primitive.ObjectID, owner string, lockedUntil time.Time) (bool, error)
+	UpdateRefreshJob(ctx context.Context, job *RefreshJob) error
+	UpsertRefreshJobResult(ctx context.Context, result *RefreshJobResult) error
+	FindRefreshJobResults(ctx context.Context, jobID primitive.ObjectID, status string, offset int, limit int) ([]*RefreshJobResult, error)
+	CountRefreshJobResults(ctx context.Context, jobID primitive.ObjectID, status string) (int, error)
+}
+
+var _ RefreshJobRepository = &MongoStoreClient{}
+
+func refreshJobsCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(refreshJobsCollectionName)
+}
+
+func refreshJobResultsCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(refreshJobResultsCollectionName)
+}
+
+// CreateRefreshJob - persist a new pending job
+func (msc *MongoStoreClient) CreateRefreshJob(ctx context.Context, job *RefreshJob) error {
+	now := time.Now()
+	job.ID = primitive.NewObjectID()
+	job.Status = RefreshJobStatusPending
+	job.CreatedTime = now
+	job.UpdatedTime = now
+	_, err := refreshJobsCollection(msc).InsertOne(ctx, job)
+	return err
+}
+
+// FindRefreshJob - find a job by id, returns nil if the job doesn't exist
+func (msc *MongoStoreClient) FindRefreshJob(ctx context.Context, id primitive.ObjectID) (*RefreshJob, error) {
+	var result *RefreshJob
+	err := refreshJobsCollection(msc).FindOne(ctx, bson.M{"_id": id}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return result, err
+}
+
+// FindUnfinishedRefreshJobs - find the pending and running jobs in the order they were created
+func (msc *MongoStoreClient) FindUnfinishedRefreshJobs(ctx context.Context) (results []*RefreshJob, err error) {
+	selector := bson.M{"status": bson.M{"$in": bson.A{RefreshJobStatusPending, RefreshJobStatusRunning}}}
+	opts := options.Find().SetSort(bson.D{{Key: "createdTime", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := refreshJobsCollection(msc).Find(ctx, selector, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &results); err != nil {
+		return results, err
+	}
+	return results, nil
+}
+
+// ClaimRefreshJob - lock an unfinished job, returns false if the job is locked by another owner.
+// The owner of the lock can extend it by claiming the job again.
+func (msc *MongoStoreClient) ClaimRefreshJob(ctx context.Context, id primitive.ObjectID, owner string, lockedUntil time.Time) (bool, error) {
+	selector := bson.M{
+		"_id":    id,
+		"status": bson.M{"$in": bson.A{RefreshJobStatusPending, RefreshJobStatusRunning}},
+		"$or": bson.A{
+			bson.M{"lockedUntil": bson.M{"$lte": time.Now()}},
+			bson.M{"owner": owner},
+		},
+	}
+	update := bson.M{"$set": bson.M{"owner": owner, "lockedUntil": lockedUntil}}
+	result, err := refreshJobsCollection(msc).UpdateOne(ctx, selector, update)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// UpdateRefreshJob - update the status of a job
+func (msc *MongoStoreClient) UpdateRefreshJob(ctx context.Context, job *RefreshJob) error {
+	job.UpdatedTime = time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"status":        job.Status,
+			"error":         job.Error,
+			"attempts":      job.Attempts,
+			"updatedTime":   job.UpdatedTime,
+			"startedTime":   job.StartedTime,
+			"completedTime": job.CompletedTime,
+			"owner":         job.Owner,
+			"lockedUntil":   job.LockedUntil,
+		},
+	}
+	_, err := refreshJobsCollection(msc).UpdateOne(ctx, bson.M{"_id": job.ID}, update)
+	return err
+}
+
+// UpsertRefreshJobResult - replace the result of a user, users may be refreshed again when a job is resumed
+func (msc *MongoStoreClient) UpsertRefreshJobResult(ctx context.Context, result *RefreshJobResult) error {
+	result.UpdatedTime = time.Now()
+	opts := options.Replace().SetUpsert(true)
+	_, err := refreshJobResultsCollection(msc).ReplaceOne(ctx, bson.M{"jobId": result.JobID, "userId": result.UserID}, result, opts)
+	return err
+}
+
+func refreshJobResultsSelector(jobID primitive.ObjectID, status string) bson.M {
+	selector := bson.M{"jobId": jobID}
+	if status != "" {
+		selector["status"] = status
+	}
+	return selector
+}
+
+// FindRefreshJobResults - find a page of the results of a job, optionally with the given status
+func (msc *MongoStoreClient) FindRefreshJobResults(ctx context.Context, jobID primitive.ObjectID, status string, offset int, limit int) (results []*RefreshJobResult, err error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "userId", Value: 1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(limit))
+	cursor, err := refreshJobResultsCollection(msc).Find(ctx, refreshJobResultsSelector(jobID, status), opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &results); err != nil {
+		return results, err
+	}
+	return results, nil
+}
+
+// CountRefreshJobResults - count the results of a job, optionally with the given status
+func (msc *MongoStoreClient) CountRefreshJobResults(ctx context.Context, jobID primitive.ObjectID, status string) (int, error) {
+	count, err := refreshJobResultsCollection(msc).CountDocuments(ctx, refreshJobResultsSelector(jobID, status))
+	return int(count), err
+}
@@ -7,10 +7,12 @@ import (
 	"sort"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	tpMongo "github.com/tidepool-org/go-common/clients/mongo"
+	"github.com/tidepool-org/go-common/clients/shoreline"
 )
 
 const (
@@ -31,18 +33,32 @@ type MongoStoreClient struct {
 	database string
 }
 type User struct {
-	Id             string   `json:"userid,omitempty" bson:"userid,omitempty"` // map userid to id
-	Username       string   `json:"username,omitempty" bson:"username,omitempty"`
-	Emails         []string `json:"emails,omitempty" bson:"emails,omitempty"`
-	Roles          []string `json:"roles,omitempty" bson:"roles,omitempty"`
-	TermsAccepted  string   `json:"termsAccepted,omitempty" bson:"termsAccepted,omitempty"`
-	EmailVerified  bool     `json:"emailVerified" bson:"authenticated"` //tag is name `authenticated` for historical reasons
-	PwHash         string   `json:"-" bson:"pwhash,omitempty"`
-	Hash           string   `json:"-" bson:"userhash,omitempty"`
-	CreatedTime    string   `json:"createdTime,omitempty" bson:"createdTime,omitempty"`
-	CreatedUserID  string   `json:"createdUserId,omitempty" bson:"createdUserId,omitempty"`
-	ModifiedTime   string   `json:"modifiedTime,omitempty" bson:"modifiedTime,omitempty"`
-	ModifiedUserID string   `json:"modifiedUserId,omitempty" bson:"modifiedUserId,omitempty"`
+	ObjectID       primitive.ObjectID `json:"-" bson:"_id,omitempty"`
+	Id             string             `json:"userid,omitempty" bson:"userid,omitempty"` // map userid to id
+	Username       string             `json:"username,omitempty" bson:"username,omitempty"`
+	Emails         []string           `json:"emails,omitempty" bson:"emails,omitempty"`
+	Roles          []string           `json:"roles,omitempty" bson:"roles,omitempty"`
+	TermsAccepted  string             `json:"termsAccepted,omitempty" bson:"termsAccepted,omitempty"`
+	EmailVerified  bool               `json:"emailVerified" bson:"authenticated"` //tag is name `authenticated` for historical reasons
+	PwHash         string             `json:"-" bson:"pwhash,omitempty"`
+	Hash           string             `json:"-" bson:"userhash,omitempty"`
+	CreatedTime    string             `json:"createdTime,omitempty" bson:"createdTime,omitempty"`
+	CreatedUserID  string             `json:"createdUserId,omitempty" bson:"createdUserId,omitempty"`
+	ModifiedTime   string             `json:"modifiedTime,omitempty" bson:"modifiedTime,omitempty"`
+	ModifiedUserID string             `json:"modifiedUserId,omitempty" bson:"modifiedUserId,omitempty"`
+}
+
+// UserData returns the user in the format used by shoreline
+func (u *User) UserData() shoreline.UserData {
+	return shoreline.UserData{
+		UserID:         u.Id,
+		Username:       u.Username,
+		Emails:         u.Emails,
+		PasswordExists: u.PwHash != "",
+		Roles:          u.Roles,
+		EmailVerified:  u.EmailVerified,
+		TermsAccepted:  u.TermsAccepted,
+	}
 }
 
 // NewMongoStoreClient creates a new MongoStoreClient
@@ -213,3 +229,123 @@ func (msc *MongoStoreClient) EnsureIndexes() error {
 
 	return nil
 }
+
+// EnsureMarketoIndexes exist for the collections owned by the marketo service. The users and tokens
+// collections are owned by shoreline and their indexes are left untouched.
+func (msc *MongoStoreClient) EnsureMarketoIndexes(ctx context.Context) error {
+	// Add indexes for the marketo sync states
+	syncStateIndexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetBackground(true),
+		},
+		{
+			Keys: bson.D{{Key: "leadId", Value: 1}},
+			Options: options.Index().
+				SetBackground(true),
+		},
+		{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "updatedTime", Value: 1}},
+			Options: options.Index().
+				SetBackground(true),
+		},
+	}
+
+	if _, err := syncStatesCollection(msc).Indexes().CreateMany(ctx, syncStateIndexes); err != nil {
+		return fmt.Errorf("unable to create sync state indexes: %w", err)
+	}
+
+	// Add indexes for the marketo outbox
+	outboxIndexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdTime", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().
+				SetBackground(true),
+		},
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "createdTime", Value: 1}},
+			Options: options.Index().
+				SetBackground(true),
+		},
+		{
+			Keys: bson.D{{Key: "updatedTime", Value: 1}},
+			Options: options.Index().
+				SetName("ExpireDeliveredOutboxEntries").
+				SetExpireAfterSeconds(deliveredOutboxEntriesExpiration).
+				SetPartialFilterExpression(bson.M{"status": OutboxStatusDelivered}).
+				SetBackground(true),
+		},
+	}
+
+	if _, err := outboxCollection(msc).Indexes().CreateMany(ctx, outboxIndexes); err != nil {
+		return fmt.Errorf("unable to create outbox indexes: %w", err)
+	}
+
+	// Add indexes for the audit log, entries expire after the retention of the service
+	auditIndexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "createdTime", Value: -1}},
+			Options: options.Index().
+				SetBackground(true),
+		},
+		{
+			Keys: bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().
+				SetName("ExpireAuditEntries").
+				SetExpireAfterSeconds(0).
+				SetBackground(true),
+		},
+	}
+
+	if _, err := auditCollection(msc).Indexes().CreateMany(ctx, auditIndexes); err != nil {
+		return fmt.Errorf("unable to create audit indexes: %w", err)
+	}
+
+	// Add indexes for the refresh jobs
+	refreshJobIndexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdTime", Value: 1}},
+			Options: options.Index().
+				SetBackground(true),
+		},
+	}
+
+	if _, err := refreshJobsCollection(msc).Indexes().CreateMany(ctx, refreshJobIndexes); err != nil {
+		return fmt.Errorf("unable to create refresh job indexes: %w", err)
+	}
+
+	refreshJobResultIndexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "jobId", Value: 1}, {Key: "userId", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetBackground(true),
+		},
+		{
+			Keys: bson.D{{Key: "jobId", Value: 1}, {Key: "status", Value: 1}, {Key: "userId", Value: 1}},
+			Options: options.Index().
+				SetBackground(true),
+		},
+	}
+
+	if _, err := refreshJobResultsCollection(msc).Indexes().CreateMany(ctx, refreshJobResultIndexes); err != nil {
+		return fmt.Errorf("unable to create refresh job result indexes: %w", err)
+	}
+
+	// Add indexes for the parked changes of the users collection
+	parkedUserChangeIndexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "createdTime", Value: -1}},
+			Options: options.Index().
+				SetBackground(true),
+		},
+	}
+
+	if _, err := parkedUserChangesCollection(msc).Indexes().CreateMany(ctx, parkedUserChangeIndexes); err != nil {
+		return fmt.Errorf("unable to create parked user change indexes: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const syncStatesCollectionName = "marketoSyncStates"
+
+const (
+	SyncStatusSynced = "synced"
+	SyncStatusFailed = "failed"
+	// SyncStatusRemoved is the status of users whose lead was removed, the lead id of the state is stale
+	SyncStatusRemoved = "removed"
+)
+
+// SyncState - the state of a user as it was last synced to Marketo
+type SyncState struct {
+	UserID      string                 `json:"userId" bson:"userId"`
+	Email       string                 `json:"email" bson:"email"`
+	LeadID      int                    `json:"leadId,omitempty" bson:"leadId,omitempty"`
+	InputHash   string                 `json:"inputHash,omitempty" bson:"inputHash,omitempty"`
+	Payload     map[string]interface{} `json:"payload,omitempty" bson:"payload,omitempty"`
+	Status      string                 `json:"status" bson:"status"`
+	Error       string                 `json:"error,omitempty" bson:"error"`
+	SyncedTime  time.Time              `json:"syncedTime" bson:"syncedTime"`
+	UpdatedTime time.Time              `json:"updatedTime" bson:"updatedTime"`
+	// Memberships are the ids of the clinics whose membership objects were last synced. It's nil if
+	// the memberships of the user were never synced.
+	Memberships []string `json:"memberships,omitempty" bson:"memberships,omitempty"`
+	// MembershipsHash is the hash of the memberships which were last synced
+	MembershipsHash string `json:"membershipsHash,omitempty" bson:"membershipsHash,omitempty"`
+}
+
+// SyncStateRepository - persists the Tidepool to Marketo lead mapping and the last synced state of each user
+type SyncStateRepository interface {
+	FindSyncState(ctx context.Context, userID string) (*SyncState, error)
+	UpsertSyncState(ctx context.Context, state *SyncState) error
+	UpdateSyncStatus(ctx context.Context, userID string, status string, syncErr string) error
+	UpdateSyncStateMemberships(ctx context.Context, userID string, clinicIDs []string, hash string) error
+}
+
+var _ SyncStateRepository = &MongoStoreClient{}
+
+func syncStatesCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(syncStatesCollectionName)
+}
+
+// FindSyncState - find the last synced state of a user, returns nil if the user was never synced
+func (msc *MongoStoreClient) FindSyncState(ctx context.Context, userID string) (*SyncState, error) {
+	var result *SyncState
+	err := syncStatesCollection(msc).FindOne(ctx, bson.M{"userId": userID}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return result, err
+}
+
+// UpsertSyncState - replace the last synced state of a user
+func (msc *MongoStoreClient) UpsertSyncState(ctx context.Context, state *SyncState) error {
+	if state.UpdatedTime.IsZero() {
+		state.UpdatedTime = time.Now()
+	}
+	opts := options.Update().SetUpsert(true)
+	_, err := syncStatesCollection(msc).UpdateOne(ctx, bson.M{"userId": state.UserID}, bson.D{{Key: "$set", Value: state}}, opts)
+	return err
+}
+
+// UpdateSyncStatus - update the status of the last sync attempt without modifying the last synced state
+func (msc *MongoStoreClient) UpdateSyncStatus(ctx context.Context, userID string, status string, syncErr string) error {
+	update := bson.M{
+		"$set": bson.M{
+			"status":      status,
+			"error":       syncErr,
+			"updatedTime": time.Now(),
+		},
+	}
+	opts := options.Update().SetUpsert(true)
+	_, err := syncStatesCollection(msc).UpdateOne(ctx, bson.M{"userId": userID}, update, opts)
+	return err
+}
+
+// UpdateSyncStateMemberships - record the clinic ids and the hash of the synced memberships without modifying the last synced state
+func (msc *MongoStoreClient) UpdateSyncStateMemberships(ctx context.Context, userID string, clinicIDs []string, hash string) error {
+	if clinicIDs == nil {
+		clinicIDs = []string{}
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"memberships":     clinicIDs,
+			"membershipsHash": hash,
+			"updatedTime":     time.Now(),
+		},
+	}
+	_, err := syncStatesCollection(msc).UpdateOne(ctx, bson.M{"userId": userID}, update)
+	return err
+}
+
+// ListSyncStates - find and return a page of sync states ordered by user id, starting after the given user id
+func (msc *MongoStoreClient) ListSyncStates(ctx context.Context, afterUserID string, limit int) (results []*SyncState, err error) {
+	selector := bson.M{}
+	if afterUserID != "" {
+		selector["userId"] = bson.M{"$gt": afterUserID}
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "userId", Value: 1}}).
+		SetLimit(int64(limit))
+	cursor, err := syncStatesCollection(msc).Find(ctx, selector, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &results); err != nil {
+		return results, err
+	}
+	return results, nil
+}
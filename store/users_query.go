@@ -0,0 +1,141 @@
+package store
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultUsersBatchSize = 100
+
+// UsersFilter - selects the users returned by StreamUsers. Empty fields are not applied.
+type UsersFilter struct {
+	// ModifiedSince and ModifiedUntil select the users modified, or created if they
+	// were never modified, within the range. Times are compared as RFC3339 strings.
+	ModifiedSince string `json:"modifiedSince,omitempty"`
+	ModifiedUntil string `json:"modifiedUntil,omitempty"`
+	// Roles selects the users with any of the roles
+	Roles         []string `json:"roles,omitempty"`
+	TermsAccepted *bool    `json:"termsAccepted,omitempty"`
+	EmailVerified *bool    `json:"emailVerified,omitempty"`
+	UserIDs       []string `json:"userIds,omitempty"`
+}
+
+func (f *UsersFilter) selector() bson.M {
+	selector := bson.M{}
+	if f == nil {
+		return selector
+	}
+	if f.ModifiedSince != "" || f.ModifiedUntil != "" {
+		timeRange := bson.M{}
+		if f.ModifiedSince != "" {
+			timeRange["$gte"] = f.ModifiedSince
+		}
+		if f.ModifiedUntil != "" {
+			timeRange["$lt"] = f.ModifiedUntil
+		}
+		selector["$or"] = []bson.M{
+			{"modifiedTime": timeRange},
+			{"modifiedTime": bson.M{"$exists": false}, "createdTime": timeRange},
+		}
+	}
+	if len(f.Roles) > 0 {
+		selector["roles"] = bson.M{"$in": f.Roles}
+	}
+	if f.TermsAccepted != nil {
+		if *f.TermsAccepted {
+			selector["termsAccepted"] = bson.M{"$exists": true, "$ne": ""}
+		} else {
+			selector["termsAccepted"] = bson.M{"$in": bson.A{nil, ""}}
+		}
+	}
+	if f.EmailVerified != nil {
+		if *f.EmailVerified {
+			selector["authenticated"] = true
+		} else {
+			selector["authenticated"] = bson.M{"$ne": true}
+		}
+	}
+	if len(f.UserIDs) > 0 {
+		selector["userid"] = bson.M{"$in": f.UserIDs}
+	}
+	return selector
+}
+
+// UsersIterator - iterates over users in the order of their `_id`. The position of the
+// current user can be used to resume the iteration after it.
+type UsersIterator interface {
+	Next(ctx context.Context) bool
+	User() *User
+	Position() string
+	Err() error
+	Close(ctx context.Context) error
+}
+
+type usersCursor struct {
+	cursor *mongo.Cursor
+	user   *User
+	err    error
+}
+
+func (c *usersCursor) Next(ctx context.Context) bool {
+	if c.err != nil || !c.cursor.Next(ctx) {
+		return false
+	}
+	user := &User{}
+	if c.err = c.cursor.Decode(user); c.err != nil {
+		return false
+	}
+	c.user = user
+	return true
+}
+
+func (c *usersCursor) User() *User {
+	return c.user
+}
+
+func (c *usersCursor) Position() string {
+	if c.user == nil {
+		return ""
+	}
+	return c.user.ObjectID.Hex()
+}
+
+func (c *usersCursor) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.cursor.Err()
+}
+
+func (c *usersCursor) Close(ctx context.Context) error {
+	return c.cursor.Close(ctx)
+}
+
+// StreamUsers - iterate over the users matching the filter, starting after the given position.
+// Users are fetched from the database in batches of the given size.
+func (msc *MongoStoreClient) StreamUsers(ctx context.Context, filter *UsersFilter, after string, batchSize int) (UsersIterator, error) {
+	selector := filter.selector()
+	if after != "" {
+		id, err := primitive.ObjectIDFromHex(after)
+		if err != nil {
+			return nil, err
+		}
+		selector = bson.M{"$and": []bson.M{selector, {"_id": bson.M{"$gt": id}}}}
+	}
+	if batchSize <= 0 {
+		batchSize = defaultUsersBatchSize
+	}
+	opts := options.Find().
+		SetCollation(usersCollation).
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetBatchSize(int32(batchSize))
+	cursor, err := usersCollection(msc).Find(ctx, selector, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &usersCursor{cursor: cursor}, nil
+}